@@ -8,9 +8,11 @@ import (
 	"os"
 	"p2p-music/config"
 	"p2p-music/internal/peerdiscovery"
+	"p2p-music/internal/player"
 	"p2p-music/tui/model"
 	"time"
 
+	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/multiformats/go-multiaddr"
 
 	tea "github.com/charmbracelet/bubbletea"
@@ -23,6 +25,26 @@ func main() {
 		log.Fatal(err)
 	}
 
+	if hasCmdFlag("-reset-catalog") {
+		configs.ResetCatalog = true
+	}
+
+	if hasCmdFlag("-identity") || hasCmdFlag("-rotate-identity") {
+		if err := identityCmd(configs, hasCmdFlag("-rotate-identity")); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if hasCmdFlag("-new-swarm-key") {
+		path, err := peerdiscovery.NewSwarmKey(configs)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("Swarm key written to", path+", copy it to the data directory of every node of the network")
+		return
+	}
+
 	logger := slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{
 		AddSource: true,
 	}))
@@ -30,7 +52,12 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	h := peerdiscovery.SetupHost()
+	h := peerdiscovery.SetupHost(configs)
+
+	reachability, err := peerdiscovery.WatchReachability(ctx, h, logger)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	discoveryPeers := []multiaddr.Multiaddr{}
 
@@ -44,11 +71,18 @@ func main() {
 		fmt.Println("discovery PEER:", cmdPeer)
 	}
 
-	closeDB, songTable, ts := peerdiscovery.Bootstrap(ctx, h, discoveryPeers, configs, logger)
+	closeDB, songTable, ts, songManager := peerdiscovery.Bootstrap(ctx, h, discoveryPeers, configs, logger)
+
+	audioOutput, err := player.NewOutput(configs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	songPlayer := player.NewPlayer(audioOutput, logger)
+	defer songPlayer.Close()
 
 	time.Sleep(time.Second)
 
-	p := tea.NewProgram(model.InitTea(songTable, ts))
+	p := tea.NewProgram(model.InitTea(songTable, ts, songManager, songPlayer, reachability))
 	if _, err := p.Run(); err != nil {
 		fmt.Printf("Alas, there's been an error: %v", err)
 		os.Exit(1)
@@ -77,6 +111,40 @@ func getCmdPeerDiscovery() []string {
 	return peerDiscovery
 }
 
+// identityCmd prints the peer ID of the node, after replacing its key
+// with a new one when asked to rotate it.
+func identityCmd(configs *config.Config, rotate bool) error {
+	load := peerdiscovery.LoadIdentity
+	if rotate {
+		load = peerdiscovery.RotateIdentity
+	}
+
+	key, err := load(configs)
+	if err != nil {
+		return err
+	}
+
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if rotate {
+		fmt.Println("New peer ID, share it with the peers bootstrapping from this node:")
+	}
+	fmt.Println(id)
+	return nil
+}
+
+func hasCmdFlag(flag string) bool {
+	for _, arg := range os.Args[1:] {
+		if arg == flag {
+			return true
+		}
+	}
+	return false
+}
+
 func peerAddrPrefix(peerAddr string) string {
 	runePeerAddr := []rune(peerAddr)
 	if len(runePeerAddr) < 6 {
@@ -1,6 +1,8 @@
 package config
 
 import (
+	"time"
+
 	_ "github.com/joho/godotenv/autoload"
 	"github.com/kelseyhightower/envconfig"
 )
@@ -8,6 +10,81 @@ import (
 type Config struct {
 	MusicPath    string `envconfig:"MUSIC_PATH"`
 	TestFilePath string `envconfig:"TEST_FILE_PATH"`
+
+	// DataDir holds the node state, DBPath overrides where the database is
+	DataDir string `envconfig:"DATA_DIR" default:"data"`
+	DBPath  string `envconfig:"DB_PATH"`
+
+	// IdentityPath overrides where the private key of the node is, its
+	// peer ID stays the same as long as the key does
+	IdentityPath string `envconfig:"IDENTITY_PATH"`
+
+	// Transports the node listens and dials on: tcp, quic and websocket,
+	// by default tcp and quic, or only tcp in a private network. ListenAddrs
+	// default to a random port for each of them, set them to open a
+	// firewall rule, e.g. /ip4/0.0.0.0/udp/4001/quic-v1
+	Transports  []string `envconfig:"TRANSPORTS"`
+	ListenAddrs []string `envconfig:"LISTEN_ADDRS"`
+
+	// AnnounceAddrs replace the listen addresses the node announces, e.g.
+	// the public address of a port forward. NoAnnounceAddrs are left out,
+	// exact addresses or ranges like /ip4/10.0.0.0/ipcidr/8
+	AnnounceAddrs   []string `envconfig:"ANNOUNCE_ADDRS"`
+	NoAnnounceAddrs []string `envconfig:"NO_ANNOUNCE_ADDRS"`
+
+	// RelayService relays the connections of the nodes behind a NAT, for
+	// publicly reachable nodes. RelayClient reserves a slot on such relays,
+	// StaticRelays or else the connected peers, and HolePunching upgrades
+	// the relayed connections to direct ones
+	RelayService bool     `envconfig:"RELAY_SERVICE"`
+	RelayClient  bool     `envconfig:"RELAY_CLIENT" default:"true"`
+	StaticRelays []string `envconfig:"STATIC_RELAYS"`
+	HolePunching bool     `envconfig:"HOLE_PUNCHING" default:"true"`
+
+	// SwarmKeyPath is the pre-shared key of a private network, only nodes
+	// with the same key connect. By default DataDir/swarm.key when it
+	// exists
+	SwarmKeyPath string `envconfig:"SWARM_KEY_PATH"`
+
+	// DHTProtocolPrefix runs a DHT apart from the public one, e.g. /music
+	DHTProtocolPrefix string `envconfig:"DHT_PROTOCOL_PREFIX"`
+
+	// NetworkNamespace isolates the song table topics and the discovery
+	// names of a network
+	NetworkNamespace string `envconfig:"NETWORK_NAMESPACE"`
+
+	// MDNS finds and connects the nodes of the local network without
+	// bootstrap addresses
+	MDNS bool `envconfig:"MDNS" default:"true"`
+
+	// ResetCatalog wipes the cached network catalog on start
+	ResetCatalog bool `envconfig:"RESET_CATALOG"`
+
+	// AntiEntropyInterval between catalog reconciliations with a random
+	// peer, zero turns them off
+	AntiEntropyInterval time.Duration `envconfig:"ANTI_ENTROPY_INTERVAL" default:"1m"`
+
+	// GossipPublishRate of catalog operations a peer may publish per
+	// second after a burst of GossipPublishBurst, GossipMaxFieldLength
+	// bounds the song metadata fields
+	GossipPublishRate    float64 `envconfig:"GOSSIP_PUBLISH_RATE" default:"5"`
+	GossipPublishBurst   int     `envconfig:"GOSSIP_PUBLISH_BURST" default:"100"`
+	GossipMaxFieldLength int     `envconfig:"GOSSIP_MAX_FIELD_LENGTH" default:"256"`
+
+	// Gossipsub peer scoring: the score lost per rejected message, and the
+	// scores below which a peer gets no gossip, isn't published to, and is
+	// graylisted
+	GossipInvalidMessageWeight float64 `envconfig:"GOSSIP_INVALID_MESSAGE_WEIGHT" default:"-10"`
+	GossipThreshold            float64 `envconfig:"GOSSIP_THRESHOLD" default:"-10"`
+	GossipPublishThreshold     float64 `envconfig:"GOSSIP_PUBLISH_THRESHOLD" default:"-50"`
+	GossipGraylistThreshold    float64 `envconfig:"GOSSIP_GRAYLIST_THRESHOLD" default:"-80"`
+
+	// SeedDownloads makes verified downloads available to other peers
+	SeedDownloads bool `envconfig:"SEED_DOWNLOADS" default:"true"`
+
+	// AudioOutput is "device", "null" or "wav"
+	AudioOutput   string `envconfig:"AUDIO_OUTPUT" default:"device"`
+	WAVOutputPath string `envconfig:"WAV_OUTPUT_PATH" default:"output.wav"`
 }
 
 func LoadConfig() (*Config, error) {
@@ -1,23 +1,37 @@
 package db
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"log/slog"
+	"os"
+	"p2p-music/config"
 	"p2p-music/internal/song"
-	"strings"
+	"path/filepath"
+	"time"
 
 	"github.com/boltdb/bolt"
-	"github.com/google/uuid"
-	"github.com/hbollon/go-edlib"
 	"github.com/ipfs/go-cid"
 )
 
+// songsBucket keeps the songs by CID bytes. Titles aren't unique, older
+// databases kept them by title in legacySongsBucket, where songs sharing a
+// title replaced each other.
 const (
-	pathsBucket = "cid_to_path"
-	songsBucket = "songs_metadata"
+	pathsBucket       = "cid_to_path"
+	songsBucket       = "songs_by_cid"
+	legacySongsBucket = "songs_metadata"
+)
+
+const (
+	dbFileName = "catalog.db"
+
+	// dbLockTimeout is how long to wait for another instance to release
+	// the database file before giving up.
+	dbLockTimeout = time.Second
 )
 
 type Storage struct {
@@ -25,14 +39,22 @@ type Storage struct {
 	logger *slog.Logger
 }
 
-func InitDB(logger *slog.Logger) (*Storage, func() error, error) {
-	uuid := uuid.New()
+// InitDB opens the database at DB_PATH, or in DATA_DIR when it isn't set,
+// and keeps using the same file across restarts. The cached network
+// catalog is wiped only when ResetCatalog is set, local file paths are
+// always kept.
+func InitDB(cfg *config.Config, logger *slog.Logger) (*Storage, func() error, error) {
+	dbFile := dbPath(cfg)
+	if err := os.MkdirAll(filepath.Dir(dbFile), 0700); err != nil {
+		return nil, nil, err
+	}
 
-	//TODO: const db name; It's tmp desicion for testing multiple app instances
-	dbFile := fmt.Sprintf("cid_store_%s.db", uuid.String())
-	db, err := bolt.Open(dbFile, 0600, nil)
+	db, err := bolt.Open(dbFile, 0600, &bolt.Options{Timeout: dbLockTimeout})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, nil, fmt.Errorf("%w: %s", errDBLocked, dbFile)
+	}
 	if err != nil {
-		log.Fatal(err)
+		return nil, nil, err
 	}
 
 	closeDBConn := func() error {
@@ -43,80 +65,46 @@ func InitDB(logger *slog.Logger) (*Storage, func() error, error) {
 	}
 
 	err = db.Update(func(tx *bolt.Tx) error {
-		tx.DeleteBucket([]byte(songsBucket))
+		if cfg.ResetCatalog {
+			for _, bucket := range []string{songsBucket, legacySongsBucket, catalogBucket, legacyCatalogTitleBucket} {
+				if err := tx.DeleteBucket([]byte(bucket)); err != nil && err != bolt.ErrBucketNotFound {
+					return err
+				}
+			}
+			logger.Info("Wiped cached network catalog", "path", dbFile)
+		}
 
-		if _, err := tx.CreateBucketIfNotExists([]byte(pathsBucket)); err != nil {
-			return err
+		for _, bucket := range []string{pathsBucket, songsBucket, catalogBucket} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(bucket)); err != nil {
+				return err
+			}
 		}
-		if _, err := tx.CreateBucketIfNotExists([]byte(songsBucket)); err != nil {
-			return err
+		if cfg.ResetCatalog {
+			return reindexSongs(tx)
+		}
+		if tx.Bucket([]byte(legacySongsBucket)) != nil {
+			return migrateSongsBucket(tx)
 		}
 
-		return nil
+		return createIndexBuckets(tx)
 	})
 	if err != nil {
 		return nil, closeDBConn, err
 	}
 
+	logger.Info("Opened database", "path", dbFile)
+
 	return &Storage{
 		db:     db,
 		logger: logger,
 	}, closeDBConn, nil
 }
 
-func (s *Storage) AddSong(ctx context.Context, pSong song.Song) (song.Song, error) {
-	var aSong song.Song
-
-	err := s.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(songsBucket))
-
-		if existingSong, ok := s.checkSongIfExists(ctx, pSong); ok {
-			aSong = existingSong
-			return nil
-		}
-
-		songBytes, err := json.Marshal(pSong)
-		if err != nil {
-			return err
-		}
-		aSong = pSong
-
-		return b.Put([]byte(pSong.Title), songBytes)
-	})
-	if err != nil {
-		return song.Song{}, err
+func dbPath(cfg *config.Config) string {
+	if cfg.DBPath != "" {
+		return cfg.DBPath
 	}
-
-	return aSong, nil
-}
-
-// func (s *Storage) UpdateSong(ctx context.Context, song song.Song) error {
-// 	return nil
-// }
-
-func (s *Storage) CreateSongsList(ctx context.Context, songs []song.Song) error {
-	return s.db.Batch(func(tx *bolt.Tx) error {
-		for _, song := range songs {
-			b := tx.Bucket([]byte(songsBucket))
-
-			if existing := b.Get([]byte(song.Title)); existing != nil {
-				s.logger.Warn("Song already exists", "title", song.Title)
-				continue
-			}
-
-			songBytes, err := json.Marshal(song)
-			if err != nil {
-				s.logger.Error("Failed to marshal song", "err", err)
-				return err
-			}
-
-			if err := b.Put([]byte(song.Title), songBytes); err != nil {
-				s.logger.Error("Failed to put song", "err", err)
-				return err
-			}
-		}
-		return nil
-	})
+	return filepath.Join(cfg.DataDir, dbFileName)
 }
 
 func (s *Storage) GetSongsList(ctx context.Context) ([]song.Song, error) {
@@ -141,121 +129,154 @@ func (s *Storage) GetSongsList(ctx context.Context) ([]song.Song, error) {
 	return songs, err
 }
 
-func (s *Storage) FindSongByTitle(ctx context.Context, title string) (song.Song, error) {
-	var songFound song.Song
+// GetSongsPage returns up to limit songs stored after the CID, in CID
+// order, so the table can be walked without loading it whole. An undefined
+// CID starts from the first song.
+func (s *Storage) GetSongsPage(ctx context.Context, after cid.Cid, limit int) ([]song.Song, error) {
+	var songs []song.Song
 
 	err := s.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(songsBucket))
+		c := tx.Bucket([]byte(songsBucket)).Cursor()
 
-		return b.ForEach(func(k, v []byte) error {
-			if string(k) == title {
-				if err := json.Unmarshal(v, &songFound); err != nil {
-					s.logger.Error("Failed to unmarshal found song", "err", err)
-				}
+		var k, v []byte
+		if after.Defined() {
+			k, v = c.Seek(after.Bytes())
+			if k != nil && bytes.Equal(k, after.Bytes()) {
+				k, v = c.Next()
 			}
+		} else {
+			k, v = c.First()
+		}
 
-			return nil
-		})
+		for ; k != nil && len(songs) < limit; k, v = c.Next() {
+			var song song.Song
+			if err := json.Unmarshal(v, &song); err != nil {
+				s.logger.Error("Failed to unmarshal stored song", "err", err)
+				continue
+			}
+			songs = append(songs, song)
+		}
+		return nil
 	})
 
-	if (songFound == song.Song{}) {
-		return song.Song{}, errSongNotFound
-	}
-
-	return songFound, err
+	return songs, err
 }
 
-func (s *Storage) FindSongByCID(ctx context.Context, cid cid.Cid) (song.Song, error) {
-	var sng song.Song
+// FindSongByTitle returns the song with the title, the one with the
+// lowest CID when several songs share it.
+func (s *Storage) FindSongByTitle(ctx context.Context, title string) (song.Song, error) {
+	var songFound song.Song
 
 	err := s.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(songsBucket))
-
-		return b.ForEach(func(k, v []byte) error {
+		c := tx.Bucket([]byte(songsBucket)).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
 			var vSong song.Song
 			if err := json.Unmarshal(v, &vSong); err != nil {
-				s.logger.Error("Failed to unmarshal found song", "err", err)
+				s.logger.Error("Failed to unmarshal stored song", "err", err)
+				continue
+			}
+			if vSong.Title == title {
+				songFound = vSong
 				return nil
 			}
+		}
+		return errSongNotFound
+	})
+	if err != nil {
+		return song.Song{}, err
+	}
 
-			if vSong.CID.Equals(cid) {
-				sng = vSong
-			}
+	return songFound, nil
+}
 
-			return nil
-		})
+func (s *Storage) FindSongByCID(ctx context.Context, cid cid.Cid) (song.Song, error) {
+	var sng song.Song
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		songs, err := getSongs(tx, [][]byte{cid.Bytes()})
+		if err != nil || len(songs) == 0 {
+			return err
+		}
+		sng = songs[0]
+		return nil
 	})
+	if err != nil {
+		return song.Song{}, err
+	}
 
 	if (sng == song.Song{}) {
 		return song.Song{}, fmt.Errorf("couldn't find song by CID: %s", cid.String())
 	}
 
-	return sng, err
+	return sng, nil
 }
 
-// TODO: think about cuncurrent search :: search data by uploading batches of songs in-memory
-func (s *Storage) FindSongsByTitle(ctx context.Context, title string) ([]song.Song, error) {
+// FindSongsByArtist returns the songs of the artist, ignoring case.
+func (s *Storage) FindSongsByArtist(ctx context.Context, artist string) ([]song.Song, error) {
+	return s.findSongsByIndex(artistIndexBucket, normalizeIndexValue(artist))
+}
+
+// FindSongsByAlbum returns the songs of the album, ignoring case.
+func (s *Storage) FindSongsByAlbum(ctx context.Context, album string) ([]song.Song, error) {
+	return s.findSongsByIndex(albumIndexBucket, normalizeIndexValue(album))
+}
+
+func (s *Storage) FindSongsByYear(ctx context.Context, year int) ([]song.Song, error) {
+	return s.findSongsByIndex(yearIndexBucket, yearIndexValue(year))
+}
+
+func (s *Storage) findSongsByIndex(bucket string, value []byte) ([]song.Song, error) {
 	var songs []song.Song
 
 	err := s.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(songsBucket))
+		var err error
+		songs, err = getSongs(tx, scanIndex(tx, bucket, value))
+		return err
+	})
 
-		return b.ForEach(func(k, v []byte) error {
-			if strings.ContainsAny(string(k), title) {
-				var song song.Song
-				if err := json.Unmarshal(v, &song); err != nil {
-					s.logger.Error("Failed to unmarshal found song", "err", err)
-				}
-				songs = append(songs, song)
-			}
+	return songs, err
+}
 
-			return nil
-		})
-	})
+// FindSongsByTitle returns the songs with the title as a case-insensitive
+// substring.
+func (s *Storage) FindSongsByTitle(ctx context.Context, title string) ([]song.Song, error) {
+	songs, err := s.FindSongsWithParams(ctx, song.SongQuery{Template: song.Song{Title: title}})
 
 	s.logger.Info("The amount of songs for title", "title", title, "amount", len(songs))
 
 	return songs, err
 }
 
-// TODO: implement:)
-func (s *Storage) FindSongsWithParams(context.Context, song.Song) ([]song.Song, error) {
-	return nil, nil
-}
-
-func (s *Storage) checkSongIfExists(ctx context.Context, songParam song.Song) (song.Song, bool) {
-	var existingSong song.Song
+// FindSongsWithParams returns the page of songs matching the query. Year
+// filters are served from the year index, everything else is matched
+// against the songs it yields.
+func (s *Storage) FindSongsWithParams(ctx context.Context, query song.SongQuery) ([]song.Song, error) {
+	var candidates []song.Song
 
 	err := s.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(songsBucket))
-
-		return b.ForEach(func(k, v []byte) error {
-			var vSong song.Song
-			if err := json.Unmarshal(v, &vSong); err != nil {
-				s.logger.Error("Failed to unmarshal found song", "err", err)
-			}
-
-			match, err := edlib.StringsSimilarity(string(k), songParam.Title, edlib.JaroWinkler)
-			if err != nil {
-				s.logger.Error("Failed to compare songs titles", "err", err)
-			}
+		from, to := query.YearRange()
+		if from == 0 && to == 0 {
+			return tx.Bucket([]byte(songsBucket)).ForEach(func(k, v []byte) error {
+				var vSong song.Song
+				if err := json.Unmarshal(v, &vSong); err != nil {
+					s.logger.Error("Failed to unmarshal found song", "err", err)
+					return nil
+				}
 
-			if match > 0.8 {
-				existingSong = vSong
-				return nil
-			} else if vSong.CID == songParam.CID {
-				existingSong = vSong
+				candidates = append(candidates, vSong)
 				return nil
-			}
+			})
+		}
 
-			return nil
-		})
+		var err error
+		candidates, err = getSongs(tx, scanYearRange(tx, from, to))
+		return err
 	})
-	if err != nil || existingSong.Title == "" || (existingSong.CID == cid.Undef) {
-		return existingSong, false
+	if err != nil {
+		return nil, err
 	}
 
-	return existingSong, true
+	return query.Apply(candidates), nil
 }
 
 func (s *Storage) SaveFilePath(ctx context.Context, CID cid.Cid, path string) error {
@@ -266,6 +287,27 @@ func (s *Storage) SaveFilePath(ctx context.Context, CID cid.Cid, path string) er
 	return nil
 }
 
+func (s *Storage) ListFilePaths(ctx context.Context) (map[cid.Cid]string, error) {
+	paths := make(map[cid.Cid]string)
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(pathsBucket))
+
+		return b.ForEach(func(k, v []byte) error {
+			c, err := cid.Cast(k)
+			if err != nil {
+				s.logger.Error("Failed to parse stored CID", "err", err)
+				return nil
+			}
+
+			paths[c] = string(v)
+			return nil
+		})
+	})
+
+	return paths, err
+}
+
 func (s *Storage) FindFilePath(ctx context.Context, CID cid.Cid) (string, error) {
 	var path string
 
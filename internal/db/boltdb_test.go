@@ -1,13 +1,24 @@
 package db
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
+	"io"
 	"log/slog"
+	"p2p-music/config"
 	"p2p-music/internal/song"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/boltdb/bolt"
 	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
 
 	"github.com/stretchr/testify/require"
 )
@@ -16,8 +27,8 @@ const (
 	testDBName = "boltdb_test.db"
 )
 
-func MustOpenDB() *Storage {
-	db, err := bolt.Open(testDBName, 0600, nil)
+func MustOpenDB(tb testing.TB) *Storage {
+	db, err := bolt.Open(filepath.Join(tb.TempDir(), testDBName), 0600, nil)
 	if err != nil {
 		panic(err)
 	}
@@ -38,14 +49,13 @@ func (s *Storage) createBuckets() error {
 	return s.db.Update(func(tx *bolt.Tx) error {
 		tx.DeleteBucket([]byte(songsBucket))
 
-		if _, err := tx.CreateBucketIfNotExists([]byte(pathsBucket)); err != nil {
-			return err
-		}
-		if _, err := tx.CreateBucketIfNotExists([]byte(songsBucket)); err != nil {
-			return err
+		for _, bucket := range []string{pathsBucket, songsBucket, catalogBucket} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(bucket)); err != nil {
+				return err
+			}
 		}
 
-		return nil
+		return reindexSongs(tx)
 	})
 }
 
@@ -53,157 +63,18 @@ func (s *Storage) deleteBuckets() {
 	s.db.Update(func(tx *bolt.Tx) error {
 		tx.DeleteBucket([]byte(pathsBucket))
 		tx.DeleteBucket([]byte(songsBucket))
+		tx.DeleteBucket([]byte(catalogBucket))
+		for _, bucket := range indexBuckets {
+			tx.DeleteBucket([]byte(bucket))
+		}
 		return nil
 	})
 }
 
-func TestAddSong(t *testing.T) {
-	ctx, _ := context.WithCancel(context.Background())
-
-	db := MustOpenDB()
-	defer db.MustClose()
-
-	dummyCid, err := cid.Parse("QmUNLLsPACCz1vLxQVkXqqLX5R1X345qqfHbsf67hvA3Nn")
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	testCases := []struct {
-		name     string
-		song     song.Song
-		testFunc func(song.Song) (song.Song, error)
-		wantErr  error
-	}{
-		{
-			name: "1. AddSong: success",
-			song: song.Song{
-				Title: "test_title_1",
-				CID:   dummyCid,
-			},
-			testFunc: func(s song.Song) (song.Song, error) {
-				saved, err := db.AddSong(ctx, s)
-				if err != nil {
-					return saved, err
-				}
-				return saved, err
-			},
-			wantErr: nil,
-		},
-		{
-			name: "2. AddSong: error: duplicate key",
-			song: song.Song{
-				Title: "test_title_1",
-				CID:   dummyCid,
-			},
-			testFunc: func(s song.Song) (song.Song, error) {
-				_, err := db.AddSong(ctx, s)
-				if err != nil {
-					return song.Song{}, err
-				}
-
-				sCopy := song.Song{
-					Title: s.Title,
-				}
-				duplicateTitleSave, err := db.AddSong(ctx, sCopy)
-				if err != nil {
-					return duplicateTitleSave, err
-				}
-				return duplicateTitleSave, err
-			},
-			wantErr: nil,
-		},
-	}
-
-	for _, tc := range testCases {
-		if tc.testFunc == nil {
-			continue
-		}
-
-		err := db.createBuckets()
-		require.NoError(t, err)
-
-		t.Run(tc.name, func(t *testing.T) {
-			saved, err := tc.testFunc(tc.song)
-			if tc.wantErr != nil {
-				require.EqualError(t, err, tc.wantErr.Error())
-				return
-			}
-			require.Equal(t, tc.song.CID, saved.CID)
-			require.NoError(t, err)
-		})
-
-		db.deleteBuckets()
-	}
-}
-
-func TestCreateSongsList(t *testing.T) {
-	ctx, _ := context.WithCancel(context.Background())
-
-	db := MustOpenDB()
-	defer db.MustClose()
-
-	dummyCid, err := cid.Parse("QmUNLLsPACCz1vLxQVkXqqLX5R1X345qqfHbsf67hvA3Nn")
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	testCases := []struct {
-		name     string
-		songs    []song.Song
-		testFunc func([]song.Song) error
-		wantErr  error
-	}{
-		{
-			name: "1. CreateSongsList: success",
-			songs: []song.Song{
-				{
-					Title: "test_title_1",
-					CID:   dummyCid,
-				},
-				{
-					Title: "test_title_2",
-					CID:   dummyCid,
-				},
-				{
-					Title: "test_title_3",
-					CID:   dummyCid,
-				},
-			},
-			testFunc: func(songs []song.Song) error {
-				if err := db.CreateSongsList(ctx, songs); err != nil {
-					return err
-				}
-				return nil
-			},
-			wantErr: nil,
-		},
-	}
-
-	for _, tc := range testCases {
-		if tc.testFunc == nil {
-			continue
-		}
-
-		err := db.createBuckets()
-		require.NoError(t, err)
-
-		t.Run(tc.name, func(t *testing.T) {
-			err := tc.testFunc(tc.songs)
-			if tc.wantErr != nil {
-				require.EqualError(t, err, tc.wantErr.Error())
-				return
-			}
-			require.NoError(t, err)
-		})
-
-		db.deleteBuckets()
-	}
-}
-
 func TestFindSongByTitle(t *testing.T) {
-	ctx, _ := context.WithCancel(context.Background())
+	ctx := context.Background()
 
-	db := MustOpenDB()
+	db := MustOpenDB(t)
 	defer db.MustClose()
 
 	dummyCid, err := cid.Parse("QmUNLLsPACCz1vLxQVkXqqLX5R1X345qqfHbsf67hvA3Nn")
@@ -224,9 +95,7 @@ func TestFindSongByTitle(t *testing.T) {
 				CID:   dummyCid,
 			},
 			testFunc: func(s song.Song) (song.Song, error) {
-				if _, err := db.AddSong(ctx, s); err != nil {
-					return song.Song{}, err
-				}
+				db.mustAddSongs(t, s)
 
 				s, err := db.FindSongByTitle(ctx, s.Title)
 				if err != nil {
@@ -278,16 +147,11 @@ func TestFindSongByTitle(t *testing.T) {
 }
 
 func TestGetSongsList(t *testing.T) {
-	ctx, _ := context.WithCancel(context.Background())
+	ctx := context.Background()
 
-	db := MustOpenDB()
+	db := MustOpenDB(t)
 	defer db.MustClose()
 
-	dummyCid, err := cid.Parse("QmUNLLsPACCz1vLxQVkXqqLX5R1X345qqfHbsf67hvA3Nn")
-	if err != nil {
-		t.Fatal(err)
-	}
-
 	testCases := []struct {
 		name     string
 		songs    []song.Song
@@ -299,21 +163,19 @@ func TestGetSongsList(t *testing.T) {
 			songs: []song.Song{
 				{
 					Title: "test_title_1",
-					CID:   dummyCid,
+					CID:   testSongCID(t, 1),
 				},
 				{
 					Title: "test_title_2",
-					CID:   dummyCid,
+					CID:   testSongCID(t, 2),
 				},
 				{
 					Title: "test_title_3",
-					CID:   dummyCid,
+					CID:   testSongCID(t, 3),
 				},
 			},
 			testFunc: func(s []song.Song) ([]song.Song, error) {
-				if err := db.CreateSongsList(ctx, s); err != nil {
-					return nil, err
-				}
+				db.mustAddSongs(t, s...)
 
 				songs, err := db.GetSongsList(ctx)
 				if err != nil {
@@ -328,15 +190,15 @@ func TestGetSongsList(t *testing.T) {
 			songs: []song.Song{
 				{
 					Title: "test_title_1",
-					CID:   dummyCid,
+					CID:   testSongCID(t, 1),
 				},
 				{
 					Title: "test_title_2",
-					CID:   dummyCid,
+					CID:   testSongCID(t, 2),
 				},
 				{
 					Title: "test_title_3",
-					CID:   dummyCid,
+					CID:   testSongCID(t, 3),
 				},
 			},
 			testFunc: func(s []song.Song) ([]song.Song, error) {
@@ -370,7 +232,7 @@ func TestGetSongsList(t *testing.T) {
 			if tc.wantErr == errTestArraysNotEqual {
 				require.NotEqual(t, tc.songs, songs)
 			} else {
-				require.Equal(t, tc.songs, songs)
+				require.ElementsMatch(t, tc.songs, songs)
 			}
 		})
 
@@ -379,3 +241,426 @@ func TestGetSongsList(t *testing.T) {
 }
 
 func TestFindSongsByTitle(t *testing.T) {}
+
+func TestInitDB(t *testing.T) {
+	ctx := context.Background()
+
+	dummyCid, err := cid.Parse("QmUNLLsPACCz1vLxQVkXqqLX5R1X345qqfHbsf67hvA3Nn")
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name         string
+		resetCatalog bool
+		wantSongs    int
+	}{
+		{
+			name:      "1. InitDB: catalog kept across restarts",
+			wantSongs: 1,
+		},
+		{
+			name:         "2. InitDB: catalog wiped on reset",
+			resetCatalog: true,
+			wantSongs:    0,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &config.Config{DataDir: filepath.Join(t.TempDir(), "data")}
+
+			store, closeDB, err := InitDB(cfg, slog.Default())
+			require.NoError(t, err)
+
+			store.mustAddSongs(t, song.Song{Title: "test_title_1", CID: dummyCid})
+			require.NoError(t, store.SaveFilePath(ctx, dummyCid, "/music/test_title_1.mp3"))
+			require.NoError(t, closeDB())
+
+			cfg.ResetCatalog = tc.resetCatalog
+			store, closeDB, err = InitDB(cfg, slog.Default())
+			require.NoError(t, err)
+			defer closeDB()
+
+			songs, err := store.GetSongsList(ctx)
+			require.NoError(t, err)
+			require.Len(t, songs, tc.wantSongs)
+
+			// local files are never wiped
+			path, err := store.FindFilePath(ctx, dummyCid)
+			require.NoError(t, err)
+			require.Equal(t, "/music/test_title_1.mp3", path)
+		})
+	}
+}
+
+func TestInitDBMigratesTitleKeys(t *testing.T) {
+	ctx := context.Background()
+	cfg := &config.Config{DBPath: filepath.Join(t.TempDir(), "catalog.db")}
+
+	teardrop := song.Song{Title: "Teardrop", Artist: "Massive Attack", CID: testSongCID(t, 1)}
+	cover := song.Song{Title: "Teardrop", Artist: "José González", CID: testSongCID(t, 2)}
+
+	// the title clash hid the cover in the view of an older database
+	db, err := bolt.Open(cfg.DBPath, 0600, nil)
+	require.NoError(t, err)
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		songs, err := tx.CreateBucket([]byte(legacySongsBucket))
+		if err != nil {
+			return err
+		}
+		teardropBytes, _ := json.Marshal(teardrop)
+		if err := songs.Put([]byte(teardrop.Title), teardropBytes); err != nil {
+			return err
+		}
+
+		catalog, err := tx.CreateBucket([]byte(catalogBucket))
+		if err != nil {
+			return err
+		}
+		entry := song.CatalogEntry{}
+		entry.Apply(song.CatalogOp{Kind: song.CatalogAdd, CID: cover.CID, Tag: "c1", Song: cover, Clock: song.Clock{Time: 1}})
+		entryBytes, _ := json.Marshal(entry)
+		if err := catalog.Put(cover.CID.Bytes(), entryBytes); err != nil {
+			return err
+		}
+
+		_, err = tx.CreateBucket([]byte(legacyCatalogTitleBucket))
+		return err
+	}))
+	require.NoError(t, db.Close())
+
+	store, closeDB, err := InitDB(cfg, slog.Default())
+	require.NoError(t, err)
+	defer closeDB()
+
+	songs, err := store.GetSongsList(ctx)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []song.Song{teardrop, cover}, songs)
+
+	found, err := store.FindSongsByArtist(ctx, "josé gonzález")
+	require.NoError(t, err)
+	require.Equal(t, []song.Song{cover}, found)
+}
+
+func TestInitDBLocked(t *testing.T) {
+	cfg := &config.Config{DBPath: filepath.Join(t.TempDir(), "catalog.db")}
+
+	_, closeDB, err := InitDB(cfg, slog.Default())
+	require.NoError(t, err)
+	defer closeDB()
+
+	_, _, err = InitDB(cfg, slog.Default())
+	require.ErrorIs(t, err, errDBLocked)
+	require.ErrorContains(t, err, cfg.DBPath)
+}
+
+func TestFindSongsByIndex(t *testing.T) {
+	ctx := context.Background()
+
+	db := MustOpenDB(t)
+	defer db.MustClose()
+
+	require.NoError(t, db.createBuckets())
+	defer db.deleteBuckets()
+
+	songs := []song.Song{
+		{Title: "Paranoid Android", Artist: "Radiohead", Album: "OK Computer", Year: 1997, CID: testSongCID(t, 1)},
+		{Title: "Karma Police", Artist: "radiohead ", Album: "OK Computer", Year: 1997, CID: testSongCID(t, 2)},
+		{Title: "Teardrop", Artist: "Massive Attack", Album: "Mezzanine", Year: 1998, CID: testSongCID(t, 3)},
+	}
+	db.mustAddSongs(t, songs...)
+
+	// moved to another album, the old index entries must go
+	moved := songs[2]
+	moved.Album = "Collected"
+	db.mustEditSong(t, moved)
+
+	testCases := []struct {
+		name      string
+		find      func() ([]song.Song, error)
+		wantTitle []string
+	}{
+		{
+			name:      "1. FindSongsByArtist: case-insensitive",
+			find:      func() ([]song.Song, error) { return db.FindSongsByArtist(ctx, "RADIOHEAD") },
+			wantTitle: []string{"Karma Police", "Paranoid Android"},
+		},
+		{
+			name:      "2. FindSongsByAlbum: updated song",
+			find:      func() ([]song.Song, error) { return db.FindSongsByAlbum(ctx, "collected") },
+			wantTitle: []string{"Teardrop"},
+		},
+		{
+			name: "3. FindSongsByAlbum: stale entry removed",
+			find: func() ([]song.Song, error) { return db.FindSongsByAlbum(ctx, "Mezzanine") },
+		},
+		{
+			name:      "4. FindSongsByYear: success",
+			find:      func() ([]song.Song, error) { return db.FindSongsByYear(ctx, 1998) },
+			wantTitle: []string{"Teardrop"},
+		},
+		{
+			name: "5. FindSongsByYear: no prefix collisions",
+			find: func() ([]song.Song, error) { return db.FindSongsByYear(ctx, 19) },
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			found, err := tc.find()
+			require.NoError(t, err)
+
+			var titles []string
+			for _, s := range found {
+				titles = append(titles, s.Title)
+			}
+			require.ElementsMatch(t, tc.wantTitle, titles)
+		})
+	}
+
+	found, err := db.FindSongByCID(ctx, songs[1].CID)
+	require.NoError(t, err)
+	require.Equal(t, songs[1], found)
+}
+
+// mustAddSongs adds the songs to the catalog, which stores them in the
+// songs view.
+func (s *Storage) mustAddSongs(tb testing.TB, songs ...song.Song) {
+	tb.Helper()
+
+	entries := make([]song.CatalogEntry, 0, len(songs))
+	for _, added := range songs {
+		var entry song.CatalogEntry
+		entry.Apply(song.CatalogOp{Kind: song.CatalogAdd, CID: added.CID, Tag: "t", Song: added, Clock: song.Clock{Time: 1}})
+		entries = append(entries, entry)
+	}
+	require.NoError(tb, s.MergeCatalogEntries(context.Background(), entries))
+}
+
+// mustEditSong edits the metadata of the song in the catalog.
+func (s *Storage) mustEditSong(tb testing.TB, edited song.Song) {
+	tb.Helper()
+
+	_, err := s.ApplyCatalogOp(context.Background(), song.CatalogOp{Kind: song.CatalogUpdate, CID: edited.CID, Song: edited, Clock: song.Clock{Time: 2}})
+	require.NoError(tb, err)
+}
+
+func testSongCID(tb testing.TB, i int) cid.Cid {
+	tb.Helper()
+
+	hash, err := multihash.Sum([]byte(strconv.Itoa(i)), multihash.SHA2_256, -1)
+	require.NoError(tb, err)
+	return cid.NewCidV1(cid.Raw, hash)
+}
+
+const benchmarkSongs = 20000
+
+func openBenchmarkDB(b *testing.B) *Storage {
+	b.Helper()
+
+	store, closeDB, err := InitDB(&config.Config{DataDir: b.TempDir()}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	require.NoError(b, err)
+	b.Cleanup(func() { closeDB() })
+
+	songs := make([]song.Song, 0, benchmarkSongs)
+	for i := range benchmarkSongs {
+		songs = append(songs, song.Song{
+			Title:  fmt.Sprintf("Song %d", i),
+			Artist: fmt.Sprintf("Artist %d", i%500),
+			Album:  fmt.Sprintf("Album %d", i%2000),
+			Year:   1950 + i%70,
+			CID:    testSongCID(b, i),
+		})
+	}
+	store.mustAddSongs(b, songs...)
+
+	return store
+}
+
+// scanSongs is the full bucket scan lookups did before the indexes.
+func (s *Storage) scanSongs(match func(song.Song) bool) ([]song.Song, error) {
+	var songs []song.Song
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(songsBucket)).ForEach(func(k, v []byte) error {
+			var vSong song.Song
+			if err := json.Unmarshal(v, &vSong); err != nil {
+				return err
+			}
+			if match(vSong) {
+				songs = append(songs, vSong)
+			}
+			return nil
+		})
+	})
+
+	return songs, err
+}
+
+func BenchmarkFindSongByCID(b *testing.B) {
+	ctx := context.Background()
+	store := openBenchmarkDB(b)
+	target := testSongCID(b, benchmarkSongs/2)
+
+	b.Run("index", func(b *testing.B) {
+		for b.Loop() {
+			if _, err := store.FindSongByCID(ctx, target); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("scan", func(b *testing.B) {
+		for b.Loop() {
+			if _, err := store.scanSongs(func(s song.Song) bool { return s.CID.Equals(target) }); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkFindSongsByArtist(b *testing.B) {
+	ctx := context.Background()
+	store := openBenchmarkDB(b)
+
+	b.Run("index", func(b *testing.B) {
+		for b.Loop() {
+			if _, err := store.FindSongsByArtist(ctx, "artist 42"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("scan", func(b *testing.B) {
+		for b.Loop() {
+			if _, err := store.scanSongs(func(s song.Song) bool { return strings.EqualFold(s.Artist, "artist 42") }); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkApplyCatalogOp(b *testing.B) {
+	ctx := context.Background()
+	store := openBenchmarkDB(b)
+
+	i := benchmarkSongs
+	for b.Loop() {
+		s := song.Song{Title: fmt.Sprintf("Song %d", i), Artist: "Artist", CID: testSongCID(b, i)}
+		if _, err := store.ApplyCatalogOp(ctx, song.CatalogOp{Kind: song.CatalogAdd, CID: s.CID, Tag: "t", Song: s, Clock: song.Clock{Time: 1}}); err != nil {
+			b.Fatal(err)
+		}
+		i++
+	}
+}
+
+func TestFindSongsWithParams(t *testing.T) {
+	ctx := context.Background()
+
+	db := MustOpenDB(t)
+	defer db.MustClose()
+
+	require.NoError(t, db.createBuckets())
+	defer db.deleteBuckets()
+
+	songs := []song.Song{
+		{Title: "Paranoid Android", Artist: "Radiohead", Album: "OK Computer", Year: 1997, Format: song.FormatMP3, Bitrate: 320, Duration: 386 * time.Second, CID: testSongCID(t, 1)},
+		{Title: "Karma Police", Artist: "Radiohead", Album: "OK Computer", Year: 1997, Format: song.FormatMP3, Bitrate: 128, Duration: 264 * time.Second, CID: testSongCID(t, 2)},
+		{Title: "Teardrop", Artist: "Massive Attack", Album: "Mezzanine", Year: 1998, Format: song.FormatFLAC, Bitrate: 900, Duration: 330 * time.Second, CID: testSongCID(t, 3)},
+		{Title: "Angel", Artist: "Massive Attack", Album: "Mezzanine", Year: 1998, Format: song.FormatOGG, Bitrate: 160, Duration: 379 * time.Second, CID: testSongCID(t, 4)},
+		{Title: "One More Time", Artist: "Daft Punk", Album: "Discovery", Year: 2001, Format: song.FormatMP3, Bitrate: 256, Duration: 320 * time.Second, CID: testSongCID(t, 5)},
+	}
+	db.mustAddSongs(t, songs...)
+
+	testCases := []struct {
+		name      string
+		query     song.SongQuery
+		wantTitle []string
+	}{
+		{
+			name:      "1. FindSongsWithParams: case-insensitive artist substring",
+			query:     song.SongQuery{Template: song.Song{Artist: "ATTACK"}},
+			wantTitle: []string{"Angel", "Teardrop"},
+		},
+		{
+			name:      "2. FindSongsWithParams: title prefix",
+			query:     song.SongQuery{Template: song.Song{Title: "o"}, Match: song.MatchPrefix},
+			wantTitle: []string{"One More Time"},
+		},
+		{
+			name:      "3. FindSongsWithParams: year range from the index",
+			query:     song.SongQuery{YearFrom: 1998, YearTo: 2001, SortBy: song.SortByYear, Descending: true},
+			wantTitle: []string{"One More Time", "Teardrop", "Angel"},
+		},
+		{
+			name:      "4. FindSongsWithParams: format and bitrate floor",
+			query:     song.SongQuery{Template: song.Song{Format: "MP3", Bitrate: 200}},
+			wantTitle: []string{"One More Time", "Paranoid Android"},
+		},
+		{
+			name:      "5. FindSongsWithParams: duration range sorted by duration",
+			query:     song.SongQuery{DurationFrom: 5 * time.Minute, DurationTo: 6*time.Minute + 20*time.Second, SortBy: song.SortByDuration},
+			wantTitle: []string{"One More Time", "Teardrop", "Angel"},
+		},
+		{
+			name:      "6. FindSongsWithParams: limit and offset",
+			query:     song.SongQuery{SortBy: song.SortByBitrate, Offset: 1, Limit: 2},
+			wantTitle: []string{"Angel", "One More Time"},
+		},
+		{
+			name:  "7. FindSongsWithParams: offset past the end",
+			query: song.SongQuery{Offset: 10},
+		},
+		{
+			name:  "8. FindSongsWithParams: no single character matches",
+			query: song.SongQuery{Template: song.Song{Title: "xyz"}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			found, err := db.FindSongsWithParams(ctx, tc.query)
+			require.NoError(t, err)
+
+			var titles []string
+			for _, s := range found {
+				titles = append(titles, s.Title)
+			}
+			require.Equal(t, tc.wantTitle, titles)
+		})
+	}
+}
+
+func TestGetSongsPage(t *testing.T) {
+	ctx := context.Background()
+
+	db := MustOpenDB(t)
+	defer db.MustClose()
+
+	require.NoError(t, db.createBuckets())
+	defer db.deleteBuckets()
+
+	var songs []song.Song
+	for i := range 5 {
+		songs = append(songs, song.Song{Title: fmt.Sprintf("Song %d", i), CID: testSongCID(t, i)})
+	}
+	db.mustAddSongs(t, songs...)
+
+	slices.SortFunc(songs, func(a, b song.Song) int {
+		return bytes.Compare(a.CID.Bytes(), b.CID.Bytes())
+	})
+
+	var walked []song.Song
+	after := cid.Undef
+	for {
+		page, err := db.GetSongsPage(ctx, after, 2)
+		require.NoError(t, err)
+		if len(page) == 0 {
+			break
+		}
+		require.LessOrEqual(t, len(page), 2)
+
+		walked = append(walked, page...)
+		after = page[len(page)-1].CID
+	}
+	require.Equal(t, songs, walked)
+}
@@ -0,0 +1,177 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"p2p-music/internal/song"
+
+	"github.com/boltdb/bolt"
+	"github.com/ipfs/go-cid"
+)
+
+// catalogBucket keeps the replicated state of the global song table by
+// CID bytes. The songs bucket is a view of it: every visible entry is
+// stored there under the same key.
+const (
+	catalogBucket = "catalog_crdt"
+
+	// legacyCatalogTitleBucket indexed the entries by title when older
+	// databases kept the view by title.
+	legacyCatalogTitleBucket = "idx_catalog_title"
+)
+
+// ApplyCatalogOp merges the operation into the catalog and reports
+// whether it changed anything. Duplicated and reordered operations end up
+// in the same state.
+func (s *Storage) ApplyCatalogOp(ctx context.Context, op song.CatalogOp) (bool, error) {
+	if err := op.Validate(); err != nil {
+		return false, err
+	}
+
+	var changed bool
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		entry, err := getCatalogEntry(tx, op.CID)
+		if err != nil {
+			return err
+		}
+
+		if changed = entry.Apply(op); !changed {
+			return nil
+		}
+		return putCatalogEntry(tx, entry)
+	})
+
+	return changed, err
+}
+
+// MergeCatalogEntries merges the states of a catalog snapshot.
+func (s *Storage) MergeCatalogEntries(ctx context.Context, entries []song.CatalogEntry) error {
+	return s.db.Batch(func(tx *bolt.Tx) error {
+		for _, other := range entries {
+			if !other.CID.Defined() {
+				continue
+			}
+
+			entry, err := getCatalogEntry(tx, other.CID)
+			if err != nil {
+				return err
+			}
+			if !entry.Merge(other) {
+				continue
+			}
+			if err := putCatalogEntry(tx, entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetCatalogEntry returns the state of the song, an empty entry when the
+// catalog never heard of it.
+func (s *Storage) GetCatalogEntry(ctx context.Context, songCID cid.Cid) (song.CatalogEntry, error) {
+	var entry song.CatalogEntry
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		entry, err = getCatalogEntry(tx, songCID)
+		return err
+	})
+
+	return entry, err
+}
+
+// GetCatalogEntries returns the whole catalog state, removed songs
+// included, so it can be merged by another replica.
+func (s *Storage) GetCatalogEntries(ctx context.Context) ([]song.CatalogEntry, error) {
+	var entries []song.CatalogEntry
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(catalogBucket)).ForEach(func(k, v []byte) error {
+			var entry song.CatalogEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+			return nil
+		})
+	})
+
+	return entries, err
+}
+
+// GetCatalogEntriesPage returns up to limit entries stored after the CID,
+// in CID order, so the catalog can be sent without loading it whole. An
+// undefined CID starts from the first entry.
+func (s *Storage) GetCatalogEntriesPage(ctx context.Context, after cid.Cid, limit int) ([]song.CatalogEntry, error) {
+	var entries []song.CatalogEntry
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(catalogBucket)).Cursor()
+
+		var k, v []byte
+		if after.Defined() {
+			k, v = c.Seek(after.Bytes())
+			if k != nil && bytes.Equal(k, after.Bytes()) {
+				k, v = c.Next()
+			}
+		} else {
+			k, v = c.First()
+		}
+
+		for ; k != nil && len(entries) < limit; k, v = c.Next() {
+			var entry song.CatalogEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				s.logger.Error("Failed to unmarshal catalog entry", "err", err)
+				continue
+			}
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+
+	return entries, err
+}
+
+func getCatalogEntry(tx *bolt.Tx, songCID cid.Cid) (song.CatalogEntry, error) {
+	v := tx.Bucket([]byte(catalogBucket)).Get(songCID.Bytes())
+	if v == nil {
+		return song.CatalogEntry{CID: songCID}, nil
+	}
+
+	var entry song.CatalogEntry
+	err := json.Unmarshal(v, &entry)
+	return entry, err
+}
+
+// putCatalogEntry stores the state of the entry and brings the songs
+// bucket in line with it.
+func putCatalogEntry(tx *bolt.Tx, entry song.CatalogEntry) error {
+	entryBytes, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket([]byte(catalogBucket)).Put(entry.CID.Bytes(), entryBytes); err != nil {
+		return err
+	}
+
+	if entry.Visible() && entry.Song.Title != "" {
+		return putSong(tx, entry.Song)
+	}
+	return deleteSong(tx, entry.CID.Bytes())
+}
+
+// deleteSong removes the song stored under the key and its index entries.
+func deleteSong(tx *bolt.Tx, key []byte) error {
+	songs, err := getSongs(tx, [][]byte{key})
+	if err != nil {
+		return err
+	}
+	for _, s := range songs {
+		if err := deleteSongIndexes(tx, key, s); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket([]byte(songsBucket)).Delete(key)
+}
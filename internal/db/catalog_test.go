@@ -0,0 +1,148 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"p2p-music/config"
+	"p2p-music/internal/song"
+	"slices"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/require"
+)
+
+func openCatalogDB(t *testing.T) *Storage {
+	t.Helper()
+
+	store, closeDB, err := InitDB(&config.Config{DataDir: t.TempDir()}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	require.NoError(t, err)
+	t.Cleanup(func() { closeDB() })
+	return store
+}
+
+func TestApplyCatalogOpConvergence(t *testing.T) {
+	ctx := context.Background()
+
+	teardrop := song.Song{Title: "Teardrop", Artist: "Massive Attack", CID: testSongCID(t, 1)}
+	teardropCover := song.Song{Title: "Teardrop", Artist: "José González", CID: testSongCID(t, 2)}
+	angel := song.Song{Title: "Angel", Artist: "Massive Attack", CID: testSongCID(t, 3)}
+	angelLive := song.Song{Title: "Angel (Live)", Artist: "Massive Attack", CID: angel.CID}
+	protection := song.Song{Title: "Protection", Artist: "Massive Attack", CID: testSongCID(t, 4)}
+
+	ops := []song.CatalogOp{
+		{Kind: song.CatalogAdd, CID: teardrop.CID, Tag: "t1", Song: teardrop, Clock: song.Clock{Time: 1, Peer: "a"}},
+		{Kind: song.CatalogAdd, CID: teardropCover.CID, Tag: "t2", Song: teardropCover, Clock: song.Clock{Time: 2, Peer: "b"}},
+		{Kind: song.CatalogAdd, CID: angel.CID, Tag: "a1", Song: angel, Clock: song.Clock{Time: 3, Peer: "a"}},
+		{Kind: song.CatalogUpdate, CID: angel.CID, Song: angelLive, Clock: song.Clock{Time: 4, Peer: "b"}},
+		{Kind: song.CatalogAdd, CID: protection.CID, Tag: "p1", Song: protection, Clock: song.Clock{Time: 5, Peer: "a"}},
+		{Kind: song.CatalogRemove, CID: protection.CID, Tags: []string{"p1"}},
+	}
+
+	// both Teardrops are in the catalog, songs come in CID order
+	want := []song.Song{angelLive, teardrop, teardropCover}
+	slices.SortFunc(want, func(a, b song.Song) int {
+		return bytes.Compare(a.CID.Bytes(), b.CID.Bytes())
+	})
+
+	r := rand.New(rand.NewPCG(3, 4))
+	for i := range 10 {
+		store := openCatalogDB(t)
+
+		delivered := append([]song.CatalogOp{}, ops...)
+		delivered = append(delivered, ops[r.IntN(len(ops))], ops[r.IntN(len(ops))])
+		r.Shuffle(len(delivered), func(i, j int) {
+			delivered[i], delivered[j] = delivered[j], delivered[i]
+		})
+
+		for _, op := range delivered {
+			_, err := store.ApplyCatalogOp(ctx, op)
+			require.NoError(t, err)
+		}
+
+		songs, err := store.GetSongsList(ctx)
+		require.NoError(t, err)
+		require.Equal(t, want, songs, "delivery %d", i)
+
+		found, err := store.FindSongByCID(ctx, angel.CID)
+		require.NoError(t, err)
+		require.Equal(t, angelLive, found)
+
+		_, err = store.FindSongByCID(ctx, protection.CID)
+		require.Error(t, err)
+	}
+}
+
+func TestMergeCatalogEntries(t *testing.T) {
+	ctx := context.Background()
+
+	left, right := openCatalogDB(t), openCatalogDB(t)
+
+	teardrop := song.Song{Title: "Teardrop", CID: testSongCID(t, 1)}
+	angel := song.Song{Title: "Angel", CID: testSongCID(t, 2)}
+
+	_, err := left.ApplyCatalogOp(ctx, song.CatalogOp{Kind: song.CatalogAdd, CID: teardrop.CID, Tag: "t1", Song: teardrop, Clock: song.Clock{Time: 1}})
+	require.NoError(t, err)
+	_, err = right.ApplyCatalogOp(ctx, song.CatalogOp{Kind: song.CatalogAdd, CID: angel.CID, Tag: "a1", Song: angel, Clock: song.Clock{Time: 1}})
+	require.NoError(t, err)
+	_, err = right.ApplyCatalogOp(ctx, song.CatalogOp{Kind: song.CatalogRemove, CID: teardrop.CID, Tags: []string{"t1"}})
+	require.NoError(t, err)
+
+	leftEntries, err := left.GetCatalogEntries(ctx)
+	require.NoError(t, err)
+	rightEntries, err := right.GetCatalogEntries(ctx)
+	require.NoError(t, err)
+
+	require.NoError(t, left.MergeCatalogEntries(ctx, rightEntries))
+	require.NoError(t, right.MergeCatalogEntries(ctx, leftEntries))
+
+	for _, store := range []*Storage{left, right} {
+		songs, err := store.GetSongsList(ctx)
+		require.NoError(t, err)
+		require.Equal(t, []song.Song{angel}, songs)
+	}
+}
+
+func TestApplyCatalogOpInvalid(t *testing.T) {
+	store := openCatalogDB(t)
+
+	_, err := store.ApplyCatalogOp(context.Background(), song.CatalogOp{Kind: song.CatalogAdd, Tag: "t1", Song: song.Song{Title: "Teardrop"}})
+	require.Error(t, err)
+}
+
+func TestGetCatalogEntriesPage(t *testing.T) {
+	ctx := context.Background()
+	store := openCatalogDB(t)
+
+	var want []song.CatalogEntry
+	for i := range 5 {
+		s := song.Song{Title: "Song", CID: testSongCID(t, i)}
+		_, err := store.ApplyCatalogOp(ctx, song.CatalogOp{Kind: song.CatalogAdd, CID: s.CID, Tag: "t", Song: s, Clock: song.Clock{Time: 1}})
+		require.NoError(t, err)
+
+		entry, err := store.GetCatalogEntry(ctx, s.CID)
+		require.NoError(t, err)
+		want = append(want, entry)
+	}
+	slices.SortFunc(want, func(a, b song.CatalogEntry) int {
+		return bytes.Compare(a.CID.Bytes(), b.CID.Bytes())
+	})
+
+	var walked []song.CatalogEntry
+	after := cid.Undef
+	for {
+		page, err := store.GetCatalogEntriesPage(ctx, after, 2)
+		require.NoError(t, err)
+		if len(page) == 0 {
+			break
+		}
+		require.LessOrEqual(t, len(page), 2)
+
+		walked = append(walked, page...)
+		after = page[len(page)-1].CID
+	}
+	require.Equal(t, want, walked)
+}
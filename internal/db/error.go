@@ -7,6 +7,8 @@ import (
 var (
 	errDuplicateKey = errors.New("song already exists")
 	errSongNotFound = errors.New("song not found")
+	errSongNoCID    = errors.New("song has no CID")
+	errDBLocked     = errors.New("database is used by another running instance")
 )
 
 var (
@@ -0,0 +1,298 @@
+package db
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/binary"
+	"p2p-music/internal/song"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/boltdb/bolt"
+	"github.com/hbollon/go-edlib"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// The full-text index is an inverted index of normalised tokens from the
+// title, artist and album. Postings are "<token>\x00<song key>" with the
+// fields the token appears in as value, terms keep the number of songs
+// per token so typo matching only walks the distinct tokens.
+const (
+	fullTextBucket = "idx_fulltext"
+	termsBucket    = "idx_terms"
+)
+
+// Fields a token was found in, stored as a bit mask in postings.
+const (
+	fieldTitle byte = 1 << iota
+	fieldArtist
+	fieldAlbum
+)
+
+const (
+	// prefixMatchScore and typoMatchScore are what a token scores
+	// compared to an exact match
+	prefixMatchScore = 0.85
+	typoMatchScore   = 0.7
+
+	// similarityWeight of the edlib similarity of the whole query to
+	// "artist title" in the final score
+	similarityWeight = 0.25
+
+	minPrefixLen = 2
+	minTypoLen   = 3
+)
+
+var fieldWeights = map[byte]float64{
+	fieldTitle:  1,
+	fieldArtist: 0.9,
+	fieldAlbum:  0.6,
+}
+
+// cyrillicToLatin transliterates Russian, Ukrainian and Belarusian
+// letters, so "Кино" and "Kino" end up as the same token.
+var cyrillicToLatin = map[rune]string{
+	'а': "a", 'б': "b", 'в': "v", 'г': "g", 'д': "d", 'е': "e", 'ё': "e",
+	'ж': "zh", 'з': "z", 'и': "i", 'й': "y", 'к': "k", 'л': "l", 'м': "m",
+	'н': "n", 'о': "o", 'п': "p", 'р': "r", 'с': "s", 'т': "t", 'у': "u",
+	'ф': "f", 'х': "kh", 'ц': "ts", 'ч': "ch", 'ш': "sh", 'щ': "shch",
+	'ъ': "", 'ы': "y", 'ь': "", 'э': "e", 'ю': "yu", 'я': "ya",
+	'і': "i", 'ї': "yi", 'є': "ye", 'ґ': "g", 'ў': "u",
+}
+
+// latinLigatures don't decompose into a letter and a diacritic.
+var latinLigatures = map[rune]string{
+	'ß': "ss", 'æ': "ae", 'œ': "oe", 'ø': "o", 'ł': "l", 'đ': "d", 'þ': "th",
+}
+
+// normalizeText lowercases, transliterates to Latin and strips
+// diacritics.
+func normalizeText(text string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(text) {
+		if latin, ok := cyrillicToLatin[r]; ok {
+			b.WriteString(latin)
+			continue
+		}
+		if latin, ok := latinLigatures[r]; ok {
+			b.WriteString(latin)
+			continue
+		}
+		b.WriteRune(r)
+	}
+
+	stripped, _, err := transform.String(transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC), b.String())
+	if err != nil {
+		return b.String()
+	}
+	return stripped
+}
+
+// tokenize splits normalised text into words.
+func tokenize(text string) []string {
+	return strings.FieldsFunc(normalizeText(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// songTokens maps every token of the song to the fields it is in.
+func songTokens(s song.Song) map[string]byte {
+	tokens := make(map[string]byte)
+	for field, text := range map[byte]string{fieldTitle: s.Title, fieldArtist: s.Artist, fieldAlbum: s.Album} {
+		for _, token := range tokenize(text) {
+			tokens[token] |= field
+		}
+	}
+	return tokens
+}
+
+func putFullTextIndex(tx *bolt.Tx, songKey []byte, s song.Song) error {
+	postings := tx.Bucket([]byte(fullTextBucket))
+	terms := tx.Bucket([]byte(termsBucket))
+
+	for token, fields := range songTokens(s) {
+		key := indexKey([]byte(token), songKey)
+		if postings.Get(key) == nil {
+			if err := addTermCount(terms, token, 1); err != nil {
+				return err
+			}
+		}
+		if err := postings.Put(key, []byte{fields}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deleteFullTextIndex(tx *bolt.Tx, songKey []byte, s song.Song) error {
+	postings := tx.Bucket([]byte(fullTextBucket))
+	terms := tx.Bucket([]byte(termsBucket))
+
+	for token := range songTokens(s) {
+		key := indexKey([]byte(token), songKey)
+		if postings.Get(key) == nil {
+			continue
+		}
+		if err := postings.Delete(key); err != nil {
+			return err
+		}
+		if err := addTermCount(terms, token, -1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addTermCount(terms *bolt.Bucket, token string, delta int64) error {
+	var count int64
+	if v := terms.Get([]byte(token)); v != nil {
+		count = int64(binary.BigEndian.Uint32(v))
+	}
+
+	count += delta
+	if count <= 0 {
+		return terms.Delete([]byte(token))
+	}
+	return terms.Put([]byte(token), binary.BigEndian.AppendUint32(nil, uint32(count)))
+}
+
+// matchTerms finds the indexed tokens matching a query token: the token
+// itself, tokens it is a prefix of and tokens within a typo or two. It
+// returns the score of each matching token.
+func matchTerms(terms *bolt.Bucket, queryToken string) map[string]float64 {
+	matches := make(map[string]float64)
+	c := terms.Cursor()
+
+	if len(queryToken) >= minPrefixLen {
+		for k, _ := c.Seek([]byte(queryToken)); k != nil && bytes.HasPrefix(k, []byte(queryToken)); k, _ = c.Next() {
+			matches[string(k)] = prefixMatchScore
+		}
+	}
+	if terms.Get([]byte(queryToken)) != nil {
+		matches[queryToken] = 1
+	}
+
+	maxTypos := maxTyposFor(queryToken)
+	if maxTypos == 0 {
+		return matches
+	}
+
+	// typos in the first letter are rare, which keeps the walk short
+	first := []byte(string([]rune(queryToken)[0]))
+	for k, _ := c.Seek(first); k != nil && bytes.HasPrefix(k, first); k, _ = c.Next() {
+		term := string(k)
+		if _, ok := matches[term]; ok {
+			continue
+		}
+
+		distance := edlib.OSADamerauLevenshteinDistance(queryToken, term)
+		if distance <= maxTypos {
+			matches[term] = typoMatchScore * (1 - float64(distance)/float64(len([]rune(queryToken))+1))
+		}
+	}
+	return matches
+}
+
+func maxTyposFor(token string) int {
+	switch n := len([]rune(token)); {
+	case n < minTypoLen:
+		return 0
+	case n < 6:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// SearchSongs ranks the catalog against free text: every query token
+// scores the best matching token of a song, weighted by the field it is
+// in, and the edlib similarity of the query to "artist title" breaks
+// close calls. Zero limit returns every match.
+func (s *Storage) SearchSongs(ctx context.Context, query string, limit int) ([]song.SearchResult, error) {
+	queryTokens := tokenize(query)
+	if len(queryTokens) == 0 {
+		return nil, nil
+	}
+
+	var results []song.SearchResult
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		terms := tx.Bucket([]byte(termsBucket))
+		postings := tx.Bucket([]byte(fullTextBucket))
+
+		// best score per song key, the CID bytes, for every query token
+		scores := make(map[string][]float64)
+		for i, queryToken := range queryTokens {
+			for term, termScore := range matchTerms(terms, queryToken) {
+				prefix := indexPrefix([]byte(term))
+
+				c := postings.Cursor()
+				for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+					songKey := string(k[len(prefix):])
+					if scores[songKey] == nil {
+						scores[songKey] = make([]float64, len(queryTokens))
+					}
+
+					score := termScore * fieldsWeight(v[0])
+					scores[songKey][i] = max(scores[songKey][i], score)
+				}
+			}
+		}
+
+		keys := make([][]byte, 0, len(scores))
+		for key := range scores {
+			keys = append(keys, []byte(key))
+		}
+		songs, err := getSongs(tx, keys)
+		if err != nil {
+			return err
+		}
+
+		normalizedQuery := strings.Join(queryTokens, " ")
+		for _, found := range songs {
+			var tokenScore float64
+			for _, score := range scores[string(found.CID.Bytes())] {
+				tokenScore += score
+			}
+			tokenScore /= float64(len(queryTokens))
+
+			similarity := edlib.JaroWinklerSimilarity(normalizedQuery, strings.Join(tokenize(found.Artist+" "+found.Title), " "))
+
+			results = append(results, song.SearchResult{
+				Song:  found,
+				Score: (1-similarityWeight)*tokenScore + similarityWeight*float64(similarity),
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(results, func(a, b song.SearchResult) int {
+		if c := cmp.Compare(b.Score, a.Score); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Song.Title, b.Song.Title)
+	})
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+
+	return results, nil
+}
+
+// fieldsWeight is the weight of the most important field in the mask.
+func fieldsWeight(fields byte) float64 {
+	var weight float64
+	for field, fieldWeight := range fieldWeights {
+		if fields&field != 0 {
+			weight = max(weight, fieldWeight)
+		}
+	}
+	return weight
+}
@@ -0,0 +1,148 @@
+package db
+
+import (
+	"context"
+	"p2p-music/internal/song"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenize(t *testing.T) {
+	testCases := []struct {
+		name string
+		text string
+		want []string
+	}{
+		{
+			name: "1. tokenize: lowercase and punctuation",
+			text: "Don't Stop Me Now!",
+			want: []string{"don", "t", "stop", "me", "now"},
+		},
+		{
+			name: "2. tokenize: diacritics stripped",
+			text: "Beyoncé – Déjà Vu",
+			want: []string{"beyonce", "deja", "vu"},
+		},
+		{
+			name: "3. tokenize: Cyrillic transliterated",
+			text: "Кино - Группа крови",
+			want: []string{"kino", "gruppa", "krovi"},
+		},
+		{
+			name: "4. tokenize: ligatures",
+			text: "Straße Øresund",
+			want: []string{"strasse", "oresund"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.want, tokenize(tc.text))
+		})
+	}
+}
+
+func TestSearchSongs(t *testing.T) {
+	ctx := context.Background()
+
+	db := MustOpenDB(t)
+	defer db.MustClose()
+
+	require.NoError(t, db.createBuckets())
+	defer db.deleteBuckets()
+
+	songs := []song.Song{
+		{Title: "Группа крови", Artist: "Кино", Album: "Группа крови", CID: testSongCID(t, 1)},
+		{Title: "Paranoid Android", Artist: "Radiohead", Album: "OK Computer", CID: testSongCID(t, 2)},
+		{Title: "Karma Police", Artist: "Radiohead", Album: "OK Computer", CID: testSongCID(t, 3)},
+		{Title: "Déjà Vu", Artist: "Beyoncé", Album: "B'Day", CID: testSongCID(t, 4)},
+		{Title: "Computer Love", Artist: "Kraftwerk", Album: "Computer World", CID: testSongCID(t, 5)},
+		{Title: "Angel", Artist: "Massive Attack", Album: "Mezzanine", CID: testSongCID(t, 6)},
+		{Title: "Anel", Album: "Angel", CID: testSongCID(t, 7)},
+	}
+	db.mustAddSongs(t, songs...)
+
+	testCases := []struct {
+		name      string
+		query     string
+		limit     int
+		wantTitle []string
+	}{
+		{
+			name:      "1. SearchSongs: transliterated query",
+			query:     "kino gruppa krovi",
+			wantTitle: []string{"Группа крови"},
+		},
+		{
+			name:      "2. SearchSongs: typos",
+			query:     "paranod andriod",
+			wantTitle: []string{"Paranoid Android"},
+		},
+		{
+			name:      "3. SearchSongs: prefix",
+			query:     "karm",
+			wantTitle: []string{"Karma Police"},
+		},
+		{
+			name:      "4. SearchSongs: without diacritics",
+			query:     "beyonce deja vu",
+			wantTitle: []string{"Déjà Vu"},
+		},
+		{
+			name:      "5. SearchSongs: title ranked above album",
+			query:     "computer",
+			wantTitle: []string{"Computer Love", "Paranoid Android", "Karma Police"},
+		},
+		{
+			name:      "6. SearchSongs: limit",
+			query:     "radiohead",
+			limit:     1,
+			wantTitle: []string{"Karma Police"},
+		},
+		{
+			// the similarity of "anel" alone would rank it first
+			name:      "7. SearchSongs: title match above album match",
+			query:     "angel",
+			wantTitle: []string{"Angel", "Anel"},
+		},
+		{
+			name:  "8. SearchSongs: nothing close",
+			query: "zzz",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			results, err := db.SearchSongs(ctx, tc.query, tc.limit)
+			require.NoError(t, err)
+
+			var titles []string
+			for _, r := range results {
+				titles = append(titles, r.Song.Title)
+			}
+			require.Equal(t, tc.wantTitle, titles)
+		})
+	}
+}
+
+func TestSearchSongsAfterUpdate(t *testing.T) {
+	ctx := context.Background()
+
+	db := MustOpenDB(t)
+	defer db.MustClose()
+
+	require.NoError(t, db.createBuckets())
+	defer db.deleteBuckets()
+
+	db.mustAddSongs(t, song.Song{Title: "Teardrop", Artist: "Massive Attack", CID: testSongCID(t, 1)})
+	db.mustEditSong(t, song.Song{Title: "Teardrop", Artist: "Elizabeth Fraser", CID: testSongCID(t, 1)})
+
+	results, err := db.SearchSongs(ctx, "massive", 0)
+	require.NoError(t, err)
+	require.Empty(t, results)
+
+	results, err = db.SearchSongs(ctx, "fraser", 0)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+}
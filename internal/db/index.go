@@ -0,0 +1,250 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"p2p-music/internal/song"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+// Index buckets map a song attribute to the songs bucket keys, which are
+// the song CIDs. They store "<value>\x00<key>" with an empty value, so all
+// songs with a value are found with one cursor seek.
+const (
+	artistIndexBucket = "idx_artist"
+	albumIndexBucket  = "idx_album"
+	yearIndexBucket   = "idx_year"
+
+	// legacyCIDIndexBucket mapped CIDs to the title keys of older
+	// databases.
+	legacyCIDIndexBucket = "idx_cid"
+)
+
+var indexBuckets = []string{artistIndexBucket, albumIndexBucket, yearIndexBucket, fullTextBucket, termsBucket}
+
+const (
+	indexSeparator = 0x00
+
+	// yearIndexLen of the big endian year in year index keys
+	yearIndexLen = 4
+)
+
+// normalizeIndexValue makes artist and album lookups case-insensitive.
+func normalizeIndexValue(value string) []byte {
+	return []byte(strings.ToLower(strings.TrimSpace(value)))
+}
+
+func yearIndexValue(year int) []byte {
+	return binary.BigEndian.AppendUint32(nil, uint32(year))
+}
+
+func indexPrefix(value []byte) []byte {
+	return append(bytes.Clone(value), indexSeparator)
+}
+
+func indexKey(value, songKey []byte) []byte {
+	return append(indexPrefix(value), songKey...)
+}
+
+// songIndexEntries lists the multi-value index entries of a song.
+func songIndexEntries(songKey []byte, s song.Song) map[string][]byte {
+	entries := make(map[string][]byte)
+	if s.Artist != "" {
+		entries[artistIndexBucket] = indexKey(normalizeIndexValue(s.Artist), songKey)
+	}
+	if s.Album != "" {
+		entries[albumIndexBucket] = indexKey(normalizeIndexValue(s.Album), songKey)
+	}
+	if s.Year != 0 {
+		entries[yearIndexBucket] = indexKey(yearIndexValue(s.Year), songKey)
+	}
+	return entries
+}
+
+func putSongIndexes(tx *bolt.Tx, songKey []byte, s song.Song) error {
+	for bucket, key := range songIndexEntries(songKey, s) {
+		if err := tx.Bucket([]byte(bucket)).Put(key, []byte{}); err != nil {
+			return err
+		}
+	}
+	return putFullTextIndex(tx, songKey, s)
+}
+
+func deleteSongIndexes(tx *bolt.Tx, songKey []byte, s song.Song) error {
+	for bucket, key := range songIndexEntries(songKey, s) {
+		if err := tx.Bucket([]byte(bucket)).Delete(key); err != nil {
+			return err
+		}
+	}
+	return deleteFullTextIndex(tx, songKey, s)
+}
+
+// createIndexBuckets creates missing index buckets and rebuilds the
+// indexes when any was missing, e.g. for databases from older versions.
+func createIndexBuckets(tx *bolt.Tx) error {
+	missing := false
+	for _, bucket := range indexBuckets {
+		if tx.Bucket([]byte(bucket)) != nil {
+			continue
+		}
+		missing = true
+		if _, err := tx.CreateBucket([]byte(bucket)); err != nil {
+			return err
+		}
+	}
+
+	if !missing {
+		return nil
+	}
+	return reindexSongs(tx)
+}
+
+// migrateSongsBucket moves the songs of an older database from their
+// title keys to their CIDs, together with the catalog entries the title
+// clashes hid, and rebuilds the indexes.
+func migrateSongsBucket(tx *bolt.Tx) error {
+	songs := tx.Bucket([]byte(songsBucket))
+
+	err := tx.Bucket([]byte(legacySongsBucket)).ForEach(func(k, v []byte) error {
+		var s song.Song
+		if err := json.Unmarshal(v, &s); err != nil || !s.CID.Defined() {
+			// can't be keyed, the catalog brings it back if it's shared
+			return nil
+		}
+		return songs.Put(s.CID.Bytes(), v)
+	})
+	if err != nil {
+		return err
+	}
+
+	err = tx.Bucket([]byte(catalogBucket)).ForEach(func(k, v []byte) error {
+		var entry song.CatalogEntry
+		if err := json.Unmarshal(v, &entry); err != nil {
+			return nil
+		}
+		if !entry.Visible() || entry.Song.Title == "" {
+			return nil
+		}
+
+		songBytes, err := json.Marshal(entry.Song)
+		if err != nil {
+			return err
+		}
+		return songs.Put(entry.CID.Bytes(), songBytes)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, bucket := range []string{legacySongsBucket, legacyCatalogTitleBucket, legacyCIDIndexBucket} {
+		if err := tx.DeleteBucket([]byte(bucket)); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+	}
+	return reindexSongs(tx)
+}
+
+// reindexSongs rebuilds every index from the songs bucket.
+func reindexSongs(tx *bolt.Tx) error {
+	for _, bucket := range indexBuckets {
+		if err := tx.DeleteBucket([]byte(bucket)); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		if _, err := tx.CreateBucket([]byte(bucket)); err != nil {
+			return err
+		}
+	}
+
+	return tx.Bucket([]byte(songsBucket)).ForEach(func(k, v []byte) error {
+		var s song.Song
+		if err := json.Unmarshal(v, &s); err != nil {
+			// unreadable entries can't be found by value anyway
+			return nil
+		}
+		return putSongIndexes(tx, k, s)
+	})
+}
+
+// scanIndex returns the keys of the songs with the value in the index.
+func scanIndex(tx *bolt.Tx, bucket string, value []byte) [][]byte {
+	prefix := indexPrefix(value)
+
+	var keys [][]byte
+	c := tx.Bucket([]byte(bucket)).Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		keys = append(keys, bytes.Clone(k[len(prefix):]))
+	}
+	return keys
+}
+
+// scanYearRange returns the keys of the songs released between from and
+// to, zero bounds are open.
+func scanYearRange(tx *bolt.Tx, from, to int) [][]byte {
+	if to == 0 {
+		to = math.MaxUint32
+	}
+
+	var keys [][]byte
+	c := tx.Bucket([]byte(yearIndexBucket)).Cursor()
+	for k, _ := c.Seek(yearIndexValue(from)); k != nil && len(k) > yearIndexLen; k, _ = c.Next() {
+		if int64(binary.BigEndian.Uint32(k)) > int64(to) {
+			break
+		}
+		keys = append(keys, bytes.Clone(k[yearIndexLen+1:]))
+	}
+	return keys
+}
+
+// getSongs loads the songs stored under the keys.
+func getSongs(tx *bolt.Tx, keys [][]byte) ([]song.Song, error) {
+	b := tx.Bucket([]byte(songsBucket))
+
+	songs := make([]song.Song, 0, len(keys))
+	for _, key := range keys {
+		v := b.Get(key)
+		if v == nil {
+			continue
+		}
+
+		var s song.Song
+		if err := json.Unmarshal(v, &s); err != nil {
+			return nil, err
+		}
+		songs = append(songs, s)
+	}
+	return songs, nil
+}
+
+// putSong stores the song under its CID and keeps the indexes in sync
+// with it, replacing the entries of the song stored before.
+func putSong(tx *bolt.Tx, s song.Song) error {
+	if !s.CID.Defined() {
+		return errSongNoCID
+	}
+
+	b := tx.Bucket([]byte(songsBucket))
+	key := s.CID.Bytes()
+
+	if old := b.Get(key); old != nil {
+		var oldSong song.Song
+		if err := json.Unmarshal(old, &oldSong); err == nil {
+			if err := deleteSongIndexes(tx, key, oldSong); err != nil {
+				return err
+			}
+		}
+	}
+
+	songBytes, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err := b.Put(key, songBytes); err != nil {
+		return err
+	}
+
+	return putSongIndexes(tx, key, s)
+}
@@ -17,6 +17,14 @@ const (
 	nodeNamespace string = "music"
 )
 
+// networkNamespace is the rendezvous and mDNS name of the network.
+func networkNamespace(configs *config.Config) string {
+	if configs.NetworkNamespace == "" {
+		return nodeNamespace
+	}
+	return nodeNamespace + "/" + configs.NetworkNamespace
+}
+
 type PeerDiscoverer interface {
 	NewDHT(ctx context.Context, bootstrapPeers []multiaddr.Multiaddr) (*dht.IpfsDHT, error)
 
@@ -35,38 +43,52 @@ func Bootstrap(
 
 	logger *slog.Logger,
 
-) (func() error, song.SongTableSynchronizer, song.SongTableStore) {
+) (func() error, song.SongTableSynchronizer, song.SongTableStore, *song.SongManager) {
 	// Peer discovery
-	peerDiscoverer := NewDHTManager(h, logger)
+	peerDiscoverer := NewDHTManager(h, configs.DHTProtocolPrefix, logger)
 	kdht, err := peerDiscoverer.NewDHT(ctx, bootstrapPeers)
 	if err != nil {
 		logger.Error("Error creating KAD", "err", err)
 		log.Fatal(err)
 	}
 
-	go peerDiscoverer.Discover(ctx, kdht, nodeNamespace)
+	namespace := networkNamespace(configs)
+	go peerDiscoverer.Discover(ctx, kdht, namespace)
 
-	store, closeDBConn, err := db.InitDB(logger)
+	if configs.MDNS {
+		if err := StartMDNS(ctx, h, namespace, logger); err != nil {
+			logger.Error("Failed to start mDNS discovery", "err", err)
+		}
+	}
+
+	store, closeDBConn, err := db.InitDB(configs, logger)
 	if err != nil {
 		logger.Error("Failed to init BoltDB", "err", err)
 		log.Fatal(err)
 	}
 
 	// Global song list initialization
-	songTable, err := song.SetupSongTableSync(ctx, h, store, logger)
+	songTable, err := song.SetupSongTableSync(ctx, h, store, configs, logger)
 	if err != nil {
 		logger.Error("Setup global palylist error", "err", err)
 		log.Fatal(err)
 	}
 	songTable.RegisterSongTableHandlers(ctx, h)
+	songTable.StartAntiEntropy(ctx, configs.AntiEntropyInterval)
 
 	songTableManager := song.NewSongManager(h, songTable, kdht, store, store, configs, logger)
 	songTableManager.RegisterSongStreamingProtocols(ctx)
+	songTableManager.RegisterSongSearchProtocol(ctx)
+
+	if err := songTableManager.MigrateLegacySongs(ctx); err != nil {
+		logger.Error("Failed to migrate legacy song CIDs", "err", err)
+	}
 
 	////////////////////
 	//.....TESTING......
 	if len(bootstrapPeers) == 0 {
-		select {}
+		// mDNS and the DHT fill in peers while the node runs
+		return closeDBConn, songTable, store, songTableManager
 	}
 
 	song, err := song.NewSong(configs.TestFilePath)
@@ -85,17 +107,14 @@ func Bootstrap(
 	}
 
 	if len(songProviders) > 0 {
-		_, err := songTableManager.ReceiveSongStream(ctx, song, songProviders[len(songProviders)-1].ID)
+		// seeded right away when SEED_DOWNLOADS is on
+		_, err := songTableManager.SwarmDownload(ctx, song, songProviders)
 		if err != nil {
 			log.Fatal(err)
 		}
-
-		// if err := songTableManager.PromoteSong(ctx, song, receivedSongFilePath); err != nil {
-		// 	log.Fatal(err)
-		// }
 	}
 	// //////////////////
 	// .....TESTING......
 
-	return closeDBConn, songTable, store
+	return closeDBConn, songTable, store, songTableManager
 }
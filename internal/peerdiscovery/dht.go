@@ -11,6 +11,7 @@ import (
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
 	drouting "github.com/libp2p/go-libp2p/p2p/discovery/routing"
 	"github.com/multiformats/go-multiaddr"
 )
@@ -18,17 +19,26 @@ import (
 type DHTManager struct {
 	h   host.Host
 	log *slog.Logger
+
+	// protocolPrefix of the DHT, empty for the public /ipfs one
+	protocolPrefix string
 }
 
-func NewDHTManager(h host.Host, logger *slog.Logger) *DHTManager {
+func NewDHTManager(h host.Host, protocolPrefix string, logger *slog.Logger) *DHTManager {
 	return &DHTManager{
 		h:   h,
 		log: logger,
+
+		protocolPrefix: protocolPrefix,
 	}
 }
 
 func (m *DHTManager) NewDHT(ctx context.Context, bootstrapPeers []multiaddr.Multiaddr) (*dht.IpfsDHT, error) {
 	var opts []dht.Option
+	if m.protocolPrefix != "" {
+		// a DHT of its own, nodes of the public DHT don't speak it
+		opts = append(opts, dht.ProtocolPrefix(protocol.ID(m.protocolPrefix)))
+	}
 
 	// if no bootstrap peers give this peer act as a bootstraping node
 	// other peers can use this peers ipfs address for peer discovery via dht
@@ -3,19 +3,21 @@ package peerdiscovery
 import (
 	"fmt"
 	"log"
+	"p2p-music/config"
 
 	_ "github.com/joho/godotenv/autoload"
 	"github.com/libp2p/go-libp2p"
 	"github.com/libp2p/go-libp2p/core/host"
 	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
-	"github.com/multiformats/go-multiaddr"
 )
 
-const (
-	defaultAddr = "/ip4/0.0.0.0/tcp/0"
-)
+// SetupHost starts the libp2p host with the identity of the node.
+func SetupHost(configs *config.Config) host.Host {
+	key, err := LoadIdentity(configs)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-func SetupHost() host.Host {
 	// Start with the default scaling limits.
 	scalingLimits := rcmgr.DefaultLimits
 
@@ -49,19 +51,62 @@ func SetupHost() host.Host {
 		panic(err)
 	}
 
-	h, err := libp2p.New(
-		libp2p.ListenAddrStrings(defaultAddr),
+	psk, err := LoadSwarmKey(configs)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	enabled, err := enabledTransports(configs, psk != nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	transports, err := transportOptions(enabled)
+	if err != nil {
+		log.Fatal(err)
+	}
+	listen, err := listenAddrs(configs, enabled)
+	if err != nil {
+		log.Fatal(err)
+	}
+	announce, err := addrsFactory(configs)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	opts := []libp2p.Option{
+		libp2p.Identity(key),
+		libp2p.ListenAddrs(listen...),
+		libp2p.AddrsFactory(announce),
 		libp2p.ResourceManager(rm),
 		libp2p.EnableAutoNATv2(),
-	)
+	}
+	opts = append(opts, transports...)
+
+	if psk != nil {
+		opts = append(opts, libp2p.PrivateNetwork(psk))
+		fmt.Println("Joining the private network of the swarm key")
+	}
+
+	candidates := newRelayCandidates()
+	nat, err := natOptions(configs, candidates)
 	if err != nil {
 		log.Fatal(err)
 	}
+	opts = append(opts, nat...)
 
+	h, err := libp2p.New(opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	candidates.setHost(h)
+
+	fmt.Println("Listening on:")
+	for _, addr := range h.Network().ListenAddresses() {
+		fmt.Println(addr)
+	}
 	fmt.Println("Available addresses:")
-	for _, addr := range h.Addrs() {
-		fullAddr := addr.Encapsulate(multiaddr.StringCast(fmt.Sprintf("/p2p/%s", h.ID())))
-		fmt.Println(fullAddr)
+	for _, addr := range NodeAddrs(h) {
+		fmt.Println(addr)
 	}
 
 	return h
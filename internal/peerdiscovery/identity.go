@@ -0,0 +1,132 @@
+package peerdiscovery
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"p2p-music/config"
+	"path/filepath"
+	"runtime"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+)
+
+const (
+	identityFileName = "identity.key"
+
+	// keyFileMode keeps the key files readable by the node user only
+	keyFileMode = 0600
+)
+
+var errKeyPermissions = errors.New("key file is accessible by other users")
+
+// identityPath is where the private key of the node is kept.
+func identityPath(cfg *config.Config) string {
+	if cfg.IdentityPath != "" {
+		return cfg.IdentityPath
+	}
+	return filepath.Join(cfg.DataDir, identityFileName)
+}
+
+// LoadIdentity returns the private key of the node, which its peer ID is
+// derived from. The key is generated on the first start and kept in the
+// data directory, so the peer ID stays the same across restarts. A key
+// file other users can access is refused.
+func LoadIdentity(cfg *config.Config) (crypto.PrivKey, error) {
+	path := identityPath(cfg)
+
+	key, err := readIdentity(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		key, err = generateIdentity()
+		if err != nil {
+			return nil, err
+		}
+		return key, writeIdentity(path, key)
+	}
+	return key, err
+}
+
+// RotateIdentity replaces the key of the node with a new one, so it gets
+// a new peer ID on the next start. The old key is kept next to it with
+// the .old suffix.
+func RotateIdentity(cfg *config.Config) (crypto.PrivKey, error) {
+	path := identityPath(cfg)
+
+	key, err := generateIdentity()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		if err := os.Rename(path, path+".old"); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	return key, writeIdentity(path, key)
+}
+
+func generateIdentity() (crypto.PrivKey, error) {
+	key, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	return key, err
+}
+
+func readIdentity(path string) (crypto.PrivKey, error) {
+	keyBytes, err := readKeyFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := crypto.UnmarshalPrivateKey(keyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read identity key %s: %w", path, err)
+	}
+	return key, nil
+}
+
+func writeIdentity(path string, key crypto.PrivKey) error {
+	keyBytes, err := crypto.MarshalPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	return writeKeyFile(path, keyBytes)
+}
+
+// readKeyFile reads a secret key file, refusing one other users can
+// access.
+func readKeyFile(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	// Windows doesn't have the permission bits
+	if runtime.GOOS != "windows" && info.Mode().Perm()&^keyFileMode != 0 {
+		return nil, fmt.Errorf("%w: %s has mode %v, expected %v", errKeyPermissions, path, info.Mode().Perm(), fs.FileMode(keyFileMode))
+	}
+
+	return os.ReadFile(path)
+}
+
+// writeKeyFile writes the key through a temporary file, so a crash never
+// leaves a half written key behind.
+func writeKeyFile(path string, keyBytes []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	// a leftover would keep its mode
+	tmpPath := path + ".tmp"
+	os.Remove(tmpPath)
+	if err := os.WriteFile(tmpPath, keyBytes, keyFileMode); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package peerdiscovery
+
+import (
+	"os"
+	"p2p-music/config"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadIdentity(t *testing.T) {
+	cfg := &config.Config{DataDir: filepath.Join(t.TempDir(), "data")}
+
+	key, err := LoadIdentity(cfg)
+	require.NoError(t, err)
+	id, err := peer.IDFromPrivateKey(key)
+	require.NoError(t, err)
+
+	info, err := os.Stat(identityPath(cfg))
+	require.NoError(t, err)
+	if runtime.GOOS != "windows" {
+		require.Equal(t, os.FileMode(keyFileMode), info.Mode().Perm())
+	}
+
+	// same peer ID after a restart
+	key, err = LoadIdentity(cfg)
+	require.NoError(t, err)
+	again, err := peer.IDFromPrivateKey(key)
+	require.NoError(t, err)
+	require.Equal(t, id, again)
+
+	key, err = RotateIdentity(cfg)
+	require.NoError(t, err)
+	rotated, err := peer.IDFromPrivateKey(key)
+	require.NoError(t, err)
+	require.NotEqual(t, id, rotated)
+
+	key, err = LoadIdentity(cfg)
+	require.NoError(t, err)
+	loaded, err := peer.IDFromPrivateKey(key)
+	require.NoError(t, err)
+	require.Equal(t, rotated, loaded)
+	require.FileExists(t, identityPath(cfg)+".old")
+}
+
+func TestLoadIdentityPermissions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no permission bits on windows")
+	}
+
+	cfg := &config.Config{IdentityPath: filepath.Join(t.TempDir(), "node.key")}
+	_, err := LoadIdentity(cfg)
+	require.NoError(t, err)
+
+	require.NoError(t, os.Chmod(cfg.IdentityPath, 0644))
+	_, err = LoadIdentity(cfg)
+	require.ErrorIs(t, err, errKeyPermissions)
+}
@@ -0,0 +1,56 @@
+package peerdiscovery
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/discovery/mdns"
+)
+
+const mdnsConnectTimeout = 10 * time.Second
+
+// mdnsNotifee connects to the peers mDNS finds on the local network.
+type mdnsNotifee struct {
+	ctx context.Context
+	h   host.Host
+	log *slog.Logger
+}
+
+func (n *mdnsNotifee) HandlePeerFound(pi peer.AddrInfo) {
+	if pi.ID == n.h.ID() || n.h.Network().Connectedness(pi.ID) == network.Connected {
+		return
+	}
+
+	// called from the mDNS resolver loop, which mustn't wait for the dial
+	go func() {
+		ctx, cancel := context.WithTimeout(n.ctx, mdnsConnectTimeout)
+		defer cancel()
+
+		if err := n.h.Connect(ctx, pi); err != nil {
+			n.log.Warn("Failed to connect to local peer", "PeerID", pi.ID, "err", err)
+			return
+		}
+		n.log.Info("Connected to local peer", "PeerID", pi.ID)
+	}()
+}
+
+// StartMDNS announces the node on the local network under the service
+// name and connects to the other nodes announcing it, so nodes on one LAN
+// find each other without bootstrap addresses. The service stops with
+// ctx.
+func StartMDNS(ctx context.Context, h host.Host, serviceName string, logger *slog.Logger) error {
+	service := mdns.NewMdnsService(h, serviceName, &mdnsNotifee{ctx: ctx, h: h, log: logger})
+	if err := service.Start(); err != nil {
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		service.Close()
+	}()
+	return nil
+}
@@ -0,0 +1,31 @@
+package peerdiscovery
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMDNSNotifee(t *testing.T) {
+	mn, err := mocknet.WithNPeers(2)
+	require.NoError(t, err)
+	defer mn.Close()
+	require.NoError(t, mn.LinkAll())
+
+	h, other := mn.Hosts()[0], mn.Hosts()[1]
+	n := &mdnsNotifee{ctx: context.Background(), h: h, log: slog.Default()}
+
+	// finding itself is a no-op
+	n.HandlePeerFound(peer.AddrInfo{ID: h.ID(), Addrs: h.Addrs()})
+
+	n.HandlePeerFound(peer.AddrInfo{ID: other.ID(), Addrs: other.Addrs()})
+	require.Eventually(t, func() bool {
+		return h.Network().Connectedness(other.ID()) == network.Connected
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,143 @@
+package peerdiscovery
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"p2p-music/config"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// relayCandidates offers the connected peers to the relay client, which
+// keeps the ones running a relay service. The host is only known once
+// libp2p made it, so the candidates wait for it.
+type relayCandidates struct {
+	h     host.Host
+	ready chan struct{}
+}
+
+func newRelayCandidates() *relayCandidates {
+	return &relayCandidates{ready: make(chan struct{})}
+}
+
+// setHost hands the host over to the peer source, once.
+func (c *relayCandidates) setHost(h host.Host) {
+	c.h = h
+	close(c.ready)
+}
+
+// peerSource is the autorelay.PeerSource of the node.
+func (c *relayCandidates) peerSource(ctx context.Context, num int) <-chan peer.AddrInfo {
+	out := make(chan peer.AddrInfo, num)
+
+	go func() {
+		defer close(out)
+
+		select {
+		case <-c.ready:
+		case <-ctx.Done():
+			return
+		}
+
+		for _, p := range c.h.Network().Peers() {
+			if num == 0 {
+				return
+			}
+			select {
+			case out <- c.h.Peerstore().PeerInfo(p):
+				num--
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// natOptions makes the NAT traversal of the node. Publicly reachable
+// nodes may relay the connections of the others, which in turn reserve a
+// slot on such relays, from StaticRelays or the connected peers, and
+// upgrade the relayed connections to direct ones by hole punching.
+func natOptions(cfg *config.Config, candidates *relayCandidates) ([]libp2p.Option, error) {
+	var opts []libp2p.Option
+
+	if cfg.RelayService {
+		// the service only runs while AutoNAT finds the node public
+		opts = append(opts, libp2p.EnableRelayService())
+	}
+
+	if cfg.RelayClient {
+		if len(cfg.StaticRelays) > 0 {
+			addrs, err := parseAddrs(cfg.StaticRelays)
+			if err != nil {
+				return nil, err
+			}
+			relays, err := peer.AddrInfosFromP2pAddrs(addrs...)
+			if err != nil {
+				return nil, fmt.Errorf("invalid static relay: %w", err)
+			}
+			opts = append(opts, libp2p.EnableAutoRelayWithStaticRelays(relays))
+		} else {
+			opts = append(opts, libp2p.EnableAutoRelayWithPeerSource(candidates.peerSource))
+		}
+	}
+
+	if cfg.HolePunching {
+		opts = append(opts, libp2p.EnableHolePunching())
+	}
+	return opts, nil
+}
+
+// WatchReachability logs whether other nodes can dial the node, and sends
+// the changes on the returned channel until ctx is done. Only the latest
+// change waits there, a slow reader misses none but the stale ones.
+func WatchReachability(ctx context.Context, h host.Host, logger *slog.Logger) (<-chan network.Reachability, error) {
+	sub, err := h.EventBus().Subscribe(new(event.EvtLocalReachabilityChanged))
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan network.Reachability, 1)
+	go func() {
+		defer sub.Close()
+		defer close(out)
+
+		for {
+			select {
+			case e, ok := <-sub.Out():
+				if !ok {
+					return
+				}
+				r := e.(event.EvtLocalReachabilityChanged).Reachability
+				logReachability(logger, h, r)
+
+				// replace the change nobody read yet
+				select {
+				case <-out:
+				default:
+				}
+				out <- r
+
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+func logReachability(logger *slog.Logger, h host.Host, r network.Reachability) {
+	switch r {
+	case network.ReachabilityPublic:
+		logger.Info("Node is publicly reachable", "addrs", h.Addrs())
+	case network.ReachabilityPrivate:
+		logger.Info("Node is behind a NAT, peers connect through relays and hole punching", "addrs", h.Addrs())
+	default:
+		logger.Info("Node reachability is unknown")
+	}
+}
@@ -0,0 +1,121 @@
+package peerdiscovery
+
+import (
+	"context"
+	"log/slog"
+	"p2p-music/config"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNATOptions(t *testing.T) {
+	relay := "/ip4/203.0.113.7/tcp/4001/p2p/12D3KooWADsthUCJpFYWpLss7hybGAbyCjJL1LTT8WsmT8BCJfBW"
+
+	tests := []struct {
+		name    string
+		cfg     *config.Config
+		wantLen int
+		wantErr bool
+	}{
+		{
+			name:    "1. natOptions: relay client and hole punching",
+			cfg:     &config.Config{RelayClient: true, HolePunching: true},
+			wantLen: 2,
+		},
+		{
+			name:    "2. natOptions: relay service",
+			cfg:     &config.Config{RelayService: true, RelayClient: true, HolePunching: true},
+			wantLen: 3,
+		},
+		{
+			name:    "3. natOptions: static relays",
+			cfg:     &config.Config{RelayClient: true, StaticRelays: []string{relay}},
+			wantLen: 1,
+		},
+		{
+			name:    "4. natOptions: static relay without peer ID",
+			cfg:     &config.Config{RelayClient: true, StaticRelays: []string{"/ip4/203.0.113.7/tcp/4001"}},
+			wantErr: true,
+		},
+		{
+			name: "5. natOptions: all off",
+			cfg:  &config.Config{StaticRelays: []string{"not an address"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := natOptions(tt.cfg, newRelayCandidates())
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, opts, tt.wantLen)
+		})
+	}
+}
+
+func TestRelayCandidates(t *testing.T) {
+	mn, err := mocknet.FullMeshConnected(4)
+	require.NoError(t, err)
+	defer mn.Close()
+
+	h := mn.Hosts()[0]
+	c := newRelayCandidates()
+
+	// the host isn't there yet
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, ok := <-c.peerSource(ctx, 2)
+	require.False(t, ok)
+
+	c.setHost(h)
+	var found []peer.ID
+	for pi := range c.peerSource(context.Background(), 2) {
+		require.NotEqual(t, h.ID(), pi.ID)
+		require.NotEmpty(t, pi.Addrs)
+		found = append(found, pi.ID)
+	}
+	require.Len(t, found, 2)
+}
+
+func TestWatchReachability(t *testing.T) {
+	mn, err := mocknet.WithNPeers(1)
+	require.NoError(t, err)
+	defer mn.Close()
+	h := mn.Hosts()[0]
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := WatchReachability(ctx, h, slog.Default())
+	require.NoError(t, err)
+
+	emitter, err := h.EventBus().Emitter(new(event.EvtLocalReachabilityChanged))
+	require.NoError(t, err)
+	defer emitter.Close()
+
+	require.NoError(t, emitter.Emit(event.EvtLocalReachabilityChanged{Reachability: network.ReachabilityPrivate}))
+	require.Equal(t, network.ReachabilityPrivate, <-events)
+
+	// only the latest change waits for the reader
+	require.NoError(t, emitter.Emit(event.EvtLocalReachabilityChanged{Reachability: network.ReachabilityUnknown}))
+	require.NoError(t, emitter.Emit(event.EvtLocalReachabilityChanged{Reachability: network.ReachabilityPublic}))
+	require.Eventually(t, func() bool {
+		select {
+		case r := <-events:
+			return r == network.ReachabilityPublic
+		default:
+			return false
+		}
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	for range events {
+	}
+}
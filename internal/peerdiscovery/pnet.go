@@ -0,0 +1,72 @@
+package peerdiscovery
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"p2p-music/config"
+	"path/filepath"
+
+	"github.com/libp2p/go-libp2p/core/pnet"
+)
+
+// A private network is a set of nodes sharing a swarm key: connections
+// are encrypted with it on top of the usual security, so nodes without
+// the key can't even finish the handshake. The key is a file in the
+// format of IPFS private networks.
+const (
+	swarmKeyFileName = "swarm.key"
+	swarmKeyHeader   = "/key/swarm/psk/1.0.0/\n/base16/\n"
+	swarmKeySize     = 32
+)
+
+var errSwarmKeyExists = errors.New("swarm key already exists")
+
+// swarmKeyPath is where the swarm key of the node is, and whether it was
+// configured rather than the default one.
+func swarmKeyPath(cfg *config.Config) (string, bool) {
+	if cfg.SwarmKeyPath != "" {
+		return cfg.SwarmKeyPath, true
+	}
+	return filepath.Join(cfg.DataDir, swarmKeyFileName), false
+}
+
+// LoadSwarmKey returns the pre-shared key of the private network, nil
+// when there is no swarm key and the node joins the public network.
+func LoadSwarmKey(cfg *config.Config) (pnet.PSK, error) {
+	path, configured := swarmKeyPath(cfg)
+
+	keyBytes, err := readKeyFile(path)
+	if errors.Is(err, fs.ErrNotExist) && !configured {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	psk, err := pnet.DecodeV1PSK(bytes.NewReader(keyBytes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read swarm key %s: %w", path, err)
+	}
+	return psk, nil
+}
+
+// NewSwarmKey generates the swarm key of a new private network. The file
+// is then copied to the data directory of every node of the network.
+func NewSwarmKey(cfg *config.Config) (string, error) {
+	path, _ := swarmKeyPath(cfg)
+	if _, err := os.Stat(path); err == nil {
+		return "", fmt.Errorf("%w: %s", errSwarmKeyExists, path)
+	}
+
+	key := make([]byte, swarmKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+
+	return path, writeKeyFile(path, []byte(swarmKeyHeader+hex.EncodeToString(key)+"\n"))
+}
@@ -0,0 +1,93 @@
+package peerdiscovery
+
+import (
+	"os"
+	"p2p-music/config"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadSwarmKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     func(dir string) *config.Config
+		prepare func(t *testing.T, cfg *config.Config)
+		wantKey bool
+		wantErr bool
+	}{
+		{
+			name:    "1. LoadSwarmKey: no swarm key joins the public network",
+			cfg:     func(dir string) *config.Config { return &config.Config{DataDir: dir} },
+			prepare: func(t *testing.T, cfg *config.Config) {},
+		},
+		{
+			name: "2. LoadSwarmKey: generated key",
+			cfg:  func(dir string) *config.Config { return &config.Config{DataDir: dir} },
+			prepare: func(t *testing.T, cfg *config.Config) {
+				_, err := NewSwarmKey(cfg)
+				require.NoError(t, err)
+			},
+			wantKey: true,
+		},
+		{
+			name: "3. LoadSwarmKey: configured key is missing",
+			cfg: func(dir string) *config.Config {
+				return &config.Config{SwarmKeyPath: filepath.Join(dir, "private.key")}
+			},
+			prepare: func(t *testing.T, cfg *config.Config) {},
+			wantErr: true,
+		},
+		{
+			name: "4. LoadSwarmKey: not a swarm key",
+			cfg:  func(dir string) *config.Config { return &config.Config{DataDir: dir} },
+			prepare: func(t *testing.T, cfg *config.Config) {
+				require.NoError(t, writeKeyFile(filepath.Join(cfg.DataDir, swarmKeyFileName), []byte("not a key")))
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg(t.TempDir())
+			tt.prepare(t, cfg)
+
+			psk, err := LoadSwarmKey(cfg)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			if tt.wantKey {
+				require.Len(t, psk, swarmKeySize)
+			} else {
+				require.Nil(t, psk)
+			}
+		})
+	}
+}
+
+func TestNewSwarmKey(t *testing.T) {
+	cfg := &config.Config{DataDir: filepath.Join(t.TempDir(), "data")}
+
+	path, err := NewSwarmKey(cfg)
+	require.NoError(t, err)
+	psk, err := LoadSwarmKey(cfg)
+	require.NoError(t, err)
+
+	// the network key is never replaced by accident
+	_, err = NewSwarmKey(cfg)
+	require.ErrorIs(t, err, errSwarmKeyExists)
+	again, err := LoadSwarmKey(cfg)
+	require.NoError(t, err)
+	require.Equal(t, psk, again)
+
+	if runtime.GOOS != "windows" {
+		require.NoError(t, os.Chmod(path, 0644))
+		_, err = LoadSwarmKey(cfg)
+		require.ErrorIs(t, err, errKeyPermissions)
+	}
+}
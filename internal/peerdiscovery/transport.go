@@ -0,0 +1,181 @@
+package peerdiscovery
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"p2p-music/config"
+	"slices"
+	"strings"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	libp2pquic "github.com/libp2p/go-libp2p/p2p/transport/quic"
+	"github.com/libp2p/go-libp2p/p2p/transport/tcp"
+	"github.com/libp2p/go-libp2p/p2p/transport/websocket"
+	"github.com/multiformats/go-multiaddr"
+)
+
+const (
+	transportTCP       = "tcp"
+	transportQUIC      = "quic"
+	transportWebSocket = "websocket"
+)
+
+var (
+	errUnknownTransport = errors.New("unknown transport")
+	errNoTransport      = errors.New("no transport enabled")
+
+	// QUIC encrypts the connection itself, there is nothing to put the
+	// pre-shared key on
+	errPrivateNetworkQUIC = errors.New("QUIC doesn't support private networks")
+)
+
+// defaultTransports when none are configured.
+var defaultTransports = []string{transportTCP, transportQUIC}
+
+// defaultListenAddrs of each transport, on a random port.
+var defaultListenAddrs = map[string]string{
+	transportTCP:       "/ip4/0.0.0.0/tcp/0",
+	transportQUIC:      "/ip4/0.0.0.0/udp/0/quic-v1",
+	transportWebSocket: "/ip4/0.0.0.0/tcp/0/ws",
+}
+
+// enabledTransports returns the names of the configured transports, or of
+// the default ones. A private network leaves QUIC out of the defaults,
+// and refuses it when it is configured.
+func enabledTransports(cfg *config.Config, private bool) ([]string, error) {
+	if len(cfg.Transports) == 0 {
+		if !private {
+			return defaultTransports, nil
+		}
+
+		log.Println("QUIC doesn't support private networks, it is left out of the default transports")
+		return slices.DeleteFunc(slices.Clone(defaultTransports), func(name string) bool {
+			return name == transportQUIC
+		}), nil
+	}
+
+	names := make([]string, 0, len(cfg.Transports))
+	for _, name := range cfg.Transports {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if private && name == transportQUIC {
+			return nil, errPrivateNetworkQUIC
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// transportOptions enables the transports, the libp2p defaults are left
+// out.
+func transportOptions(names []string) ([]libp2p.Option, error) {
+	var opts []libp2p.Option
+	for _, name := range names {
+		switch name {
+		case transportTCP:
+			opts = append(opts, libp2p.Transport(tcp.NewTCPTransport))
+		case transportQUIC:
+			opts = append(opts, libp2p.Transport(libp2pquic.NewTransport))
+		case transportWebSocket:
+			opts = append(opts, libp2p.Transport(websocket.New))
+		default:
+			return nil, fmt.Errorf("%w: %q", errUnknownTransport, name)
+		}
+	}
+
+	if len(opts) == 0 {
+		return nil, errNoTransport
+	}
+	return opts, nil
+}
+
+// listenAddrs returns the configured listen addresses, or one random
+// port for each of the transports.
+func listenAddrs(cfg *config.Config, transports []string) ([]multiaddr.Multiaddr, error) {
+	if len(cfg.ListenAddrs) > 0 {
+		return parseAddrs(cfg.ListenAddrs)
+	}
+
+	var addrs []string
+	for _, name := range transports {
+		if addr, ok := defaultListenAddrs[name]; ok {
+			addrs = append(addrs, addr)
+		}
+	}
+	return parseAddrs(addrs)
+}
+
+// addrsFactory makes the addresses the node announces to its peers: the
+// AnnounceAddrs instead of the listen addresses when they are set, minus
+// the NoAnnounceAddrs. A no-announce address is either an exact address
+// or an IP range, like /ip4/10.0.0.0/ipcidr/8.
+func addrsFactory(cfg *config.Config) (func([]multiaddr.Multiaddr) []multiaddr.Multiaddr, error) {
+	announce, err := parseAddrs(cfg.AnnounceAddrs)
+	if err != nil {
+		return nil, err
+	}
+
+	noAnnounce := make(map[string]struct{})
+	filters := multiaddr.NewFilters()
+	for _, s := range cfg.NoAnnounceAddrs {
+		if _, ipnet, err := net.ParseCIDR(cidrOf(s)); err == nil {
+			filters.AddFilter(*ipnet, multiaddr.ActionDeny)
+			continue
+		}
+		addr, err := multiaddr.NewMultiaddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid no-announce address %q: %w", s, err)
+		}
+		noAnnounce[string(addr.Bytes())] = struct{}{}
+	}
+
+	return func(addrs []multiaddr.Multiaddr) []multiaddr.Multiaddr {
+		if len(announce) > 0 {
+			addrs = announce
+		}
+
+		out := make([]multiaddr.Multiaddr, 0, len(addrs))
+		for _, addr := range addrs {
+			if _, ok := noAnnounce[string(addr.Bytes())]; ok || filters.AddrBlocked(addr) {
+				continue
+			}
+			out = append(out, addr)
+		}
+		return out
+	}, nil
+}
+
+// cidrOf turns /ip4/10.0.0.0/ipcidr/8 into 10.0.0.0/8, anything else
+// into a string net.ParseCIDR refuses.
+func cidrOf(s string) string {
+	parts := strings.Split(strings.TrimPrefix(s, "/"), "/")
+	if len(parts) != 4 || (parts[0] != "ip4" && parts[0] != "ip6") || parts[2] != "ipcidr" {
+		return ""
+	}
+	return parts[1] + "/" + parts[3]
+}
+
+func parseAddrs(addrs []string) ([]multiaddr.Multiaddr, error) {
+	out := make([]multiaddr.Multiaddr, 0, len(addrs))
+	for _, s := range addrs {
+		addr, err := multiaddr.NewMultiaddr(strings.TrimSpace(s))
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %q: %w", s, err)
+		}
+		out = append(out, addr)
+	}
+	return out, nil
+}
+
+// NodeAddrs returns the addresses the node announces, with its peer ID,
+// which other nodes bootstrap from.
+func NodeAddrs(h host.Host) []multiaddr.Multiaddr {
+	addrs, err := peer.AddrInfoToP2pAddrs(&peer.AddrInfo{ID: h.ID(), Addrs: h.Addrs()})
+	if err != nil {
+		return nil
+	}
+	return addrs
+}
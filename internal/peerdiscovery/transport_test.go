@@ -0,0 +1,185 @@
+package peerdiscovery
+
+import (
+	"p2p-music/config"
+	"testing"
+
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnabledTransports(t *testing.T) {
+	tests := []struct {
+		name       string
+		transports []string
+		private    bool
+		want       []string
+		wantErr    error
+	}{
+		{
+			name: "1. enabledTransports: default transports",
+			want: []string{"tcp", "quic"},
+		},
+		{
+			name:    "2. enabledTransports: default transports of a private network",
+			private: true,
+			want:    []string{"tcp"},
+		},
+		{
+			name:       "3. enabledTransports: configured transports",
+			transports: []string{"TCP", " quic", "websocket"},
+			want:       []string{"tcp", "quic", "websocket"},
+		},
+		{
+			name:       "4. enabledTransports: QUIC configured in a private network",
+			transports: []string{"tcp", "quic"},
+			private:    true,
+			wantErr:    errPrivateNetworkQUIC,
+		},
+		{
+			name:       "5. enabledTransports: private network",
+			transports: []string{"tcp", "websocket"},
+			private:    true,
+			want:       []string{"tcp", "websocket"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			names, err := enabledTransports(&config.Config{Transports: tt.transports}, tt.private)
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, names)
+		})
+	}
+	require.Equal(t, []string{"tcp", "quic"}, defaultTransports)
+}
+
+func TestTransportOptions(t *testing.T) {
+	tests := []struct {
+		name       string
+		transports []string
+		wantLen    int
+		wantErr    error
+	}{
+		{
+			name:       "1. transportOptions: default transports",
+			transports: []string{"tcp", "quic"},
+			wantLen:    2,
+		},
+		{
+			name:       "2. transportOptions: all transports",
+			transports: []string{"tcp", "quic", "websocket"},
+			wantLen:    3,
+		},
+		{
+			name:       "3. transportOptions: unknown transport",
+			transports: []string{"tcp", "webrtc"},
+			wantErr:    errUnknownTransport,
+		},
+		{
+			name:    "4. transportOptions: no transport",
+			wantErr: errNoTransport,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := transportOptions(tt.transports)
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, opts, tt.wantLen)
+		})
+	}
+}
+
+func TestSetupHostPrivateNetworkDefaults(t *testing.T) {
+	cfg, err := config.LoadConfig()
+	require.NoError(t, err)
+	cfg.DataDir, cfg.IdentityPath, cfg.SwarmKeyPath = t.TempDir(), "", ""
+	cfg.Transports, cfg.ListenAddrs = nil, nil
+	_, err = NewSwarmKey(cfg)
+	require.NoError(t, err)
+
+	h := SetupHost(cfg)
+	defer h.Close()
+
+	require.NotEmpty(t, h.Network().ListenAddresses())
+	for _, addr := range h.Network().ListenAddresses() {
+		_, err := addr.ValueForProtocol(multiaddr.P_QUIC_V1)
+		require.Error(t, err, "QUIC listen address %s", addr)
+	}
+}
+
+func TestListenAddrs(t *testing.T) {
+	addrs, err := listenAddrs(&config.Config{}, []string{"tcp", "quic"})
+	require.NoError(t, err)
+	require.Equal(t, []multiaddr.Multiaddr{
+		multiaddr.StringCast("/ip4/0.0.0.0/tcp/0"),
+		multiaddr.StringCast("/ip4/0.0.0.0/udp/0/quic-v1"),
+	}, addrs)
+
+	addrs, err = listenAddrs(&config.Config{ListenAddrs: []string{"/ip4/0.0.0.0/tcp/4001"}}, []string{"tcp"})
+	require.NoError(t, err)
+	require.Equal(t, []multiaddr.Multiaddr{multiaddr.StringCast("/ip4/0.0.0.0/tcp/4001")}, addrs)
+
+	_, err = listenAddrs(&config.Config{ListenAddrs: []string{"0.0.0.0:4001"}}, nil)
+	require.Error(t, err)
+}
+
+func TestAddrsFactory(t *testing.T) {
+	listen := []multiaddr.Multiaddr{
+		multiaddr.StringCast("/ip4/127.0.0.1/tcp/4001"),
+		multiaddr.StringCast("/ip4/10.1.2.3/tcp/4001"),
+		multiaddr.StringCast("/ip4/192.168.1.5/udp/4001/quic-v1"),
+	}
+
+	tests := []struct {
+		name    string
+		cfg     *config.Config
+		want    []multiaddr.Multiaddr
+		wantErr bool
+	}{
+		{
+			name: "1. addrsFactory: listen addresses",
+			cfg:  &config.Config{},
+			want: listen,
+		},
+		{
+			name: "2. addrsFactory: no-announce address and range",
+			cfg:  &config.Config{NoAnnounceAddrs: []string{"/ip4/127.0.0.1/tcp/4001", "/ip4/10.0.0.0/ipcidr/8"}},
+			want: listen[2:],
+		},
+		{
+			name: "3. addrsFactory: announce addresses",
+			cfg: &config.Config{
+				AnnounceAddrs:   []string{"/ip4/203.0.113.7/tcp/4001", "/ip4/10.1.2.3/tcp/4001"},
+				NoAnnounceAddrs: []string{"/ip4/10.0.0.0/ipcidr/8"},
+			},
+			want: []multiaddr.Multiaddr{multiaddr.StringCast("/ip4/203.0.113.7/tcp/4001")},
+		},
+		{
+			name:    "4. addrsFactory: invalid no-announce address",
+			cfg:     &config.Config{NoAnnounceAddrs: []string{"10.0.0.0/8"}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			factory, err := addrsFactory(tt.cfg)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, factory(listen))
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package player
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+// converterReadSize of raw PCM read from the decoder at once.
+const converterReadSize = 16 * 1024
+
+// converter resamples and remixes the PCM of a decoder to what the
+// output plays. Resampling interpolates linearly between neighbouring
+// frames, which is plenty for the usual 44.1/48 kHz conversions.
+type converter struct {
+	dec      decoder
+	rate     int
+	channels int
+
+	// step is how many source frames one output frame advances
+	step float64
+	pos  float64
+
+	raw     []byte
+	pending []byte // incomplete source frame left from the last read
+	frames  []int16
+	eof     bool
+}
+
+func newConverter(dec decoder, sampleRate, channels int) *converter {
+	return &converter{
+		dec:      dec,
+		rate:     sampleRate,
+		channels: channels,
+		step:     float64(dec.SampleRate()) / float64(sampleRate),
+		raw:      make([]byte, converterReadSize),
+	}
+}
+
+func (c *converter) SampleRate() int { return c.rate }
+
+func (c *converter) Channels() int { return c.channels }
+
+func (c *converter) Read(p []byte) (int, error) {
+	frameSize := c.channels * bytesPerSample
+
+	n := 0
+	for n+frameSize <= len(p) {
+		i := int(c.pos)
+		if i+1 >= c.buffered() && !c.eof {
+			if err := c.fill(); err != nil {
+				if n > 0 {
+					return n, nil
+				}
+				return 0, err
+			}
+			continue
+		}
+		if i >= c.buffered() {
+			if n > 0 {
+				return n, nil
+			}
+			return 0, io.EOF
+		}
+
+		frac := c.pos - float64(i)
+		for ch := range c.channels {
+			a := float64(c.frames[i*c.channels+ch])
+			b := a
+			if i+1 < c.buffered() {
+				b = float64(c.frames[(i+1)*c.channels+ch])
+			}
+			sample := clampInt16(int64(math.Round(a + (b-a)*frac)))
+			binary.LittleEndian.PutUint16(p[n+ch*bytesPerSample:], uint16(sample))
+		}
+
+		n += frameSize
+		c.pos += c.step
+	}
+	return n, nil
+}
+
+func (c *converter) buffered() int {
+	return len(c.frames) / c.channels
+}
+
+// fill drops the frames already interpolated and appends the next chunk
+// of the source, remixed to the output channels.
+func (c *converter) fill() error {
+	consumed := min(int(c.pos), c.buffered())
+	c.frames = c.frames[:copy(c.frames, c.frames[consumed*c.channels:])]
+	c.pos -= float64(consumed)
+
+	n, err := c.dec.Read(c.raw)
+	if errors.Is(err, io.EOF) {
+		c.eof = true
+	} else if err != nil {
+		return err
+	}
+
+	data := append(c.pending, c.raw[:n]...)
+	srcChannels := c.dec.Channels()
+	srcFrameSize := srcChannels * bytesPerSample
+
+	whole := len(data) - len(data)%srcFrameSize
+	for off := 0; off < whole; off += srcFrameSize {
+		c.frames = appendRemixed(c.frames, data[off:off+srcFrameSize], srcChannels, c.channels)
+	}
+	c.pending = append(c.pending[:0], data[whole:]...)
+	return nil
+}
+
+// appendRemixed appends one source frame with the output channel count.
+// Mono is spread to every channel, down mixing to mono averages, other
+// layouts keep the leading channels, which are front left and right.
+func appendRemixed(frames []int16, frame []byte, srcChannels, channels int) []int16 {
+	sample := func(ch int) int16 {
+		return int16(binary.LittleEndian.Uint16(frame[ch*bytesPerSample:]))
+	}
+
+	switch {
+	case channels == 1:
+		var sum int64
+		for ch := range srcChannels {
+			sum += int64(sample(ch))
+		}
+		return append(frames, int16(sum/int64(srcChannels)))
+	default:
+		for ch := range channels {
+			frames = append(frames, sample(min(ch, srcChannels-1)))
+		}
+		return frames
+	}
+}
+
+func (c *converter) seekFrame(frame int64) error {
+	if err := c.dec.seekFrame(int64(float64(frame) * c.step)); err != nil {
+		return err
+	}
+
+	c.frames = c.frames[:0]
+	c.pending = c.pending[:0]
+	c.pos = 0
+	c.eof = false
+	return nil
+}
+
+func (c *converter) length() int64 {
+	return int64(float64(c.dec.length()) / c.step)
+}
@@ -0,0 +1,167 @@
+package player
+
+import (
+	"errors"
+	"io"
+	"os"
+	"p2p-music/internal/song"
+	"strings"
+	"time"
+
+	"github.com/hajimehoshi/go-mp3"
+)
+
+// bytesPerSample of the signed 16-bit little endian PCM every decoder
+// produces.
+const bytesPerSample = 2
+
+// decoder turns a song into interleaved signed 16-bit little endian PCM.
+type decoder interface {
+	io.Reader
+
+	SampleRate() int
+
+	Channels() int
+
+	// seekFrame jumps to a PCM frame. It returns errNotSeekable when the
+	// decoder can't, the player then falls back to other ways.
+	seekFrame(frame int64) error
+
+	// length is the number of PCM frames, zero when unknown
+	length() int64
+}
+
+// Source is a song and the reader with its content.
+type Source struct {
+	Song   song.Song
+	Reader io.Reader
+
+	// Streaming is set when the reader is still being filled, like a
+	// song.SongStream. Decoders which index the whole file on start
+	// don't get to seek it.
+	Streaming bool
+}
+
+// OpenFile opens a local song file for playback.
+func OpenFile(s song.Song, path string) (Source, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Source{}, err
+	}
+	return Source{Song: s, Reader: file}, nil
+}
+
+// StreamSource plays a song while it is being downloaded.
+func StreamSource(s song.Song, stream *song.SongStream) Source {
+	return Source{Song: s, Reader: stream, Streaming: true}
+}
+
+func (src Source) format() string {
+	if src.Song.Format != "" {
+		return strings.ToLower(src.Song.Format)
+	}
+	return strings.ToLower(src.Song.SongFormat())
+}
+
+// indexReader is what decoders which scan the whole file on start get,
+// io.Seeker is hidden from them while the song is streaming.
+func (src Source) indexReader() io.Reader {
+	if src.Streaming {
+		return readerOnly{src.Reader}
+	}
+	return src.Reader
+}
+
+// readerOnly hides io.Seeker.
+type readerOnly struct {
+	io.Reader
+}
+
+// newDecoder picks the decoder by the song format.
+func newDecoder(src Source) (decoder, error) {
+	switch src.format() {
+	case song.FormatMP3:
+		return newMP3Decoder(src.indexReader())
+	case song.FormatOGG:
+		return newVorbisDecoder(src.indexReader())
+	case song.FormatFLAC:
+		return newFLACDecoder(src.indexReader())
+	case song.FormatWAV:
+		return newWAVDecoder(src.Reader)
+	default:
+		return nil, UnsupportedFormatError{Format: src.format()}
+	}
+}
+
+// openDecoder returns a decoder producing PCM the output can play.
+func openDecoder(src Source, sampleRate, channels int) (decoder, error) {
+	dec, err := newDecoder(src)
+	if err != nil {
+		return nil, err
+	}
+	if dec.SampleRate() <= 0 || dec.Channels() <= 0 {
+		return nil, OutputMismatchError{SampleRate: dec.SampleRate(), Channels: dec.Channels()}
+	}
+
+	if dec.SampleRate() == sampleRate && dec.Channels() == channels {
+		return dec, nil
+	}
+	return newConverter(dec, sampleRate, channels), nil
+}
+
+type mp3Decoder struct {
+	*mp3.Decoder
+	seekable bool
+}
+
+func newMP3Decoder(r io.Reader) (*mp3Decoder, error) {
+	d, err := mp3.NewDecoder(r)
+	if err != nil {
+		return nil, err
+	}
+
+	_, seekable := r.(io.Seeker)
+	return &mp3Decoder{Decoder: d, seekable: seekable}, nil
+}
+
+// Channels is always 2, go-mp3 duplicates mono streams.
+func (d *mp3Decoder) Channels() int {
+	return 2
+}
+
+func (d *mp3Decoder) seekFrame(frame int64) error {
+	if !d.seekable {
+		return errNotSeekable
+	}
+	_, err := d.Seek(frame*2*bytesPerSample, io.SeekStart)
+	return err
+}
+
+func (d *mp3Decoder) length() int64 {
+	if !d.seekable {
+		return 0
+	}
+	return d.Length() / (2 * bytesPerSample)
+}
+
+// skipFrames decodes and drops frames, for decoders which can't seek.
+func skipFrames(dec decoder, frames int64) error {
+	_, err := io.CopyN(io.Discard, dec, frames*int64(dec.Channels()*bytesPerSample))
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	return err
+}
+
+// framesDuration converts a number of PCM frames to playback time.
+func framesDuration(frames int64, sampleRate int) time.Duration {
+	if sampleRate <= 0 {
+		return 0
+	}
+	return time.Duration(frames * int64(time.Second) / int64(sampleRate))
+}
+
+// clampInt16 converts a sample in any range to int16, clipping it.
+func clampInt16(v int64) int16 {
+	return int16(min(max(v, -32768), 32767))
+}
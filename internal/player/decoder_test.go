@@ -0,0 +1,195 @@
+package player
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"os"
+	"p2p-music/internal/song"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// toneFrames in the tone.wav and tone.flac fixtures: 1.5 seconds at
+// 22050 Hz, the last half second silent.
+const toneFrames = 33075
+
+func decodeAll(t *testing.T, src Source) (decoder, []byte) {
+	t.Helper()
+
+	dec, err := newDecoder(src)
+	require.NoError(t, err)
+
+	pcm, err := io.ReadAll(dec)
+	require.NoError(t, err)
+	return dec, pcm
+}
+
+func fileSource(t *testing.T, path, format string) Source {
+	t.Helper()
+
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { file.Close() })
+
+	return Source{Song: song.Song{Format: format}, Reader: file}
+}
+
+func TestNewDecoder(t *testing.T) {
+	_, wavPCM := decodeAll(t, fileSource(t, "testdata/tone.wav", song.FormatWAV))
+
+	testCases := []struct {
+		name           string
+		path           string
+		format         string
+		wantSampleRate int
+		wantChannels   int
+		wantFrames     int64
+		wantPCM        []byte
+	}{
+		{
+			name:           "1. newDecoder: WAV",
+			path:           "testdata/tone.wav",
+			format:         song.FormatWAV,
+			wantSampleRate: 22050,
+			wantChannels:   2,
+			wantFrames:     toneFrames,
+		},
+		{
+			name:           "2. newDecoder: FLAC decodes the same samples as WAV",
+			path:           "testdata/tone.flac",
+			format:         song.FormatFLAC,
+			wantSampleRate: 22050,
+			wantChannels:   2,
+			wantFrames:     toneFrames,
+			wantPCM:        wavPCM,
+		},
+		{
+			name:           "3. newDecoder: OGG Vorbis",
+			path:           "testdata/vorbis.ogg",
+			format:         song.FormatOGG,
+			wantSampleRate: 44100,
+			wantChannels:   1,
+			wantFrames:     44100,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dec, pcm := decodeAll(t, fileSource(t, tc.path, tc.format))
+			require.Equal(t, tc.wantSampleRate, dec.SampleRate())
+			require.Equal(t, tc.wantChannels, dec.Channels())
+			require.Equal(t, tc.wantFrames, dec.length())
+			require.Len(t, pcm, int(tc.wantFrames)*tc.wantChannels*bytesPerSample)
+			if tc.wantPCM != nil {
+				require.Equal(t, tc.wantPCM, pcm)
+			}
+		})
+	}
+}
+
+func TestNewDecoderUnsupportedFormat(t *testing.T) {
+	_, err := newDecoder(Source{Song: song.Song{Format: "xm"}, Reader: bytes.NewReader(nil)})
+
+	var formatErr UnsupportedFormatError
+	require.ErrorAs(t, err, &formatErr)
+	require.Equal(t, "xm", formatErr.Format)
+}
+
+func TestFLACSeekFrame(t *testing.T) {
+	_, wavPCM := decodeAll(t, fileSource(t, "testdata/tone.wav", song.FormatWAV))
+
+	dec, err := newDecoder(fileSource(t, "testdata/tone.flac", song.FormatFLAC))
+	require.NoError(t, err)
+
+	// land in the middle of the second FLAC frame
+	const frame = 5000
+	require.NoError(t, dec.seekFrame(frame))
+
+	pcm, err := io.ReadAll(dec)
+	require.NoError(t, err)
+	require.Equal(t, wavPCM[frame*2*bytesPerSample:], pcm)
+}
+
+// constantDecoder produces frames with the same sample.
+type constantDecoder struct {
+	sampleRate int
+	channels   int
+	frames     int
+	sample     int16
+}
+
+func (d *constantDecoder) Read(p []byte) (int, error) {
+	frameSize := d.channels * bytesPerSample
+	n := 0
+	for ; d.frames > 0 && n+frameSize <= len(p); d.frames-- {
+		for range d.channels {
+			binary.LittleEndian.PutUint16(p[n:], uint16(d.sample))
+			n += bytesPerSample
+		}
+	}
+	if n == 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+func (d *constantDecoder) SampleRate() int { return d.sampleRate }
+
+func (d *constantDecoder) Channels() int { return d.channels }
+
+func (d *constantDecoder) seekFrame(frame int64) error { return errNotSeekable }
+
+func (d *constantDecoder) length() int64 { return 0 }
+
+func TestConverter(t *testing.T) {
+	testCases := []struct {
+		name       string
+		dec        *constantDecoder
+		wantFrames int
+	}{
+		{
+			name:       "1. converter: upsample mono to stereo",
+			dec:        &constantDecoder{sampleRate: 22050, channels: 1, frames: 22050, sample: 1234},
+			wantFrames: 44100,
+		},
+		{
+			name:       "2. converter: downsample 48 kHz",
+			dec:        &constantDecoder{sampleRate: 48000, channels: 2, frames: 48000, sample: -1234},
+			wantFrames: 44100,
+		},
+		{
+			name:       "3. converter: down mix surround",
+			dec:        &constantDecoder{sampleRate: 44100, channels: 6, frames: 4410, sample: 99},
+			wantFrames: 4410,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			sample := tc.dec.sample
+			pcm, err := io.ReadAll(newConverter(tc.dec, 44100, 2))
+			require.NoError(t, err)
+
+			require.InDelta(t, tc.wantFrames, len(pcm)/(2*bytesPerSample), 1)
+			for i := 0; i < len(pcm); i += bytesPerSample {
+				require.Equal(t, sample, int16(binary.LittleEndian.Uint16(pcm[i:])))
+			}
+		})
+	}
+}
+
+func TestPlayerResamples(t *testing.T) {
+	p := NewPlayer(NewNullOutput(defaultSampleRate, defaultChannels), slog.Default())
+	defer p.Close()
+
+	require.NoError(t, p.Play(fileSource(t, "testdata/tone.flac", song.FormatFLAC)))
+
+	e := waitStopped(t, p)
+	require.NoError(t, e.Err)
+	require.Equal(t, 1500*time.Millisecond, e.Duration)
+	require.InDelta(t, e.Duration, e.Position, float64(time.Millisecond))
+}
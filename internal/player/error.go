@@ -0,0 +1,33 @@
+package player
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	errNotPlaying    = errors.New("nothing is playing")
+	errNotSeekable   = errors.New("song can't be seeked")
+	errPlayerClosed  = errors.New("player is closed")
+	errUnknownOutput = errors.New("unknown audio output")
+)
+
+// UnsupportedFormatError is returned for songs no decoder can play.
+type UnsupportedFormatError struct {
+	Format string
+}
+
+func (e UnsupportedFormatError) Error() string {
+	return fmt.Sprintf("unsupported song format %q", e.Format)
+}
+
+// OutputMismatchError is returned when the decoded audio doesn't match
+// what the output plays.
+type OutputMismatchError struct {
+	SampleRate int
+	Channels   int
+}
+
+func (e OutputMismatchError) Error() string {
+	return fmt.Sprintf("output can't play %d Hz audio with %d channels", e.SampleRate, e.Channels)
+}
@@ -0,0 +1,101 @@
+package player
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/mewkiz/flac"
+)
+
+type flacDecoder struct {
+	stream   *flac.Stream
+	seekable bool
+
+	pending []byte
+	skip    int64 // frames to drop from the next decoded frames
+}
+
+func newFLACDecoder(r io.Reader) (*flacDecoder, error) {
+	if rs, ok := r.(io.ReadSeeker); ok {
+		stream, err := flac.NewSeek(rs)
+		if err != nil {
+			return nil, err
+		}
+		return &flacDecoder{stream: stream, seekable: true}, nil
+	}
+
+	stream, err := flac.New(r)
+	if err != nil {
+		return nil, err
+	}
+	return &flacDecoder{stream: stream}, nil
+}
+
+func (d *flacDecoder) SampleRate() int { return int(d.stream.Info.SampleRate) }
+
+func (d *flacDecoder) Channels() int { return int(d.stream.Info.NChannels) }
+
+func (d *flacDecoder) Read(p []byte) (int, error) {
+	for len(d.pending) == 0 {
+		if err := d.decodeFrame(); err != nil {
+			return 0, err
+		}
+	}
+
+	frameSize := d.Channels() * bytesPerSample
+	n := copy(p[:len(p)-len(p)%frameSize], d.pending)
+	d.pending = d.pending[n:]
+	return n, nil
+}
+
+// decodeFrame decodes the next frame into pending PCM.
+func (d *flacDecoder) decodeFrame() error {
+	frame, err := d.stream.ParseNext()
+	if err != nil {
+		return err
+	}
+
+	blockSize := int(frame.BlockSize)
+	start := min(int(d.skip), blockSize)
+	d.skip -= int64(start)
+
+	d.pending = d.pending[:0]
+	shift := int(frame.BitsPerSample) - 16
+	for i := start; i < blockSize; i++ {
+		for _, subframe := range frame.Subframes {
+			sample := subframe.Samples[i]
+			if shift > 0 {
+				sample >>= shift
+			} else {
+				sample <<= -shift
+			}
+			d.pending = binary.LittleEndian.AppendUint16(d.pending, uint16(int16(sample)))
+		}
+	}
+	return nil
+}
+
+// seekFrame seeks to the FLAC frame holding the target and drops the
+// frames before it. Without a seek table the first seek scans the file.
+func (d *flacDecoder) seekFrame(frame int64) error {
+	if !d.seekable {
+		return errNotSeekable
+	}
+
+	start, err := d.stream.Seek(uint64(frame))
+	if err != nil {
+		// flac can't seek past the end nor, once it scanned the file,
+		// into its last buffered bytes. The player decodes up to the
+		// frame instead
+		return errors.Join(errNotSeekable, err)
+	}
+
+	d.pending = d.pending[:0]
+	d.skip = frame - int64(start)
+	return nil
+}
+
+func (d *flacDecoder) length() int64 {
+	return int64(d.stream.Info.NSamples)
+}
@@ -0,0 +1,143 @@
+package player
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/ebitengine/oto/v3"
+)
+
+const (
+	// otoBufferDuration of PCM queued ahead of the sound card. Smaller
+	// means quicker pause and seek but more risk of underruns.
+	otoBufferDuration = 200 * time.Millisecond
+)
+
+// OtoOutput plays through the sound card. There can only be one oto
+// context per process, so there is one OtoOutput for the whole node.
+type OtoOutput struct {
+	sampleRate int
+	channels   int
+
+	player *oto.Player
+	buf    *pcmBuffer
+}
+
+func NewOtoOutput(sampleRate, channels int) (*OtoOutput, error) {
+	otoCtx, readyChan, err := oto.NewContext(&oto.NewContextOptions{
+		SampleRate:   sampleRate,
+		ChannelCount: channels,
+		Format:       oto.FormatSignedInt16LE,
+		BufferSize:   otoBufferDuration,
+	})
+	if err != nil {
+		return nil, err
+	}
+	<-readyChan
+
+	bytesPerSecond := sampleRate * channels * bytesPerSample
+	buf := newPCMBuffer(int(int64(bytesPerSecond) * int64(otoBufferDuration) / int64(time.Second)))
+
+	player := otoCtx.NewPlayer(buf)
+	player.SetBufferSize(buf.capacity)
+	player.Play()
+
+	return &OtoOutput{
+		sampleRate: sampleRate,
+		channels:   channels,
+		player:     player,
+		buf:        buf,
+	}, nil
+}
+
+func (o *OtoOutput) SampleRate() int { return o.sampleRate }
+
+func (o *OtoOutput) Channels() int { return o.channels }
+
+func (o *OtoOutput) Write(pcm []byte) (int, error) {
+	if err := o.player.Err(); err != nil {
+		return 0, err
+	}
+	return o.buf.Write(pcm)
+}
+
+func (o *OtoOutput) Flush() {
+	o.buf.reset()
+	// drops what oto itself has buffered
+	o.player.Seek(0, io.SeekStart)
+}
+
+func (o *OtoOutput) Close() error {
+	o.buf.close()
+	return o.player.Close()
+}
+
+// pcmBuffer sits between the player and oto. Writes block while it is
+// full, reads never block and return silence when it is empty, so the
+// oto player keeps running between songs.
+type pcmBuffer struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	data     []byte
+	capacity int
+	closed   bool
+}
+
+func newPCMBuffer(capacity int) *pcmBuffer {
+	b := &pcmBuffer{capacity: capacity}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+func (b *pcmBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	written := 0
+	for written < len(p) {
+		for !b.closed && len(b.data) >= b.capacity {
+			b.cond.Wait()
+		}
+		if b.closed {
+			return written, errPlayerClosed
+		}
+
+		n := min(len(p)-written, b.capacity-len(b.data))
+		b.data = append(b.data, p[written:written+n]...)
+		written += n
+	}
+	return written, nil
+}
+
+func (b *pcmBuffer) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := copy(p, b.data)
+	b.data = b.data[:copy(b.data, b.data[n:])]
+	clear(p[n:])
+	b.cond.Broadcast()
+	return len(p), nil
+}
+
+// Seek only exists so oto drops its own buffer on Flush.
+func (b *pcmBuffer) Seek(offset int64, whence int) (int64, error) {
+	return 0, nil
+}
+
+func (b *pcmBuffer) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.data = b.data[:0]
+	b.cond.Broadcast()
+}
+
+func (b *pcmBuffer) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	b.cond.Broadcast()
+}
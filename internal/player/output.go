@@ -0,0 +1,157 @@
+package player
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"p2p-music/config"
+	"sync"
+)
+
+const (
+	// OutputDevice plays through the sound card.
+	OutputDevice = "device"
+
+	// OutputNull discards the audio, for nodes without a sound card.
+	OutputNull = "null"
+
+	// OutputWAV writes the audio into a WAV file.
+	OutputWAV = "wav"
+
+	defaultSampleRate = 44100
+	defaultChannels   = 2
+)
+
+// Output plays interleaved signed 16-bit little endian PCM. It lives as
+// long as the player and is shared by all songs.
+type Output interface {
+	SampleRate() int
+
+	Channels() int
+
+	// Write blocks until the PCM is queued for playback.
+	Write(pcm []byte) (int, error)
+
+	// Flush drops queued PCM, so stop and seek are heard right away.
+	Flush()
+
+	Close() error
+}
+
+// NewOutput opens the output selected by AUDIO_OUTPUT.
+func NewOutput(cfg *config.Config) (Output, error) {
+	switch cfg.AudioOutput {
+	case OutputDevice, "":
+		return NewOtoOutput(defaultSampleRate, defaultChannels)
+	case OutputNull:
+		return NewNullOutput(defaultSampleRate, defaultChannels), nil
+	case OutputWAV:
+		file, err := os.Create(cfg.WAVOutputPath)
+		if err != nil {
+			return nil, err
+		}
+		out, err := NewWAVOutput(file, defaultSampleRate, defaultChannels)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		return out, nil
+	default:
+		return nil, errUnknownOutput
+	}
+}
+
+// NullOutput discards everything it is given, as fast as it is given.
+type NullOutput struct {
+	sampleRate int
+	channels   int
+}
+
+func NewNullOutput(sampleRate, channels int) *NullOutput {
+	return &NullOutput{sampleRate: sampleRate, channels: channels}
+}
+
+func (o *NullOutput) SampleRate() int { return o.sampleRate }
+
+func (o *NullOutput) Channels() int { return o.channels }
+
+func (o *NullOutput) Write(pcm []byte) (int, error) { return len(pcm), nil }
+
+func (o *NullOutput) Flush() {}
+
+func (o *NullOutput) Close() error { return nil }
+
+// wavHeaderSize of the canonical 44 byte RIFF/WAVE header.
+const wavHeaderSize = 44
+
+// WAVOutput writes the audio into a WAV file. The sizes in the header are
+// filled in on Close.
+type WAVOutput struct {
+	mu         sync.Mutex
+	w          io.WriteSeeker
+	sampleRate int
+	channels   int
+	dataSize   int64
+}
+
+// NewWAVOutput writes a WAV header to w. Close patches the header and
+// closes w if it is an io.Closer.
+func NewWAVOutput(w io.WriteSeeker, sampleRate, channels int) (*WAVOutput, error) {
+	o := &WAVOutput{w: w, sampleRate: sampleRate, channels: channels}
+	if _, err := w.Write(o.header()); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func (o *WAVOutput) header() []byte {
+	blockAlign := o.channels * bytesPerSample
+
+	header := make([]byte, 0, wavHeaderSize)
+	header = append(header, "RIFF"...)
+	header = binary.LittleEndian.AppendUint32(header, uint32(wavHeaderSize-8+o.dataSize))
+	header = append(header, "WAVEfmt "...)
+	header = binary.LittleEndian.AppendUint32(header, 16)
+	header = binary.LittleEndian.AppendUint16(header, 1) // PCM
+	header = binary.LittleEndian.AppendUint16(header, uint16(o.channels))
+	header = binary.LittleEndian.AppendUint32(header, uint32(o.sampleRate))
+	header = binary.LittleEndian.AppendUint32(header, uint32(o.sampleRate*blockAlign))
+	header = binary.LittleEndian.AppendUint16(header, uint16(blockAlign))
+	header = binary.LittleEndian.AppendUint16(header, 8*bytesPerSample)
+	header = append(header, "data"...)
+	header = binary.LittleEndian.AppendUint32(header, uint32(o.dataSize))
+	return header
+}
+
+func (o *WAVOutput) SampleRate() int { return o.sampleRate }
+
+func (o *WAVOutput) Channels() int { return o.channels }
+
+func (o *WAVOutput) Write(pcm []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	n, err := o.w.Write(pcm)
+	o.dataSize += int64(n)
+	return n, err
+}
+
+// Flush does nothing, the file keeps what was played.
+func (o *WAVOutput) Flush() {}
+
+func (o *WAVOutput) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if _, err := o.w.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := o.w.Write(o.header()); err != nil {
+		return err
+	}
+
+	if closer, ok := o.w.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
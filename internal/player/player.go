@@ -0,0 +1,448 @@
+package player
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"p2p-music/internal/song"
+	"sync"
+	"time"
+)
+
+const (
+	// eventInterval between position events while playing.
+	eventInterval = 250 * time.Millisecond
+
+	// eventsBufferSize of the events channel. Old events are dropped when
+	// nobody reads them.
+	eventsBufferSize = 16
+
+	// pumpFrames of PCM decoded and written in one go.
+	pumpFrames = 2048
+)
+
+type State int
+
+const (
+	Stopped State = iota
+	Playing
+	Paused
+)
+
+func (s State) String() string {
+	switch s {
+	case Playing:
+		return "playing"
+	case Paused:
+		return "paused"
+	default:
+		return "stopped"
+	}
+}
+
+// Event reports the player state and the playback position. Err is set
+// when playback stopped because of an error.
+type Event struct {
+	State    State
+	Source   Source
+	Position time.Duration
+	Duration time.Duration
+	Err      error
+}
+
+// Player plays one song at a time through a long-lived output.
+type Player struct {
+	out    Output
+	logger *slog.Logger
+	events chan Event
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	track  *track
+	state  State
+	volume float64
+	closed bool
+}
+
+// track is the song being played. mu serializes decoder reads and seeks,
+// the position is guarded by Player.mu.
+type track struct {
+	src Source
+
+	mu  sync.Mutex
+	dec decoder
+
+	base     time.Duration // position the decoder started at
+	frames   int64         // frames played since base
+	gen      int           // bumped on seek, drops PCM decoded before it
+	duration time.Duration
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func NewPlayer(out Output, logger *slog.Logger) *Player {
+	p := &Player{
+		out:    out,
+		logger: logger,
+		events: make(chan Event, eventsBufferSize),
+		volume: 1,
+	}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// Events returns the channel with state changes and, while playing,
+// periodic position updates. It is closed by Close.
+func (p *Player) Events() <-chan Event {
+	return p.events
+}
+
+// Play stops the current song and starts playing src. The player owns
+// the source reader from now on and closes it when done.
+func (p *Player) Play(src Source) error {
+	dec, err := openDecoder(src, p.out.SampleRate(), p.out.Channels())
+	if err != nil {
+		closeSource(src)
+		return err
+	}
+
+	t := &track{
+		src:      src,
+		dec:      dec,
+		duration: src.Song.Duration,
+		done:     make(chan struct{}),
+	}
+	if t.duration == 0 {
+		t.duration = framesDuration(dec.length(), dec.SampleRate())
+	}
+
+	p.Stop()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		closeSource(src)
+		return errPlayerClosed
+	}
+
+	p.track = t
+	p.state = Playing
+	p.emit(nil)
+
+	go p.run(t)
+
+	p.logger.Info("Playing song", "CID", src.Song.CID, "title", src.Song.Title, "streaming", src.Streaming)
+	return nil
+}
+
+func (p *Player) Pause() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.state != Playing {
+		return
+	}
+	p.state = Paused
+	p.emit(nil)
+}
+
+func (p *Player) Resume() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.state != Paused {
+		return
+	}
+	p.state = Playing
+	p.cond.Broadcast()
+	p.emit(nil)
+}
+
+// Stop stops playback and waits until the song is released.
+func (p *Player) Stop() {
+	p.mu.Lock()
+	t := p.track
+	if t == nil {
+		p.mu.Unlock()
+		return
+	}
+	p.track = nil
+	p.state = Stopped
+	p.cond.Broadcast()
+	p.emitTrack(t, nil)
+	p.mu.Unlock()
+
+	// unblocks a decoder waiting for a download
+	t.close()
+	p.out.Flush()
+	<-t.done
+}
+
+// Seek jumps to pos in the current song.
+func (p *Player) Seek(pos time.Duration) error {
+	p.mu.Lock()
+	t := p.track
+	p.mu.Unlock()
+	if t == nil {
+		return errNotPlaying
+	}
+
+	pos = max(pos, 0)
+	if t.duration > 0 {
+		pos = min(pos, t.duration)
+	}
+
+	t.mu.Lock()
+	err := t.seek(pos)
+	if err == nil {
+		p.mu.Lock()
+		t.base = pos
+		t.frames = 0
+		t.gen++
+		p.mu.Unlock()
+	}
+	t.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	p.out.Flush()
+
+	p.mu.Lock()
+	p.emit(nil)
+	p.mu.Unlock()
+	return nil
+}
+
+// SetVolume sets the volume between 0 (muted) and 1 (as decoded).
+func (p *Player) SetVolume(volume float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.volume = min(max(volume, 0), 1)
+}
+
+func (p *Player) Volume() float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.volume
+}
+
+// Status returns the current state the way an event would report it.
+func (p *Player) Status() Event {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.track == nil {
+		return Event{State: p.state}
+	}
+	return p.trackEvent(p.track, nil)
+}
+
+// Close stops playback, closes the output and the events channel.
+func (p *Player) Close() error {
+	p.Stop()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	close(p.events)
+	return p.out.Close()
+}
+
+// run decodes the track into the output until it ends or is stopped.
+func (p *Player) run(t *track) {
+	defer close(t.done)
+	defer t.close()
+
+	frameSize := p.out.Channels() * bytesPerSample
+	buf := make([]byte, pumpFrames*frameSize)
+	lastEvent := time.Now()
+
+	for p.waitPlaying(t) {
+		t.mu.Lock()
+		n, err := io.ReadFull(t.dec, buf)
+		p.mu.Lock()
+		gen := t.gen
+		volume := p.volume
+		p.mu.Unlock()
+		t.mu.Unlock()
+
+		n -= n % frameSize
+		if n > 0 {
+			applyVolume(buf[:n], volume)
+			if _, err := p.out.Write(buf[:n]); err != nil {
+				p.finish(t, fmt.Errorf("audio output: %w", err))
+				return
+			}
+
+			p.mu.Lock()
+			if t.gen == gen {
+				t.frames += int64(n / frameSize)
+			}
+			if time.Since(lastEvent) >= eventInterval && p.track == t {
+				p.emit(nil)
+				lastEvent = time.Now()
+			}
+			p.mu.Unlock()
+		}
+
+		switch {
+		case err == io.EOF || err == io.ErrUnexpectedEOF:
+			p.finish(t, nil)
+			return
+		case err != nil:
+			p.finish(t, fmt.Errorf("decode song: %w", err))
+			return
+		}
+	}
+}
+
+// waitPlaying blocks while the track is paused. It returns false once the
+// track isn't the current one anymore.
+func (p *Player) waitPlaying(t *track) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for p.track == t && p.state == Paused {
+		p.cond.Wait()
+	}
+	return p.track == t
+}
+
+// finish ends the track on its own, because it ended or failed.
+func (p *Player) finish(t *track, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.track != t {
+		// stopped meanwhile, the error is of no interest
+		return
+	}
+	if err != nil {
+		p.logger.Error("Playback failed", "CID", t.src.Song.CID, "err", err)
+	}
+
+	p.track = nil
+	p.state = Stopped
+	p.emitTrack(t, err)
+}
+
+// emit sends the current state. Must be called with mu held.
+func (p *Player) emit(err error) {
+	if p.track == nil {
+		p.send(Event{State: p.state, Err: err})
+		return
+	}
+	p.emitTrack(p.track, err)
+}
+
+func (p *Player) emitTrack(t *track, err error) {
+	p.send(p.trackEvent(t, err))
+}
+
+func (p *Player) trackEvent(t *track, err error) Event {
+	return Event{
+		State:    p.state,
+		Source:   t.src,
+		Position: t.base + framesDuration(t.frames, p.out.SampleRate()),
+		Duration: t.duration,
+		Err:      err,
+	}
+}
+
+// send never blocks, the oldest event is dropped for the new one when
+// nobody keeps up reading.
+func (p *Player) send(e Event) {
+	if p.closed {
+		return
+	}
+	for {
+		select {
+		case p.events <- e:
+			return
+		default:
+		}
+
+		select {
+		case <-p.events:
+		default:
+		}
+	}
+}
+
+// seek moves the decoder to pos. Must be called with t.mu held.
+func (t *track) seek(pos time.Duration) error {
+	rate, channels := t.dec.SampleRate(), t.dec.Channels()
+	frame := int64(pos) * int64(rate) / int64(time.Second)
+
+	err := t.dec.seekFrame(frame)
+	if !errors.Is(err, errNotSeekable) {
+		return err
+	}
+
+	// start a new decoder on the source, which is still a seekable
+	// stream unless it is a plain reader
+	seeker, ok := t.src.Reader.(io.Seeker)
+	if !ok {
+		return errNotSeekable
+	}
+
+	var skip int64
+	if t.src.format() == song.FormatMP3 && t.src.Song.FileSize > 0 && t.duration > 0 {
+		// estimate the byte offset, the decoder resyncs on the next
+		// frame header. Good enough for constant bitrate songs
+		offset := int64(float64(t.src.Song.FileSize) * float64(pos) / float64(t.duration))
+		if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+	} else {
+		if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		skip = frame
+	}
+
+	dec, err := openDecoder(t.src, rate, channels)
+	if err != nil {
+		return err
+	}
+	if err := skipFrames(dec, skip); err != nil {
+		return err
+	}
+
+	t.dec = dec
+	return nil
+}
+
+func (t *track) close() {
+	t.closeOnce.Do(func() {
+		closeSource(t.src)
+	})
+}
+
+func closeSource(src Source) {
+	if closer, ok := src.Reader.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// applyVolume scales signed 16-bit little endian samples in place.
+func applyVolume(pcm []byte, volume float64) {
+	if volume >= 1 {
+		return
+	}
+	for i := 0; i+1 < len(pcm); i += bytesPerSample {
+		sample := int16(binary.LittleEndian.Uint16(pcm[i:]))
+		binary.LittleEndian.PutUint16(pcm[i:], uint16(int16(float64(sample)*volume)))
+	}
+}
@@ -0,0 +1,187 @@
+package player
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"os"
+	"p2p-music/internal/song"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const fixture = "../song/testdata/id3v23.mp3"
+
+// gateOutput discards PCM but only once the gate is open.
+type gateOutput struct {
+	NullOutput
+	gate chan struct{}
+}
+
+func (o *gateOutput) Write(pcm []byte) (int, error) {
+	<-o.gate
+	return len(pcm), nil
+}
+
+func openFixture(t *testing.T) Source {
+	t.Helper()
+
+	s, err := song.NewSong(fixture)
+	require.NoError(t, err)
+
+	src, err := OpenFile(s, fixture)
+	require.NoError(t, err)
+	return src
+}
+
+// waitStopped reads events until playback stops.
+func waitStopped(t *testing.T, p *Player) Event {
+	t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e := <-p.Events():
+			if e.State == Stopped {
+				return e
+			}
+		case <-timeout:
+			t.Fatal("playback didn't stop")
+		}
+	}
+}
+
+func TestPlayerWAVOutput(t *testing.T) {
+	wavPath := filepath.Join(t.TempDir(), "out.wav")
+	file, err := os.Create(wavPath)
+	require.NoError(t, err)
+
+	out, err := NewWAVOutput(file, defaultSampleRate, defaultChannels)
+	require.NoError(t, err)
+
+	p := NewPlayer(out, slog.Default())
+
+	src := openFixture(t)
+	require.NoError(t, p.Play(src))
+
+	e := waitStopped(t, p)
+	require.NoError(t, e.Err)
+	require.InDelta(t, src.Song.Duration, e.Position, float64(50*time.Millisecond))
+
+	require.NoError(t, p.Close())
+
+	wav, err := os.ReadFile(wavPath)
+	require.NoError(t, err)
+	require.Equal(t, "RIFF", string(wav[:4]))
+	require.Equal(t, "WAVE", string(wav[8:12]))
+
+	dataSize := binary.LittleEndian.Uint32(wav[40:44])
+	require.Equal(t, len(wav)-wavHeaderSize, int(dataSize))
+
+	played := framesDuration(int64(dataSize)/(defaultChannels*bytesPerSample), defaultSampleRate)
+	require.Equal(t, e.Position, played)
+}
+
+func TestPlayerControls(t *testing.T) {
+	out := &gateOutput{
+		NullOutput: *NewNullOutput(defaultSampleRate, defaultChannels),
+		gate:       make(chan struct{}),
+	}
+	p := NewPlayer(out, slog.Default())
+	defer p.Close()
+
+	src := openFixture(t)
+	require.NoError(t, p.Play(src))
+	require.Equal(t, Playing, p.Status().State)
+
+	p.Pause()
+	require.Equal(t, Paused, p.Status().State)
+
+	require.NoError(t, p.Seek(time.Second))
+	require.Equal(t, time.Second, p.Status().Position)
+
+	p.SetVolume(2)
+	require.Equal(t, 1.0, p.Volume())
+
+	close(out.gate)
+	p.Resume()
+
+	e := waitStopped(t, p)
+	require.NoError(t, e.Err)
+	require.InDelta(t, src.Song.Duration, e.Position, float64(50*time.Millisecond))
+
+	require.ErrorIs(t, p.Seek(0), errNotPlaying)
+}
+
+func TestPlayerStop(t *testing.T) {
+	out := &gateOutput{
+		NullOutput: *NewNullOutput(defaultSampleRate, defaultChannels),
+		gate:       make(chan struct{}),
+	}
+	p := NewPlayer(out, slog.Default())
+
+	require.NoError(t, p.Play(openFixture(t)))
+
+	stopped := make(chan struct{})
+	go func() {
+		p.Stop()
+		close(stopped)
+	}()
+
+	// the blocked write has to finish before the track is released
+	close(out.gate)
+	<-stopped
+
+	require.Equal(t, Stopped, p.Status().State)
+	require.NoError(t, p.Close())
+}
+
+func TestPlayerUnsupportedFormat(t *testing.T) {
+	p := NewPlayer(NewNullOutput(defaultSampleRate, defaultChannels), slog.Default())
+	defer p.Close()
+
+	src := openFixture(t)
+	src.Song.Format = "xm"
+
+	var formatErr UnsupportedFormatError
+	require.ErrorAs(t, p.Play(src), &formatErr)
+	require.Equal(t, "xm", formatErr.Format)
+}
+
+func TestApplyVolume(t *testing.T) {
+	testCases := []struct {
+		name   string
+		volume float64
+		sample int16
+		want   int16
+	}{
+		{
+			name:   "1. applyVolume: full volume",
+			volume: 1,
+			sample: -1000,
+			want:   -1000,
+		},
+		{
+			name:   "2. applyVolume: half volume",
+			volume: 0.5,
+			sample: -1000,
+			want:   -500,
+		},
+		{
+			name:   "3. applyVolume: muted",
+			volume: 0,
+			sample: 32767,
+			want:   0,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pcm := binary.LittleEndian.AppendUint16(nil, uint16(tc.sample))
+			applyVolume(pcm, tc.volume)
+			require.Equal(t, tc.want, int16(binary.LittleEndian.Uint16(pcm)))
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package player
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/jfreymuth/oggvorbis"
+)
+
+type vorbisDecoder struct {
+	r        *oggvorbis.Reader
+	seekable bool
+	samples  []float32
+}
+
+func newVorbisDecoder(r io.Reader) (*vorbisDecoder, error) {
+	reader, err := oggvorbis.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	_, seekable := r.(io.Seeker)
+	return &vorbisDecoder{r: reader, seekable: seekable}, nil
+}
+
+func (d *vorbisDecoder) SampleRate() int { return d.r.SampleRate() }
+
+func (d *vorbisDecoder) Channels() int { return d.r.Channels() }
+
+func (d *vorbisDecoder) Read(p []byte) (int, error) {
+	channels := d.r.Channels()
+	count := len(p) / bytesPerSample
+	count -= count % channels
+	if count == 0 {
+		return 0, io.ErrShortBuffer
+	}
+
+	if cap(d.samples) < count {
+		d.samples = make([]float32, count)
+	}
+	n, err := d.r.Read(d.samples[:count])
+	for i, sample := range d.samples[:n] {
+		binary.LittleEndian.PutUint16(p[i*bytesPerSample:], uint16(clampInt16(int64(sample*32767))))
+	}
+	return n * bytesPerSample, err
+}
+
+func (d *vorbisDecoder) seekFrame(frame int64) error {
+	if !d.seekable {
+		return errNotSeekable
+	}
+	return d.r.SetPosition(frame)
+}
+
+func (d *vorbisDecoder) length() int64 {
+	return d.r.Length()
+}
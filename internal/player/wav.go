@@ -0,0 +1,199 @@
+package player
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+const (
+	wavFormatPCM        = 1
+	wavFormatFloat      = 3
+	wavFormatExtensible = 0xFFFE
+)
+
+var errInvalidWAV = errors.New("invalid WAV file")
+
+// wavDecoder reads integer PCM of 8 to 32 bits and 32/64-bit float WAV
+// files.
+type wavDecoder struct {
+	src io.Reader
+	r   *bufio.Reader
+
+	format        int
+	channels      int
+	sampleRate    int
+	bitsPerSample int
+	blockAlign    int
+
+	dataStart int64
+	dataSize  int64
+	read      int64
+
+	block []byte
+}
+
+func newWAVDecoder(r io.Reader) (*wavDecoder, error) {
+	d := &wavDecoder{src: r, r: bufio.NewReader(r)}
+
+	var riff [12]byte
+	if _, err := io.ReadFull(d.r, riff[:]); err != nil {
+		return nil, err
+	}
+	if string(riff[:4]) != "RIFF" || string(riff[8:]) != "WAVE" {
+		return nil, errInvalidWAV
+	}
+	offset := int64(len(riff))
+
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(d.r, header[:]); err != nil {
+			return nil, errInvalidWAV
+		}
+		offset += int64(len(header))
+		size := int64(binary.LittleEndian.Uint32(header[4:]))
+
+		switch string(header[:4]) {
+		case "fmt ":
+			if size < 16 {
+				return nil, errInvalidWAV
+			}
+			chunk := make([]byte, size+size%2)
+			if _, err := io.ReadFull(d.r, chunk); err != nil {
+				return nil, err
+			}
+			offset += int64(len(chunk))
+
+			d.format = int(binary.LittleEndian.Uint16(chunk[0:]))
+			d.channels = int(binary.LittleEndian.Uint16(chunk[2:]))
+			d.sampleRate = int(binary.LittleEndian.Uint32(chunk[4:]))
+			d.blockAlign = int(binary.LittleEndian.Uint16(chunk[12:]))
+			d.bitsPerSample = int(binary.LittleEndian.Uint16(chunk[14:]))
+			if d.format == wavFormatExtensible && size >= 26 {
+				// the sub format GUID starts with the format tag
+				d.format = int(binary.LittleEndian.Uint16(chunk[24:]))
+			}
+
+		case "data":
+			if d.channels == 0 {
+				return nil, errInvalidWAV
+			}
+			if err := d.validate(); err != nil {
+				return nil, err
+			}
+			d.dataStart = offset
+			d.dataSize = size
+			d.block = make([]byte, d.blockAlign)
+			return d, nil
+
+		default:
+			if _, err := d.r.Discard(int(size + size%2)); err != nil {
+				return nil, err
+			}
+			offset += size + size%2
+		}
+	}
+}
+
+func (d *wavDecoder) validate() error {
+	switch {
+	case d.format == wavFormatPCM && d.bitsPerSample >= 8 && d.bitsPerSample <= 32:
+	case d.format == wavFormatFloat && (d.bitsPerSample == 32 || d.bitsPerSample == 64):
+	default:
+		return UnsupportedFormatError{Format: "wav"}
+	}
+
+	if d.blockAlign != d.channels*((d.bitsPerSample+7)/8) {
+		return errInvalidWAV
+	}
+	return nil
+}
+
+func (d *wavDecoder) SampleRate() int { return d.sampleRate }
+
+func (d *wavDecoder) Channels() int { return d.channels }
+
+func (d *wavDecoder) Read(p []byte) (int, error) {
+	frameSize := d.channels * bytesPerSample
+	if len(p) < frameSize {
+		return 0, io.ErrShortBuffer
+	}
+
+	n := 0
+	for n+frameSize <= len(p) {
+		if d.dataSize > 0 && d.read+int64(d.blockAlign) > d.dataSize {
+			break
+		}
+		if _, err := io.ReadFull(d.r, d.block); err != nil {
+			if n > 0 {
+				return n, nil
+			}
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				err = io.EOF
+			}
+			return 0, err
+		}
+		d.read += int64(d.blockAlign)
+
+		width := d.blockAlign / d.channels
+		for ch := range d.channels {
+			sample := d.sample(d.block[ch*width : (ch+1)*width])
+			binary.LittleEndian.PutUint16(p[n+ch*bytesPerSample:], uint16(sample))
+		}
+		n += frameSize
+	}
+
+	if n == 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+// sample converts one little endian sample to int16.
+func (d *wavDecoder) sample(b []byte) int16 {
+	if d.format == wavFormatFloat {
+		var v float64
+		if len(b) == 8 {
+			v = math.Float64frombits(binary.LittleEndian.Uint64(b))
+		} else {
+			v = float64(math.Float32frombits(binary.LittleEndian.Uint32(b)))
+		}
+		return clampInt16(int64(v * 32767))
+	}
+
+	if len(b) == 1 {
+		// 8-bit WAV is unsigned
+		return int16(int(b[0])-128) << 8
+	}
+
+	// the two most significant bytes are the 16-bit sample
+	return int16(binary.LittleEndian.Uint16(b[len(b)-2:]))
+}
+
+func (d *wavDecoder) seekFrame(frame int64) error {
+	seeker, ok := d.src.(io.Seeker)
+	if !ok {
+		return errNotSeekable
+	}
+
+	offset := frame * int64(d.blockAlign)
+	if d.dataSize > 0 {
+		offset = min(offset, d.dataSize)
+	}
+	if _, err := seeker.Seek(d.dataStart+offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	d.r.Reset(d.src)
+	d.read = offset
+	return nil
+}
+
+func (d *wavDecoder) length() int64 {
+	if d.dataSize <= 0 || d.dataSize == math.MaxUint32 {
+		return 0
+	}
+	return d.dataSize / int64(d.blockAlign)
+}
@@ -0,0 +1,253 @@
+package song
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// The global song table is a CRDT keyed by CID: an add-wins observed-remove
+// set of songs, each with a last-writer-wins register for its metadata.
+// Peers gossip operations, every operation is merged into the entry of its
+// CID as a small state of its own, so replicas converge whatever the order
+// and however often the operations arrive.
+
+type CatalogOpKind string
+
+const (
+	CatalogAdd    CatalogOpKind = "add"
+	CatalogRemove CatalogOpKind = "remove"
+	CatalogUpdate CatalogOpKind = "update"
+)
+
+var errInvalidCatalogOp = errors.New("invalid catalog operation")
+
+// Clock orders metadata writes: a hybrid logical clock time, ties broken
+// by the writing peer, so every replica picks the same winner.
+type Clock struct {
+	Time int64  `cbor:"1,keyasint,omitempty"` // unix nanoseconds, always past every clock seen
+	Peer string `cbor:"2,keyasint,omitempty"`
+}
+
+func (c Clock) Compare(other Clock) int {
+	if n := cmp.Compare(c.Time, other.Time); n != 0 {
+		return n
+	}
+	return strings.Compare(c.Peer, other.Peer)
+}
+
+// CatalogOp is a change to the global song table.
+type CatalogOp struct {
+	Kind CatalogOpKind `cbor:"1,keyasint"`
+	CID  cid.Cid       `cbor:"2,keyasint"`
+
+	// Tag identifies an add, Tags are the adds a remove has observed.
+	// Adds the remover hasn't seen survive it.
+	Tag  string   `json:",omitempty" cbor:"3,keyasint,omitempty"`
+	Tags []string `json:",omitempty" cbor:"4,keyasint,omitempty"`
+
+	// Song and Clock are the metadata written by adds and updates.
+	Song  Song  `cbor:"5,keyasint,omitempty"`
+	Clock Clock `cbor:"6,keyasint,omitempty"`
+
+	// Publisher signed the operation, it is kept as the publisher of the
+	// metadata it writes.
+	Publisher peer.ID `json:",omitempty" cbor:"7,keyasint,omitempty"`
+
+	// Signed is the signed operation as gossiped, kept in the entries it
+	// changes as the proof of the change.
+	Signed []byte `json:"-" cbor:"-"`
+}
+
+func (op CatalogOp) Validate() error {
+	if !op.CID.Defined() {
+		return errInvalidCatalogOp
+	}
+
+	switch op.Kind {
+	case CatalogAdd:
+		if op.Tag == "" || op.Song.Title == "" {
+			return errInvalidCatalogOp
+		}
+	case CatalogRemove:
+		if len(op.Tags) == 0 {
+			return errInvalidCatalogOp
+		}
+	case CatalogUpdate:
+		if op.Song.Title == "" {
+			return errInvalidCatalogOp
+		}
+	default:
+		return errInvalidCatalogOp
+	}
+	return nil
+}
+
+// CatalogEntry is the replicated state of one song. The song is in the
+// catalog while any of its adds isn't removed.
+type CatalogEntry struct {
+	CID   cid.Cid `cbor:"1,keyasint"`
+	Song  Song    `cbor:"2,keyasint,omitempty"`
+	Clock Clock   `cbor:"3,keyasint,omitempty"`
+
+	// Adds and Removes are sorted sets of add tags.
+	Adds    []string `cbor:"4,keyasint,omitempty"`
+	Removes []string `cbor:"5,keyasint,omitempty"`
+
+	// Proofs are the signed adds and removes as a sorted set, MetaProof
+	// the signed operation which wrote the metadata. Peers rebuild the
+	// entry from them instead of taking the state on trust.
+	Proofs    [][]byte `json:",omitempty" cbor:"6,keyasint,omitempty"`
+	MetaProof []byte   `json:",omitempty" cbor:"7,keyasint,omitempty"`
+
+	// Edited is set when an update wrote the metadata rather than an add.
+	Edited bool `json:",omitempty" cbor:"8,keyasint,omitempty"`
+}
+
+// Visible reports whether the song is in the catalog.
+func (e CatalogEntry) Visible() bool {
+	return len(e.LiveTags()) > 0
+}
+
+// LiveTags are the adds which aren't removed.
+func (e CatalogEntry) LiveTags() []string {
+	var live []string
+	for _, tag := range e.Adds {
+		if _, removed := slices.BinarySearch(e.Removes, tag); !removed {
+			live = append(live, tag)
+		}
+	}
+	return live
+}
+
+// checkPublisher checks that the update or remove comes from a peer
+// which added the song, nobody else may edit or remove it.
+func (e CatalogEntry) checkPublisher(op CatalogOp) error {
+	if op.Kind == CatalogAdd || e.ownedBy(op.Publisher) {
+		return nil
+	}
+	if len(e.Adds) == 0 {
+		return errCatalogOpUnknown
+	}
+	return errCatalogOpPublisher
+}
+
+// ownedBy reports whether the peer added the song.
+func (e CatalogEntry) ownedBy(p peer.ID) bool {
+	return slices.ContainsFunc(e.Adds, func(tag string) bool {
+		return ownsCatalogTag(p, tag)
+	})
+}
+
+// Apply merges the operation in and reports whether the entry changed.
+func (e *CatalogEntry) Apply(op CatalogOp) bool {
+	return e.Merge(op.delta())
+}
+
+// delta is the state the operation merges in.
+func (op CatalogOp) delta() CatalogEntry {
+	delta := CatalogEntry{CID: op.CID}
+
+	var proofs [][]byte
+	if op.Signed != nil {
+		proofs = [][]byte{op.Signed}
+	}
+
+	switch op.Kind {
+	case CatalogAdd:
+		delta.Adds, delta.Proofs = []string{op.Tag}, proofs
+		delta.Song, delta.Clock, delta.MetaProof = op.Song, op.Clock, op.Signed
+		delta.Song.Publisher = op.Publisher
+	case CatalogRemove:
+		delta.Removes, delta.Proofs = slices.Compact(slices.Sorted(slices.Values(op.Tags))), proofs
+	case CatalogUpdate:
+		delta.Song, delta.Clock, delta.MetaProof = op.Song, op.Clock, op.Signed
+		delta.Song.Publisher = op.Publisher
+		delta.Edited = true
+	}
+	return delta
+}
+
+// Merge joins the other state of the same song in: the union of adds and
+// removes and the metadata which wins, see metadataBeats. It reports
+// whether the entry changed.
+func (e *CatalogEntry) Merge(other CatalogEntry) bool {
+	changed := false
+	if !e.CID.Defined() {
+		e.CID = other.CID
+		changed = true
+	}
+
+	var added, removed, proved bool
+	e.Adds, added = mergeTags(e.Adds, other.Adds)
+	e.Removes, removed = mergeTags(e.Removes, other.Removes)
+	e.Proofs, proved = mergeProofs(e.Proofs, other.Proofs)
+	changed = changed || added || removed || proved
+
+	if other.Song.Title != "" && (e.Song.Title == "" || other.metadataBeats(*e)) {
+		e.Song, e.Clock, e.MetaProof, e.Edited = other.Song, other.Clock, other.MetaProof, other.Edited
+		e.Song.CID = e.CID
+		changed = true
+	}
+	return changed
+}
+
+// metadataBeats reports whether the metadata of the entry wins over the
+// other's. Edits win over adds and the latest edit wins, while the first
+// add wins over later ones: adding a song other peers have, with a later
+// clock, doesn't take its metadata over. Only peers which added the song
+// may edit it.
+func (e CatalogEntry) metadataBeats(other CatalogEntry) bool {
+	if e.Edited != other.Edited {
+		return e.Edited
+	}
+	if e.Edited {
+		return e.Clock.Compare(other.Clock) > 0
+	}
+	return e.Clock.Compare(other.Clock) < 0
+}
+
+// mergeTags returns the sorted union of both tag sets and whether it has
+// tags which weren't in tags.
+func mergeTags(tags, other []string) ([]string, bool) {
+	merged := slices.Compact(slices.Sorted(slices.Values(append(slices.Clone(tags), other...))))
+	return merged, len(merged) != len(tags)
+}
+
+// mergeProofs is mergeTags for proofs.
+func mergeProofs(proofs, other [][]byte) ([][]byte, bool) {
+	merged := append(slices.Clone(proofs), other...)
+	slices.SortFunc(merged, bytes.Compare)
+	merged = slices.CompactFunc(merged, bytes.Equal)
+	return merged, len(merged) != len(proofs)
+}
+
+// hybridClock hands out clocks which follow the wall time but never go
+// back nor behind a clock seen from another peer.
+type hybridClock struct {
+	mu   sync.Mutex
+	last int64
+	peer string
+}
+
+func (hc *hybridClock) Now() Clock {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	hc.last = max(time.Now().UnixNano(), hc.last+1)
+	return Clock{Time: hc.last, Peer: hc.peer}
+}
+
+func (hc *hybridClock) Observe(c Clock) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	hc.last = max(hc.last, c.Time)
+}
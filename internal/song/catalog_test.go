@@ -0,0 +1,140 @@
+package song
+
+import (
+	"math/rand/v2"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// applyShuffled applies the operations in a random order, some of them
+// twice, to a new entry.
+func applyShuffled(r *rand.Rand, ops []CatalogOp) CatalogEntry {
+	delivered := append([]CatalogOp{}, ops...)
+	for _, op := range ops {
+		if r.IntN(2) == 0 {
+			delivered = append(delivered, op)
+		}
+	}
+	r.Shuffle(len(delivered), func(i, j int) {
+		delivered[i], delivered[j] = delivered[j], delivered[i]
+	})
+
+	var entry CatalogEntry
+	for _, op := range delivered {
+		entry.Apply(op)
+	}
+	return entry
+}
+
+func TestCatalogEntryConvergence(t *testing.T) {
+	songCID := testSearchCID(t, "teardrop")
+	original := Song{Title: "Teardrop", Artist: "Massive Attack", CID: songCID}
+	edited := Song{Title: "Teardrop", Artist: "Massive Attack", Album: "Mezzanine", Year: 1998, CID: songCID}
+	concurrentEdit := Song{Title: "Teardrop (Remastered)", Artist: "Massive Attack", CID: songCID}
+
+	add := func(tag string, song Song, clock Clock) CatalogOp {
+		return CatalogOp{Kind: CatalogAdd, CID: songCID, Tag: tag, Song: song, Clock: clock}
+	}
+	remove := func(tags ...string) CatalogOp {
+		return CatalogOp{Kind: CatalogRemove, CID: songCID, Tags: tags}
+	}
+	update := func(song Song, clock Clock) CatalogOp {
+		return CatalogOp{Kind: CatalogUpdate, CID: songCID, Song: song, Clock: clock}
+	}
+
+	testCases := []struct {
+		name        string
+		ops         []CatalogOp
+		wantVisible bool
+		wantSong    Song
+	}{
+		{
+			name:        "1. CatalogEntry: removing the observed add removes the song",
+			ops:         []CatalogOp{add("a", original, Clock{Time: 1, Peer: "a"}), remove("a")},
+			wantVisible: false,
+			wantSong:    original,
+		},
+		{
+			name: "2. CatalogEntry: concurrent add wins over remove",
+			ops: []CatalogOp{
+				add("a", original, Clock{Time: 1, Peer: "a"}),
+				remove("a"),
+				add("b", original, Clock{Time: 2, Peer: "b"}),
+			},
+			wantVisible: true,
+			wantSong:    original,
+		},
+		{
+			name: "3. CatalogEntry: latest edit wins",
+			ops: []CatalogOp{
+				add("a", original, Clock{Time: 1, Peer: "a"}),
+				update(edited, Clock{Time: 3, Peer: "b"}),
+				update(concurrentEdit, Clock{Time: 2, Peer: "c"}),
+			},
+			wantVisible: true,
+			wantSong:    edited,
+		},
+		{
+			name: "4. CatalogEntry: clock ties are broken by peer",
+			ops: []CatalogOp{
+				add("a", original, Clock{Time: 1, Peer: "a"}),
+				update(edited, Clock{Time: 2, Peer: "b"}),
+				update(concurrentEdit, Clock{Time: 2, Peer: "c"}),
+			},
+			wantVisible: true,
+			wantSong:    concurrentEdit,
+		},
+		{
+			name: "5. CatalogEntry: edit of a removed song keeps it removed",
+			ops: []CatalogOp{
+				add("a", original, Clock{Time: 1, Peer: "a"}),
+				remove("a"),
+				update(edited, Clock{Time: 2, Peer: "b"}),
+			},
+			wantVisible: false,
+			wantSong:    edited,
+		},
+		{
+			name: "6. CatalogEntry: a later add doesn't take the metadata over",
+			ops: []CatalogOp{
+				add("a", original, Clock{Time: 1, Peer: "a"}),
+				add("b", concurrentEdit, Clock{Time: 2, Peer: "b"}),
+			},
+			wantVisible: true,
+			wantSong:    original,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := rand.New(rand.NewPCG(1, 2))
+
+			want := applyShuffled(r, tc.ops)
+			require.Equal(t, tc.wantVisible, want.Visible())
+			require.Equal(t, tc.wantSong, want.Song)
+
+			for range 50 {
+				require.Equal(t, want, applyShuffled(r, tc.ops))
+			}
+		})
+	}
+}
+
+func TestCatalogEntryMerge(t *testing.T) {
+	songCID := testSearchCID(t, "angel")
+	song := Song{Title: "Angel", CID: songCID}
+
+	var left, right CatalogEntry
+	left.Apply(CatalogOp{Kind: CatalogAdd, CID: songCID, Tag: "a", Song: song, Clock: Clock{Time: 1, Peer: "a"}})
+	right.Apply(CatalogOp{Kind: CatalogAdd, CID: songCID, Tag: "b", Song: song, Clock: Clock{Time: 1, Peer: "b"}})
+	right.Apply(CatalogOp{Kind: CatalogRemove, CID: songCID, Tags: []string{"b"}})
+
+	leftMerged, rightMerged := left, right
+	require.True(t, leftMerged.Merge(right))
+	require.True(t, rightMerged.Merge(left))
+	require.Equal(t, leftMerged, rightMerged)
+	require.Equal(t, []string{"a"}, leftMerged.LiveTags())
+
+	require.False(t, leftMerged.Merge(right), "merge is idempotent")
+}
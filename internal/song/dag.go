@@ -0,0 +1,485 @@
+package song
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	chunker "github.com/ipfs/boxo/chunker"
+	"github.com/ipfs/boxo/ipld/merkledag"
+	"github.com/ipfs/boxo/ipld/unixfs"
+	"github.com/ipfs/boxo/ipld/unixfs/importer/balanced"
+	"github.com/ipfs/boxo/ipld/unixfs/importer/helpers"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multihash"
+)
+
+const (
+	songDAGProtocol = "/song/dag/1.0.0"
+
+	// songChunkSize is the size of the DAG leaves, which are also the
+	// units of swarm downloads.
+	songChunkSize = 256 * 1024
+
+	maxSongDAGNodeSize = 1 << 20
+	maxSongDAGNodes    = 4096
+	maxSongDAGDepth    = 16
+)
+
+var (
+	errIncompleteSongDAG  = errors.New("song DAG is incomplete")
+	errUnsupportedSongDAG = errors.New("unsupported song DAG layout")
+	errSongDAGSize        = errors.New("song DAG size doesn't match the song")
+)
+
+// songCIDBuilder matches `ipfs add --cid-version=1 --raw-leaves`.
+var songCIDBuilder = cid.V1Builder{Codec: cid.DagProtobuf, MhType: multihash.SHA2_256}
+
+// SongBlock is a raw leaf of the song DAG.
+type SongBlock struct {
+	CID    cid.Cid
+	Offset int64
+	Size   int64
+}
+
+// SongDAG is the UnixFS balanced layout of a song file: raw leaves of
+// songChunkSize under dag-pb nodes. Only the intermediate nodes are kept
+// in memory, leaves are described by their CIDs and file ranges.
+type SongDAG struct {
+	Root   cid.Cid
+	Blocks []SongBlock
+
+	nodes map[cid.Cid][]byte
+	order []cid.Cid
+}
+
+// hasSongDAG tells whether the CID is the root of a chunked DAG. Raw CIDs
+// are single block songs or legacy whole file hashes, both of which can
+// only be verified once the whole file is there.
+func hasSongDAG(c cid.Cid) bool {
+	return c.Type() == cid.DagProtobuf
+}
+
+// BuildSongDAG chunks the content into a UnixFS DAG.
+func BuildSongDAG(r io.Reader) (*SongDAG, error) {
+	dag := &SongDAG{nodes: make(map[cid.Cid][]byte)}
+	counter := &countingReader{r: r}
+
+	params := helpers.DagBuilderParams{
+		Maxlinks:   helpers.DefaultLinksPerBlock,
+		RawLeaves:  true,
+		CidBuilder: songCIDBuilder,
+		Dagserv:    (*songDAGService)(dag),
+	}
+	builder, err := params.New(chunker.NewSizeSplitter(counter, songChunkSize))
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := balanced.Layout(builder)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build song DAG: %w", err)
+	}
+	dag.Root = root.Cid()
+
+	if err := dag.collectBlocks(dag.Root, 0, counter.n, 0); err != nil {
+		return nil, err
+	}
+
+	return dag, nil
+}
+
+// Size is the song file size.
+func (d *SongDAG) Size() int64 {
+	if len(d.Blocks) == 0 {
+		return 0
+	}
+	last := d.Blocks[len(d.Blocks)-1]
+	return last.Offset + last.Size
+}
+
+// collectBlocks walks the DAG from c, which covers size bytes of the file
+// starting at offset, and appends its leaves to Blocks.
+func (d *SongDAG) collectBlocks(c cid.Cid, offset, size int64, depth int) error {
+	if depth > maxSongDAGDepth {
+		return errUnsupportedSongDAG
+	}
+
+	if c.Type() == cid.Raw {
+		// leaf sizes come from the publisher, blocks are read whole
+		if size < 0 || size > songChunkSize {
+			return errUnsupportedSongDAG
+		}
+		d.Blocks = append(d.Blocks, SongBlock{CID: c, Offset: offset, Size: size})
+		return nil
+	}
+
+	data, ok := d.nodes[c]
+	if !ok {
+		return errIncompleteSongDAG
+	}
+
+	node, err := merkledag.DecodeProtobuf(data)
+	if err != nil {
+		return err
+	}
+	fsNode, err := unixfs.FSNodeFromBytes(node.Data())
+	if err != nil {
+		return err
+	}
+
+	links := node.Links()
+	sizes := fsNode.BlockSizes()
+	if len(fsNode.Data()) > 0 || len(links) != len(sizes) {
+		return errUnsupportedSongDAG
+	}
+
+	for i, link := range links {
+		if err := d.collectBlocks(link.Cid, offset, int64(sizes[i]), depth+1); err != nil {
+			return err
+		}
+		offset += int64(sizes[i])
+	}
+
+	return nil
+}
+
+// verifyBlock checks leaf content against the leaf CID.
+func verifyBlock(block SongBlock, data []byte) error {
+	received, err := block.CID.Prefix().Sum(data)
+	if err != nil {
+		return err
+	}
+
+	if !received.Equals(block.CID) {
+		return IntegrityError{
+			Expected: block.CID,
+			Received: received,
+		}
+	}
+	return nil
+}
+
+// verifiedPrefix returns how many leading bytes of the file match the DAG,
+// always on a block boundary.
+func (d *SongDAG) verifiedPrefix(f io.ReaderAt) int64 {
+	for _, block := range d.Blocks {
+		data := make([]byte, block.Size)
+		if _, err := f.ReadAt(data, block.Offset); err != nil {
+			return block.Offset
+		}
+		if verifyBlock(block, data) != nil {
+			return block.Offset
+		}
+	}
+	return d.Size()
+}
+
+// copyVerified copies blocks starting at offset from r to w, checking
+// each of them before it is written, so w only ever holds verified data.
+func (d *SongDAG) copyVerified(w io.Writer, r io.Reader, offset int64) error {
+	for _, block := range d.Blocks {
+		if block.Offset < offset {
+			continue
+		}
+
+		data := make([]byte, block.Size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return err
+		}
+		if err := verifyBlock(block, data); err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeNodes writes the intermediate nodes as uvarint length prefixed
+// blocks.
+func (d *SongDAG) writeNodes(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, c := range d.order {
+		data := d.nodes[c]
+		if _, err := bw.Write(binary.AppendUvarint(nil, uint64(len(data)))); err != nil {
+			return err
+		}
+		if _, err := bw.Write(data); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// readSongDAG reads intermediate nodes written by writeNodes and rebuilds
+// the DAG under root, which has to cover size bytes. Every node is
+// addressed by the hash of its content, so a node which was tampered with
+// is simply missing from the DAG.
+func readSongDAG(r io.Reader, root cid.Cid, size int64) (*SongDAG, error) {
+	dag := &SongDAG{
+		Root:  root,
+		nodes: make(map[cid.Cid][]byte),
+	}
+
+	reader := bufio.NewReader(r)
+	for {
+		size, err := binary.ReadUvarint(reader)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if size > maxSongDAGNodeSize || len(dag.nodes) >= maxSongDAGNodes {
+			return nil, errUnsupportedSongDAG
+		}
+
+		data := make([]byte, size)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+
+		c, err := root.Prefix().Sum(data)
+		if err != nil {
+			return nil, err
+		}
+		dag.nodes[c] = data
+		dag.order = append(dag.order, c)
+	}
+
+	if err := dag.collectBlocks(root, 0, 0, 0); err != nil {
+		return nil, err
+	}
+	if dag.Size() != size {
+		return nil, fmt.Errorf("%w: %d bytes, expected %d", errSongDAGSize, dag.Size(), size)
+	}
+
+	return dag, nil
+}
+
+// songDAGService keeps the intermediate nodes built by the importer and
+// drops leaf data, which is still on disk.
+type songDAGService SongDAG
+
+func (s *songDAGService) Get(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	data, ok := s.nodes[c]
+	if !ok {
+		return nil, ipld.ErrNotFound{Cid: c}
+	}
+	return merkledag.DecodeProtobuf(data)
+}
+
+func (s *songDAGService) GetMany(ctx context.Context, cids []cid.Cid) <-chan *ipld.NodeOption {
+	out := make(chan *ipld.NodeOption, len(cids))
+	for _, c := range cids {
+		node, err := s.Get(ctx, c)
+		out <- &ipld.NodeOption{Node: node, Err: err}
+	}
+	close(out)
+	return out
+}
+
+func (s *songDAGService) Add(ctx context.Context, node ipld.Node) error {
+	if node.Cid().Type() == cid.Raw {
+		return nil
+	}
+	if _, ok := s.nodes[node.Cid()]; !ok {
+		s.order = append(s.order, node.Cid())
+	}
+	s.nodes[node.Cid()] = bytes.Clone(node.RawData())
+	return nil
+}
+
+func (s *songDAGService) AddMany(ctx context.Context, nodes []ipld.Node) error {
+	for _, node := range nodes {
+		if err := s.Add(ctx, node); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *songDAGService) Remove(ctx context.Context, c cid.Cid) error {
+	delete(s.nodes, c)
+	return nil
+}
+
+func (s *songDAGService) RemoveMany(ctx context.Context, cids []cid.Cid) error {
+	for _, c := range cids {
+		delete(s.nodes, c)
+	}
+	return nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// songDAGCache keeps DAGs of local songs so they are not rebuilt on every
+// request.
+type songDAGCache struct {
+	mu   sync.Mutex
+	dags map[cid.Cid]*SongDAG
+}
+
+func (dm *SongManager) registerSongDAGProtocol(ctx context.Context) {
+	dm.h.SetStreamHandler(songDAGProtocol, func(s network.Stream) {
+		defer s.Close()
+		if err := dm.sendSongDAG(ctx, s); err != nil {
+			dm.logger.Error("Failed to send song DAG", "err", err)
+			s.Reset()
+		}
+	})
+}
+
+func (dm *SongManager) sendSongDAG(ctx context.Context, s network.Stream) error {
+	_, songCID, err := cid.CidFromReader(bufio.NewReader(s))
+	if err != nil {
+		return err
+	}
+
+	dag, err := dm.localSongDAG(ctx, songCID)
+	if err != nil {
+		return err
+	}
+
+	return dag.writeNodes(s)
+}
+
+// localSongDAG returns the DAG of a song we have a file for.
+func (dm *SongManager) localSongDAG(ctx context.Context, songCID cid.Cid) (*SongDAG, error) {
+	dm.dagCache.mu.Lock()
+	dag, ok := dm.dagCache.dags[songCID]
+	dm.dagCache.mu.Unlock()
+	if ok {
+		return dag, nil
+	}
+
+	songPath, err := dm.filePathsStore.FindFilePath(ctx, songCID)
+	if err != nil {
+		return nil, err
+	}
+	if songPath == "" {
+		return nil, errSongFileNotFound
+	}
+
+	file, err := os.Open(songPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	dag, err = BuildSongDAG(file)
+	if err != nil {
+		return nil, err
+	}
+	if !dag.Root.Equals(songCID) {
+		// legacy CID pointing at the file, it has no DAG
+		return nil, errIncompleteSongDAG
+	}
+
+	dm.dagCache.mu.Lock()
+	dm.dagCache.dags[songCID] = dag
+	dm.dagCache.mu.Unlock()
+
+	return dag, nil
+}
+
+// FetchSongDAG fetches the intermediate nodes of the song DAG from the
+// peer and verifies them against the song CID.
+func (dm *SongManager) FetchSongDAG(ctx context.Context, song Song, targetPeerID peer.ID) (*SongDAG, error) {
+	if !hasSongDAG(song.CID) {
+		return nil, errUnsupportedSongDAG
+	}
+
+	s, err := dm.h.NewStream(ctx, targetPeerID, songDAGProtocol)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	if _, err := s.Write(song.CID.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := s.CloseWrite(); err != nil {
+		return nil, err
+	}
+
+	return readSongDAG(s, song.CID, song.FileSize)
+}
+
+// MigrateLegacySongs re-hashes local songs which are still identified by
+// a whole file SHA-256 CID into DAG CIDs, moves their catalog entries to
+// the new CIDs and provides them. The legacy CID keeps pointing at the
+// file, so peers with old catalog entries can still download it.
+func (dm *SongManager) MigrateLegacySongs(ctx context.Context) error {
+	paths, err := dm.filePathsStore.ListFilePaths(ctx)
+	if err != nil {
+		return err
+	}
+
+	migrated := make(map[string]bool)
+	for songCID, songPath := range paths {
+		if hasSongDAG(songCID) {
+			migrated[songPath] = true
+		}
+	}
+
+	for legacyCID, songPath := range paths {
+		if hasSongDAG(legacyCID) || migrated[songPath] {
+			continue
+		}
+
+		song, err := NewSong(songPath)
+		if err != nil {
+			dm.logger.Warn("Failed to re-hash legacy song", "path", songPath, "err", err)
+			continue
+		}
+		if song.CID.Equals(legacyCID) {
+			// single chunk songs keep their CID
+			continue
+		}
+
+		if err := dm.filePathsStore.SaveFilePath(ctx, song.CID, songPath); err != nil {
+			return err
+		}
+
+		if entry, err := dm.songTableStore.FindSongByCID(ctx, legacyCID); err == nil {
+			entry.CID = song.CID
+			entry.FileSize = song.FileSize
+			if err := dm.songTableSync.AdvertiseSong(entry); err != nil {
+				return err
+			}
+			// songs other peers added stay theirs to remove
+			if err := dm.songTableSync.RemoveSong(legacyCID); err != nil && !errors.Is(err, errSongNotInCatalog) {
+				return err
+			}
+		}
+
+		if err := dm.dht.Provide(ctx, song.CID, true); err != nil {
+			dm.logger.Error("Failed to provide song", "err", err)
+		}
+
+		migrated[songPath] = true
+		dm.logger.Info("Migrated legacy song CID", "path", songPath, "legacy CID", legacyCID, "CID", song.CID)
+	}
+
+	return nil
+}
@@ -0,0 +1,196 @@
+package song
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"log/slog"
+	"os"
+	"p2p-music/config"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/boxo/ipld/merkledag"
+	"github.com/ipfs/boxo/ipld/unixfs"
+	unixfs_pb "github.com/ipfs/boxo/ipld/unixfs/pb"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func randomContent(t *testing.T, size int) []byte {
+	t.Helper()
+
+	content := make([]byte, size)
+	_, err := rand.Read(content)
+	require.NoError(t, err)
+	return content
+}
+
+func TestBuildSongDAG(t *testing.T) {
+	testCases := []struct {
+		name       string
+		size       int
+		wantBlocks int
+		wantType   uint64
+	}{
+		{
+			name:       "1. BuildSongDAG: single chunk keeps a raw CID",
+			size:       songChunkSize - 1,
+			wantBlocks: 1,
+			wantType:   cid.Raw,
+		},
+		{
+			name:       "2. BuildSongDAG: several chunks",
+			size:       3*songChunkSize + 17,
+			wantBlocks: 4,
+			wantType:   cid.DagProtobuf,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			content := randomContent(t, tc.size)
+
+			dag, err := BuildSongDAG(bytes.NewReader(content))
+			require.NoError(t, err)
+			require.Equal(t, tc.wantType, dag.Root.Type())
+			require.Len(t, dag.Blocks, tc.wantBlocks)
+			require.Equal(t, int64(tc.size), dag.Size())
+
+			var offset int64
+			for _, block := range dag.Blocks {
+				require.Equal(t, offset, block.Offset)
+				require.NoError(t, verifyBlock(block, content[block.Offset:block.Offset+block.Size]))
+				offset += block.Size
+			}
+
+			if tc.wantType == cid.Raw {
+				legacyCID, err := generateRawSongCID(bytes.NewReader(content))
+				require.NoError(t, err)
+				require.Equal(t, legacyCID, dag.Root)
+			}
+		})
+	}
+}
+
+func TestReadSongDAG(t *testing.T) {
+	content := randomContent(t, 5*songChunkSize)
+
+	dag, err := BuildSongDAG(bytes.NewReader(content))
+	require.NoError(t, err)
+
+	var nodes bytes.Buffer
+	require.NoError(t, dag.writeNodes(&nodes))
+
+	// a node claiming a leaf far bigger than a chunk
+	hugeLeaf := unixfs.NewFSNode(unixfs_pb.Data_File)
+	hugeLeaf.AddBlockSize(1 << 40)
+	hugeLeafData, err := hugeLeaf.GetBytes()
+	require.NoError(t, err)
+	hugeNode := merkledag.NodeWithData(hugeLeafData)
+	require.NoError(t, hugeNode.SetCidBuilder(songCIDBuilder))
+	require.NoError(t, hugeNode.AddRawLink("", &ipld.Link{Cid: dag.Blocks[0].CID}))
+	var hugeNodes bytes.Buffer
+	hugeDAG := &SongDAG{nodes: map[cid.Cid][]byte{hugeNode.Cid(): hugeNode.RawData()}, order: []cid.Cid{hugeNode.Cid()}}
+	require.NoError(t, hugeDAG.writeNodes(&hugeNodes))
+
+	testCases := []struct {
+		name    string
+		nodes   []byte
+		root    cid.Cid
+		size    int64
+		wantErr error
+	}{
+		{
+			name:  "1. readSongDAG: success",
+			nodes: nodes.Bytes(),
+		},
+		{
+			name: "2. readSongDAG: failure: tampered node",
+			nodes: func() []byte {
+				tampered := bytes.Clone(nodes.Bytes())
+				tampered[len(tampered)-1] ^= 0xFF
+				return tampered
+			}(),
+			wantErr: errIncompleteSongDAG,
+		},
+		{
+			name:    "3. readSongDAG: failure: no nodes",
+			wantErr: errIncompleteSongDAG,
+		},
+		{
+			name:    "4. readSongDAG: failure: size doesn't match the song",
+			nodes:   nodes.Bytes(),
+			size:    int64(len(content)) - 1,
+			wantErr: errSongDAGSize,
+		},
+		{
+			name:    "5. readSongDAG: failure: leaf bigger than a chunk",
+			nodes:   hugeNodes.Bytes(),
+			root:    hugeNode.Cid(),
+			size:    1 << 40,
+			wantErr: errUnsupportedSongDAG,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			root, size := tc.root, tc.size
+			if !root.Defined() {
+				root = dag.Root
+			}
+			if size == 0 {
+				size = int64(len(content))
+			}
+
+			received, err := readSongDAG(bytes.NewReader(tc.nodes), root, size)
+			if tc.wantErr != nil {
+				require.ErrorIs(t, err, tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, dag.Blocks, received.Blocks)
+		})
+	}
+}
+
+func TestReceiveSongStreamDAG(t *testing.T) {
+	ctx := context.Background()
+
+	content := randomContent(t, 3*songChunkSize+100)
+	songPath := filepath.Join(t.TempDir(), "song.mp3")
+	require.NoError(t, os.WriteFile(songPath, content, 0644))
+
+	file, err := os.Open(songPath)
+	require.NoError(t, err)
+	songCID, err := GenerateSongCID(file)
+	file.Close()
+	require.NoError(t, err)
+	require.True(t, hasSongDAG(songCID))
+
+	song := Song{Title: "song", Format: FormatMP3, FileSize: int64(len(content)), CID: songCID}
+
+	mn, err := mocknet.FullMeshConnected(2)
+	require.NoError(t, err)
+	defer mn.Close()
+	hosts := mn.Hosts()
+
+	provider := NewSongManager(hosts[0], nil, nil, nil, &memFilePathsStore{paths: map[cid.Cid]string{songCID: songPath}}, &config.Config{}, slog.Default())
+	provider.RegisterSongStreamingProtocols(ctx)
+
+	receiver := NewSongManager(hosts[1], nil, nil, nil, &memFilePathsStore{paths: make(map[cid.Cid]string)}, &config.Config{MusicPath: t.TempDir()}, slog.Default())
+
+	// first block is good, the second one is garbage
+	part := append(bytes.Clone(content[:songChunkSize]), make([]byte, songChunkSize/2)...)
+	partPath := filepath.Join(receiver.config.MusicPath, songCID.String()+".part")
+	require.NoError(t, os.WriteFile(partPath, part, 0644))
+
+	receivedPath, err := receiver.ReceiveSongStream(ctx, song, hosts[0].ID())
+	require.NoError(t, err)
+
+	received, err := os.ReadFile(receivedPath)
+	require.NoError(t, err)
+	require.Equal(t, content, received)
+}
@@ -1,5 +1,18 @@
 package song
 
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+)
+
+var (
+	errSongFileNotFound = errors.New("song file not found")
+	errInvalidSongRange = errors.New("invalid song range")
+	errSongNotInCatalog = errors.New("song not in catalog")
+)
+
 type PromoteSongError struct {
 	errMsg string
 }
@@ -7,3 +20,14 @@ type PromoteSongError struct {
 func (e PromoteSongError) Error() string {
 	return e.errMsg
 }
+
+// IntegrityError is returned when received song content doesn't hash to
+// the requested song CID.
+type IntegrityError struct {
+	Expected cid.Cid
+	Received cid.Cid
+}
+
+func (e IntegrityError) Error() string {
+	return fmt.Sprintf("song content integrity check failed: expected %s, received %s", e.Expected, e.Received)
+}
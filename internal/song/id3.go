@@ -0,0 +1,468 @@
+package song
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strconv"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	id3v2HeaderSize = 10
+	id3v1TagSize    = 128
+
+	// mp3SyncWindow bounds how far past the ID3v2 tag we look for the
+	// first MPEG frame.
+	mp3SyncWindow = 64 * 1024
+)
+
+func readMP3Metadata(r io.ReaderAt, size int64) metadata {
+	meta, tagSize := readID3v2(r, size)
+
+	hasID3v1 := false
+	if v1, ok := readID3v1(r, size); ok {
+		hasID3v1 = true
+		meta.merge(v1)
+	}
+
+	audioEnd := size
+	if hasID3v1 {
+		audioEnd -= id3v1TagSize
+	}
+
+	bitrate, duration := readMP3StreamInfo(r, tagSize, audioEnd)
+	if duration > 0 {
+		meta.Duration = duration
+	}
+	meta.Bitrate = bitrate
+
+	return meta
+}
+
+// readID3v2 parses an ID3v2.2/2.3/2.4 tag at the start of the file and
+// returns the tag size so the caller knows where audio frames begin.
+func readID3v2(r io.ReaderAt, size int64) (metadata, int64) {
+	header := make([]byte, id3v2HeaderSize)
+	if _, err := r.ReadAt(header, 0); err != nil || !bytes.HasPrefix(header, []byte("ID3")) {
+		return metadata{}, 0
+	}
+
+	version := header[3]
+	flags := header[5]
+	bodySize := int64(synchsafe(header[6:10]))
+	tagSize := id3v2HeaderSize + bodySize
+	if flags&0x10 != 0 {
+		tagSize += id3v2HeaderSize // footer
+	}
+	if version < 2 || version > 4 || id3v2HeaderSize+bodySize > size {
+		return metadata{}, 0
+	}
+
+	body := make([]byte, bodySize)
+	if _, err := r.ReadAt(body, id3v2HeaderSize); err != nil {
+		return metadata{}, tagSize
+	}
+
+	if flags&0x80 != 0 && version < 4 {
+		body = removeUnsync(body)
+	}
+
+	if flags&0x40 != 0 && version > 2 && len(body) >= 4 {
+		extSize := int(binary.BigEndian.Uint32(body[:4]))
+		if version == 4 {
+			extSize = int(synchsafe(body[:4]))
+		} else {
+			extSize += 4
+		}
+		if extSize > len(body) {
+			return metadata{}, tagSize
+		}
+		body = body[extSize:]
+	}
+
+	frames := parseID3v2Frames(body, version)
+
+	var meta metadata
+	meta.Title = frames["TIT2"]
+	meta.Artist = frames["TPE1"]
+	if meta.Artist == "" {
+		meta.Artist = frames["TPE2"]
+	}
+	meta.Album = frames["TALB"]
+	meta.Year = parseYear(frames["TDRC"])
+	if meta.Year == 0 {
+		meta.Year = parseYear(frames["TYER"])
+	}
+	if ms, err := strconv.Atoi(frames["TLEN"]); err == nil && ms > 0 {
+		meta.Duration = time.Duration(ms) * time.Millisecond
+	}
+
+	return meta, tagSize
+}
+
+// v2.2 uses three letter frame ids, map them to their v2.3 names.
+var id3v22Frames = map[string]string{
+	"TT2": "TIT2",
+	"TP1": "TPE1",
+	"TP2": "TPE2",
+	"TAL": "TALB",
+	"TYE": "TYER",
+	"TLE": "TLEN",
+}
+
+// parseID3v2Frames collects text frames of the tag body keyed by their
+// v2.3/v2.4 frame id.
+func parseID3v2Frames(body []byte, version byte) map[string]string {
+	frames := make(map[string]string)
+
+	idLen, headerLen := 4, 10
+	if version == 2 {
+		idLen, headerLen = 3, 6
+	}
+
+	for len(body) >= headerLen {
+		id := string(body[:idLen])
+		if body[0] == 0 {
+			break // padding
+		}
+
+		var frameSize int
+		var formatFlags byte
+		switch version {
+		case 2:
+			frameSize = int(body[3])<<16 | int(body[4])<<8 | int(body[5])
+		case 3:
+			frameSize = int(binary.BigEndian.Uint32(body[4:8]))
+			formatFlags = body[9]
+		case 4:
+			frameSize = int(synchsafe(body[4:8]))
+			formatFlags = body[9]
+		}
+
+		if frameSize <= 0 || headerLen+frameSize > len(body) {
+			break
+		}
+		data := body[headerLen : headerLen+frameSize]
+		body = body[headerLen+frameSize:]
+
+		if version == 2 {
+			if mapped, ok := id3v22Frames[id]; ok {
+				id = mapped
+			}
+		}
+		if id[0] != 'T' || id == "TXXX" {
+			continue
+		}
+
+		if !validID3v2FrameData(&data, version, formatFlags) {
+			continue
+		}
+
+		if _, ok := frames[id]; !ok {
+			frames[id] = decodeID3v2Text(data)
+		}
+	}
+
+	return frames
+}
+
+// validID3v2FrameData strips per-frame encodings we understand and
+// reports whether the frame is readable at all.
+func validID3v2FrameData(data *[]byte, version byte, formatFlags byte) bool {
+	switch version {
+	case 3:
+		// compression or encryption
+		if formatFlags&0xC0 != 0 {
+			return false
+		}
+	case 4:
+		if formatFlags&0x0C != 0 {
+			return false
+		}
+		if formatFlags&0x01 != 0 {
+			if len(*data) < 4 {
+				return false
+			}
+			*data = (*data)[4:]
+		}
+		if formatFlags&0x02 != 0 {
+			*data = removeUnsync(*data)
+		}
+	}
+	return len(*data) > 0
+}
+
+func decodeID3v2Text(data []byte) string {
+	encoding, text := data[0], data[1:]
+
+	var value string
+	switch encoding {
+	case 0:
+		value = latin1ToUTF8(firstTerminated(text, 1))
+	case 1, 2:
+		value = decodeUTF16(firstTerminated(text, 2), encoding == 2)
+	case 3:
+		value = string(firstTerminated(text, 1))
+	default:
+		return ""
+	}
+
+	return cleanTagValue(value)
+}
+
+// firstTerminated returns the first null terminated value; v2.4 frames
+// may carry several of them.
+func firstTerminated(text []byte, width int) []byte {
+	for i := 0; i+width <= len(text); i += width {
+		if width == 1 && text[i] == 0 {
+			return text[:i]
+		}
+		if width == 2 && text[i] == 0 && text[i+1] == 0 {
+			return text[:i]
+		}
+	}
+	return text
+}
+
+func decodeUTF16(b []byte, bigEndian bool) string {
+	if len(b) >= 2 {
+		switch {
+		case b[0] == 0xFF && b[1] == 0xFE:
+			bigEndian, b = false, b[2:]
+		case b[0] == 0xFE && b[1] == 0xFF:
+			bigEndian, b = true, b[2:]
+		}
+	}
+
+	units := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		if bigEndian {
+			units = append(units, binary.BigEndian.Uint16(b[i:]))
+		} else {
+			units = append(units, binary.LittleEndian.Uint16(b[i:]))
+		}
+	}
+
+	return string(utf16.Decode(units))
+}
+
+func synchsafe(b []byte) uint32 {
+	return uint32(b[0]&0x7F)<<21 | uint32(b[1]&0x7F)<<14 | uint32(b[2]&0x7F)<<7 | uint32(b[3]&0x7F)
+}
+
+func removeUnsync(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	for i := 0; i < len(b); i++ {
+		out = append(out, b[i])
+		if b[i] == 0xFF && i+1 < len(b) && b[i+1] == 0x00 {
+			i++
+		}
+	}
+	return out
+}
+
+func readID3v1(r io.ReaderAt, size int64) (metadata, bool) {
+	if size < id3v1TagSize {
+		return metadata{}, false
+	}
+
+	tag := make([]byte, id3v1TagSize)
+	if _, err := r.ReadAt(tag, size-id3v1TagSize); err != nil || !bytes.HasPrefix(tag, []byte("TAG")) {
+		return metadata{}, false
+	}
+
+	return metadata{
+		Title:  cleanTagValue(latin1ToUTF8(tag[3:33])),
+		Artist: cleanTagValue(latin1ToUTF8(tag[33:63])),
+		Album:  cleanTagValue(latin1ToUTF8(tag[63:93])),
+		Year:   parseYear(string(tag[93:97])),
+	}, true
+}
+
+var mp3Bitrates = map[[2]int][16]int{
+	// {MPEG version (1 or 2), layer}: kbps by bitrate index
+	{1, 1}: {0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448, 0},
+	{1, 2}: {0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384, 0},
+	{1, 3}: {0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0},
+	{2, 1}: {0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256, 0},
+	{2, 2}: {0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+	{2, 3}: {0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+}
+
+var mp3SampleRates = map[int][3]int{
+	1:  {44100, 48000, 32000},
+	2:  {22050, 24000, 16000},
+	25: {11025, 12000, 8000},
+}
+
+type mp3FrameHeader struct {
+	version    int // 1, 2 or 25 for MPEG 2.5
+	layer      int
+	bitrate    int // kbps
+	sampleRate int
+	padding    int
+	mono       bool
+}
+
+func parseMP3FrameHeader(b []byte) (mp3FrameHeader, bool) {
+	if len(b) < 4 || b[0] != 0xFF || b[1]&0xE0 != 0xE0 {
+		return mp3FrameHeader{}, false
+	}
+
+	var h mp3FrameHeader
+	switch (b[1] >> 3) & 0x03 {
+	case 0:
+		h.version = 25
+	case 2:
+		h.version = 2
+	case 3:
+		h.version = 1
+	default:
+		return mp3FrameHeader{}, false
+	}
+
+	h.layer = 4 - int((b[1]>>1)&0x03)
+	if h.layer == 4 {
+		return mp3FrameHeader{}, false
+	}
+
+	bitrateIndex := int(b[2] >> 4)
+	sampleRateIndex := int((b[2] >> 2) & 0x03)
+	if bitrateIndex == 0 || bitrateIndex == 15 || sampleRateIndex == 3 {
+		return mp3FrameHeader{}, false
+	}
+
+	tableVersion := h.version
+	if tableVersion == 25 {
+		tableVersion = 2
+	}
+	h.bitrate = mp3Bitrates[[2]int{tableVersion, h.layer}][bitrateIndex]
+	h.sampleRate = mp3SampleRates[h.version][sampleRateIndex]
+	h.padding = int((b[2] >> 1) & 0x01)
+	h.mono = b[3]>>6 == 3
+
+	return h, true
+}
+
+func (h mp3FrameHeader) samplesPerFrame() int {
+	switch {
+	case h.layer == 1:
+		return 384
+	case h.layer == 3 && h.version != 1:
+		return 576
+	}
+	return 1152
+}
+
+func (h mp3FrameHeader) frameLength() int {
+	if h.layer == 1 {
+		return (12*h.bitrate*1000/h.sampleRate + h.padding) * 4
+	}
+	return h.samplesPerFrame()/8*h.bitrate*1000/h.sampleRate + h.padding
+}
+
+// sideInfoSize is the size of the layer III side information which
+// precedes a Xing/Info header in the first frame.
+func (h mp3FrameHeader) sideInfoSize() int {
+	switch {
+	case h.version == 1 && h.mono:
+		return 17
+	case h.version == 1:
+		return 32
+	case h.mono:
+		return 9
+	}
+	return 17
+}
+
+// readMP3StreamInfo finds the first MPEG frame after start and computes
+// the bitrate in kbps and the duration, using a Xing/Info or VBRI header
+// for VBR files and the file size for CBR files.
+func readMP3StreamInfo(r io.ReaderAt, start, end int64) (int, time.Duration) {
+	window := make([]byte, mp3SyncWindow)
+	n, err := r.ReadAt(window, start)
+	if err != nil && err != io.EOF {
+		return 0, 0
+	}
+	window = window[:n]
+
+	for i := 0; i+4 <= len(window); i++ {
+		header, ok := parseMP3FrameHeader(window[i:])
+		if !ok {
+			continue
+		}
+
+		// require the next frame to line up to avoid false syncs
+		next := i + header.frameLength()
+		if next+4 <= len(window) {
+			if _, ok := parseMP3FrameHeader(window[next:]); !ok {
+				continue
+			}
+		}
+
+		frame := window[i:min(len(window), next)]
+		frameStart := start + int64(i)
+		return mp3Duration(header, frame, end-frameStart)
+	}
+
+	return 0, 0
+}
+
+func mp3Duration(header mp3FrameHeader, frame []byte, audioSize int64) (int, time.Duration) {
+	frames, bytesCount := vbrFrameCount(header, frame)
+	if frames > 0 {
+		samples := int64(frames) * int64(header.samplesPerFrame())
+		duration := time.Duration(samples) * time.Second / time.Duration(header.sampleRate)
+
+		if bytesCount == 0 {
+			bytesCount = audioSize
+		}
+		bitrate := header.bitrate
+		if seconds := duration.Seconds(); seconds > 0 {
+			bitrate = int(float64(bytesCount) * 8 / seconds / 1000)
+		}
+		return bitrate, duration
+	}
+
+	if audioSize <= 0 {
+		return header.bitrate, 0
+	}
+
+	duration := time.Duration(audioSize*8*1000/int64(header.bitrate)) * time.Microsecond
+	return header.bitrate, duration
+}
+
+// vbrFrameCount reads the total frame and byte counts from a Xing/Info or
+// VBRI header if the first frame carries one.
+func vbrFrameCount(header mp3FrameHeader, frame []byte) (int, int64) {
+	xingOffset := 4 + header.sideInfoSize()
+	if len(frame) >= xingOffset+16 {
+		tag := string(frame[xingOffset : xingOffset+4])
+		if tag == "Xing" || tag == "Info" {
+			flags := binary.BigEndian.Uint32(frame[xingOffset+4:])
+			pos := xingOffset + 8
+
+			var frames int
+			var bytesCount int64
+			if flags&0x01 != 0 {
+				frames = int(binary.BigEndian.Uint32(frame[pos:]))
+				pos += 4
+			}
+			if flags&0x02 != 0 && len(frame) >= pos+4 {
+				bytesCount = int64(binary.BigEndian.Uint32(frame[pos:]))
+			}
+			return frames, bytesCount
+		}
+	}
+
+	const vbriOffset = 4 + 32
+	if len(frame) >= vbriOffset+18 && string(frame[vbriOffset:vbriOffset+4]) == "VBRI" {
+		bytesCount := int64(binary.BigEndian.Uint32(frame[vbriOffset+10:]))
+		frames := int(binary.BigEndian.Uint32(frame[vbriOffset+14:]))
+		return frames, bytesCount
+	}
+
+	return 0, 0
+}
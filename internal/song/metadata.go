@@ -0,0 +1,163 @@
+package song
+
+import (
+	"bytes"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	FormatMP3  = "mp3"
+	FormatOGG  = "ogg"
+	FormatFLAC = "flac"
+	FormatWAV  = "wav"
+)
+
+// metadata holds everything we manage to learn about an audio file
+// besides its content hash.
+type metadata struct {
+	Title    string
+	Artist   string
+	Album    string
+	Year     int
+	Bitrate  int
+	Duration time.Duration
+}
+
+// merge fills zero fields of m with values from other.
+func (m *metadata) merge(other metadata) {
+	if m.Title == "" {
+		m.Title = other.Title
+	}
+	if m.Artist == "" {
+		m.Artist = other.Artist
+	}
+	if m.Album == "" {
+		m.Album = other.Album
+	}
+	if m.Year == 0 {
+		m.Year = other.Year
+	}
+	if m.Bitrate == 0 {
+		m.Bitrate = other.Bitrate
+	}
+	if m.Duration == 0 {
+		m.Duration = other.Duration
+	}
+}
+
+// readMetadata parses tags and stream info of the given format. Parsing
+// errors are not fatal: whatever was read before the error is returned.
+func readMetadata(r io.ReaderAt, size int64, format string) metadata {
+	switch format {
+	case FormatMP3:
+		return readMP3Metadata(r, size)
+	case FormatOGG:
+		return readOGGMetadata(r, size)
+	}
+	return metadata{}
+}
+
+func detectFormat(filePath string, r io.ReaderAt) string {
+	switch strings.ToLower(strings.TrimPrefix(filepath.Ext(filePath), ".")) {
+	case FormatMP3:
+		return FormatMP3
+	case FormatOGG, "oga":
+		return FormatOGG
+	case FormatFLAC:
+		return FormatFLAC
+	case FormatWAV, "wave":
+		return FormatWAV
+	}
+
+	magic := make([]byte, 4)
+	if _, err := r.ReadAt(magic, 0); err != nil {
+		return ""
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, []byte("ID3")):
+		return FormatMP3
+	case bytes.Equal(magic, []byte("OggS")):
+		return FormatOGG
+	case bytes.Equal(magic, []byte("fLaC")):
+		return FormatFLAC
+	case bytes.Equal(magic, []byte("RIFF")):
+		return FormatWAV
+	case magic[0] == 0xFF && magic[1]&0xE0 == 0xE0:
+		return FormatMP3
+	}
+	return ""
+}
+
+// metadataFromFileName guesses title and artist from names like
+// "01. Artist - Title.mp3" when the file carries no tags.
+func metadataFromFileName(filePath string) metadata {
+	name := filepath.Base(filePath)
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+	name = strings.TrimSpace(strings.ReplaceAll(name, "_", " "))
+	name = trimTrackNumber(name)
+
+	var meta metadata
+	if artist, title, ok := strings.Cut(name, " - "); ok {
+		meta.Artist = strings.TrimSpace(artist)
+		meta.Title = strings.TrimSpace(title)
+	} else {
+		meta.Title = name
+	}
+
+	return meta
+}
+
+// trimTrackNumber strips a leading "01 ", "01. " or "01 - " prefix.
+func trimTrackNumber(name string) string {
+	i := 0
+	for i < len(name) && name[i] >= '0' && name[i] <= '9' {
+		i++
+	}
+	if i == 0 || i > 3 || i == len(name) {
+		return name
+	}
+
+	rest := strings.TrimLeft(name[i:], ".-) ")
+	if rest == "" || len(rest) == len(name[i:]) {
+		return name
+	}
+	return rest
+}
+
+// parseYear extracts the leading year out of values like "1999" or
+// "2004-05-12".
+func parseYear(value string) int {
+	value = strings.TrimSpace(value)
+	if len(value) < 4 {
+		return 0
+	}
+
+	year, err := strconv.Atoi(value[:4])
+	if err != nil {
+		return 0
+	}
+	return year
+}
+
+// latin1ToUTF8 decodes ISO-8859-1 text as used by ID3v1 and ID3v2 frames
+// with encoding 0.
+func latin1ToUTF8(b []byte) string {
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return string(runes)
+}
+
+func cleanTagValue(value string) string {
+	value = strings.TrimRight(value, "\x00")
+	return strings.TrimFunc(value, func(r rune) bool {
+		return unicode.IsSpace(r) || r == 0
+	})
+}
@@ -0,0 +1,149 @@
+package song
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// MatchMode says how text fields of a query template are matched. Both
+// ignore case.
+type MatchMode int
+
+const (
+	MatchSubstring MatchMode = iota
+	MatchPrefix
+)
+
+// SortField orders query results. Ties are broken by title.
+type SortField int
+
+const (
+	SortByTitle SortField = iota
+	SortByArtist
+	SortByAlbum
+	SortByYear
+	SortByDuration
+	SortByBitrate
+)
+
+// SongQuery filters, sorts and pages the catalog. Zero fields don't
+// filter.
+type SongQuery struct {
+	// Template filters by its non-zero fields. Title, Artist and Album
+	// match by Match, Format exactly, Bitrate is a floor, Year, Duration
+	// and CID must be equal.
+	Template Song
+	Match    MatchMode
+
+	YearFrom int
+	YearTo   int
+
+	DurationFrom time.Duration
+	DurationTo   time.Duration
+
+	SortBy     SortField
+	Descending bool
+
+	Offset int
+	Limit  int
+}
+
+// Matches reports whether the song passes every filter of the query.
+func (q SongQuery) Matches(s Song) bool {
+	t := q.Template
+
+	switch {
+	case !q.matchText(s.Title, t.Title),
+		!q.matchText(s.Artist, t.Artist),
+		!q.matchText(s.Album, t.Album),
+		t.Format != "" && !strings.EqualFold(s.Format, t.Format),
+		t.Bitrate != 0 && s.Bitrate < t.Bitrate,
+		t.Year != 0 && s.Year != t.Year,
+		t.Duration != 0 && s.Duration != t.Duration,
+		t.CID.Defined() && !s.CID.Equals(t.CID),
+		q.YearFrom != 0 && s.Year < q.YearFrom,
+		q.YearTo != 0 && s.Year > q.YearTo,
+		q.DurationFrom != 0 && s.Duration < q.DurationFrom,
+		q.DurationTo != 0 && s.Duration > q.DurationTo:
+		return false
+	}
+	return true
+}
+
+func (q SongQuery) matchText(value, pattern string) bool {
+	if pattern == "" {
+		return true
+	}
+
+	value = strings.ToLower(value)
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	if q.Match == MatchPrefix {
+		return strings.HasPrefix(value, pattern)
+	}
+	return strings.Contains(value, pattern)
+}
+
+// Apply sorts the matching songs and returns the requested page.
+func (q SongQuery) Apply(songs []Song) []Song {
+	matched := make([]Song, 0, len(songs))
+	for _, s := range songs {
+		if q.Matches(s) {
+			matched = append(matched, s)
+		}
+	}
+
+	slices.SortStableFunc(matched, func(a, b Song) int {
+		c := q.compare(a, b)
+		if c == 0 {
+			c = strings.Compare(strings.ToLower(a.Title), strings.ToLower(b.Title))
+		}
+		if q.Descending {
+			return -c
+		}
+		return c
+	})
+
+	if q.Offset >= len(matched) {
+		return []Song{}
+	}
+	matched = matched[max(q.Offset, 0):]
+	if q.Limit > 0 && q.Limit < len(matched) {
+		matched = matched[:q.Limit]
+	}
+	return matched
+}
+
+func (q SongQuery) compare(a, b Song) int {
+	switch q.SortBy {
+	case SortByArtist:
+		return strings.Compare(strings.ToLower(a.Artist), strings.ToLower(b.Artist))
+	case SortByAlbum:
+		return strings.Compare(strings.ToLower(a.Album), strings.ToLower(b.Album))
+	case SortByYear:
+		return cmp.Compare(a.Year, b.Year)
+	case SortByDuration:
+		return cmp.Compare(a.Duration, b.Duration)
+	case SortByBitrate:
+		return cmp.Compare(a.Bitrate, b.Bitrate)
+	default:
+		return 0
+	}
+}
+
+// YearRange is the year interval the query allows, zero bounds are open.
+func (q SongQuery) YearRange() (from, to int) {
+	from, to = q.YearFrom, q.YearTo
+	if q.Template.Year != 0 {
+		from, to = q.Template.Year, q.Template.Year
+	}
+	return from, to
+}
+
+// SearchResult is a song found by a free text search, the higher the
+// score the better it matches, 1 at most.
+type SearchResult struct {
+	Song  Song
+	Score float64
+}
@@ -0,0 +1,425 @@
+package song
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io"
+	"slices"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// Anti-entropy repairs what gossip missed with range-based set
+// reconciliation: both peers sort their catalog entries by CID and
+// compare fingerprints of CID ranges, splitting the ranges which differ
+// until they are small enough to just send the entries in them. Only the
+// entries which differ cross the wire. Received entries are only merged
+// when the signed operations they carry back their state.
+const (
+	reconcileProtocol = "/songtable/reconcile/2.0.0"
+
+	// reconcileProtocolV1 exchanges the same messages as JSON. Still
+	// served for older peers.
+	reconcileProtocolV1 = "/songtable/reconcile/1.0.0"
+
+	// reconcileLeafSize is the number of entries up to which a differing
+	// range is sent whole instead of split.
+	reconcileLeafSize = 16
+
+	// reconcileBranches a differing range is split into.
+	reconcileBranches = 16
+
+	// reconcileMessageEntries bounds the entries of a message, the rest of
+	// a range is compared again in the next round.
+	reconcileMessageEntries = 256
+
+	reconcileTimeout   = 30 * time.Second
+	maxReconcileRounds = 4096
+
+	maxReconcileMessageSize = 16 << 20
+)
+
+var errReconcileRounds = errors.New("catalog reconciliation didn't settle")
+
+// reconcileRange covers the CIDs from Lower up to Upper, excluded. Empty
+// bounds are open. Leaf ranges carry the entries of the sender instead of
+// their fingerprint.
+type reconcileRange struct {
+	Lower []byte `json:",omitempty" cbor:"1,keyasint,omitempty"`
+	Upper []byte `json:",omitempty" cbor:"2,keyasint,omitempty"`
+
+	Count       int    `cbor:"3,keyasint"`
+	Fingerprint []byte `json:",omitempty" cbor:"4,keyasint,omitempty"`
+
+	Leaf    bool           `json:",omitempty" cbor:"5,keyasint,omitempty"`
+	Entries []CatalogEntry `json:",omitempty" cbor:"6,keyasint,omitempty"`
+}
+
+// reconcileMessage carries the ranges the receiver has to compare and the
+// entries it lacks from the leaf ranges it sent.
+type reconcileMessage struct {
+	Ranges  []reconcileRange `json:",omitempty" cbor:"1,keyasint,omitempty"`
+	Entries []CatalogEntry   `json:",omitempty" cbor:"2,keyasint,omitempty"`
+}
+
+type catalogItem struct {
+	key    []byte
+	digest [sha256.Size]byte
+	entry  CatalogEntry
+}
+
+// catalogSet is a catalog snapshot sorted by CID bytes.
+type catalogSet []catalogItem
+
+func newCatalogSet(entries []CatalogEntry) (catalogSet, error) {
+	set := make(catalogSet, 0, len(entries))
+	for _, entry := range entries {
+		digest, err := catalogEntryDigest(entry)
+		if err != nil {
+			return nil, err
+		}
+		set = append(set, catalogItem{key: entry.CID.Bytes(), digest: digest, entry: entry})
+	}
+
+	slices.SortFunc(set, func(a, b catalogItem) int {
+		return bytes.Compare(a.key, b.key)
+	})
+	return set, nil
+}
+
+// catalogEntryDigest hashes the whole state of the entry, so entries with
+// the same CID but different states differ too. It hashes the JSON form
+// whatever the protocol version, so older peers get the same fingerprints.
+func catalogEntryDigest(entry CatalogEntry) ([sha256.Size]byte, error) {
+	entryBytes, err := json.Marshal(entry)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	return sha256.Sum256(entryBytes), nil
+}
+
+// span returns the items in the range.
+func (cs catalogSet) span(lower, upper []byte) catalogSet {
+	from, _ := slices.BinarySearchFunc(cs, lower, func(item catalogItem, key []byte) int {
+		return bytes.Compare(item.key, key)
+	})
+	to := len(cs)
+	if len(upper) > 0 {
+		to, _ = slices.BinarySearchFunc(cs, upper, func(item catalogItem, key []byte) int {
+			return bytes.Compare(item.key, key)
+		})
+	}
+	return cs[from:max(from, to)]
+}
+
+// fingerprint XORs the digests of the items.
+func (cs catalogSet) fingerprint() []byte {
+	fp := make([]byte, sha256.Size)
+	for _, item := range cs {
+		for i, b := range item.digest {
+			fp[i] ^= b
+		}
+	}
+	return fp
+}
+
+func (cs catalogSet) entries() []CatalogEntry {
+	entries := make([]CatalogEntry, 0, len(cs))
+	for _, item := range cs {
+		entries = append(entries, item.entry)
+	}
+	return entries
+}
+
+func (cs catalogSet) rangeOf(lower, upper []byte) reconcileRange {
+	return reconcileRange{
+		Lower:       lower,
+		Upper:       upper,
+		Count:       len(cs),
+		Fingerprint: cs.fingerprint(),
+	}
+}
+
+func (cs catalogSet) leafOf(lower, upper []byte) reconcileRange {
+	return reconcileRange{
+		Lower:   lower,
+		Upper:   upper,
+		Count:   len(cs),
+		Leaf:    true,
+		Entries: cs.entries(),
+	}
+}
+
+// split cuts the range, which cs is the span of, into ranges with about
+// the same number of items.
+func (cs catalogSet) split(lower, upper []byte) []reconcileRange {
+	size := (len(cs) + reconcileBranches - 1) / reconcileBranches
+
+	var ranges []reconcileRange
+	for from := 0; from < len(cs); from += size {
+		to := min(from+size, len(cs))
+
+		chunkLower, chunkUpper := lower, upper
+		if from > 0 {
+			chunkLower = cs[from].key
+		}
+		if to < len(cs) {
+			chunkUpper = cs[to].key
+		}
+		ranges = append(ranges, cs[from:to].rangeOf(chunkLower, chunkUpper))
+	}
+	return ranges
+}
+
+// process compares the ranges of the message with the set. It returns the
+// reply and the entries received to merge. The reply carries no more than
+// reconcileMessageEntries entries, ranges with more left to send go back
+// for another round from the first entry not sent.
+func (cs catalogSet) process(msg reconcileMessage) (reconcileMessage, []CatalogEntry, error) {
+	var reply reconcileMessage
+	received := msg.Entries
+	budget := reconcileMessageEntries
+
+	for _, r := range msg.Ranges {
+		own := cs.span(r.Lower, r.Upper)
+
+		if r.Leaf {
+			received = append(received, r.Entries...)
+
+			theirs := make(map[[sha256.Size]byte]bool, len(r.Entries))
+			for _, entry := range r.Entries {
+				digest, err := catalogEntryDigest(entry)
+				if err != nil {
+					return reconcileMessage{}, nil, err
+				}
+				theirs[digest] = true
+			}
+			var missing catalogSet
+			for _, item := range own {
+				if !theirs[item.digest] {
+					missing = append(missing, item)
+				}
+			}
+			if len(missing) > budget {
+				rest := missing[budget].key
+				reply.Ranges = append(reply.Ranges, own.span(rest, r.Upper).rangeOf(rest, r.Upper))
+				missing = missing[:budget]
+			}
+			reply.Entries = append(reply.Entries, missing.entries()...)
+			budget -= len(missing)
+			continue
+		}
+
+		if r.Count == len(own) && bytes.Equal(r.Fingerprint, own.fingerprint()) {
+			continue
+		}
+
+		// small enough, or the other side has nothing there at all
+		if len(own) <= reconcileLeafSize || r.Count == 0 {
+			n := min(len(own), budget)
+			budget -= n
+			if n == len(own) {
+				reply.Ranges = append(reply.Ranges, own.leafOf(r.Lower, r.Upper))
+				continue
+			}
+
+			rest := own[n].key
+			reply.Ranges = append(reply.Ranges, own[:n].leafOf(r.Lower, rest), own[n:].rangeOf(rest, r.Upper))
+			continue
+		}
+		reply.Ranges = append(reply.Ranges, own.split(r.Lower, r.Upper)...)
+	}
+
+	return reply, received, nil
+}
+
+// ReconcileWith repairs the catalog against the peer's and returns the
+// number of entries received. An empty catalog is streamed whole instead,
+// as are the catalogs of peers without reconciliation.
+func (ts *SongTableSync) ReconcileWith(ctx context.Context, p peer.ID) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, reconcileTimeout)
+	defer cancel()
+
+	set, err := ts.catalogSet(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	protocols := []protocol.ID{reconcileProtocol, reconcileProtocolV1, getCatalogPagesProtocol, getCatalogProtocol}
+	if len(set) == 0 {
+		// everything differs, nothing to compare
+		protocols = []protocol.ID{getCatalogPagesProtocol, reconcileProtocol, reconcileProtocolV1, getCatalogProtocol}
+	}
+
+	s, err := ts.h.NewStream(ctx, p, protocols...)
+	if err != nil {
+		return 0, err
+	}
+	defer s.Close()
+
+	switch s.Protocol() {
+	case reconcileProtocol, reconcileProtocolV1:
+	case getCatalogPagesProtocol:
+		return ts.receiveCatalogPages(ctx, s)
+	default:
+		return readSongTable(ctx, s, ts.songTableStore, ts.valid, ts.logger)
+	}
+
+	first := reconcileMessage{Ranges: []reconcileRange{set.rangeOf(nil, nil)}}
+	if len(set) <= reconcileLeafSize {
+		first.Ranges[0] = set.leafOf(nil, nil)
+	}
+
+	received, err := ts.reconcile(ctx, s, set, &first)
+	if err != nil {
+		s.Reset()
+	}
+	return received, err
+}
+
+func (ts *SongTableSync) handleReconcile(s network.Stream) {
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(ts.ctx, reconcileTimeout)
+	defer cancel()
+
+	set, err := ts.catalogSet(ctx)
+	if err != nil {
+		ts.logger.Error("Failed to load catalog", "err", err)
+		s.Reset()
+		return
+	}
+
+	received, err := ts.reconcile(ctx, s, set, nil)
+	if err != nil {
+		ts.logger.Error("Failed to reconcile catalog", "peer", s.Conn().RemotePeer(), "err", err)
+		s.Reset()
+		return
+	}
+	if received > 0 {
+		ts.logger.Info("Catalog reconciled", "peer", s.Conn().RemotePeer(), "received", received)
+	}
+}
+
+func (ts *SongTableSync) catalogSet(ctx context.Context) (catalogSet, error) {
+	entries, err := ts.songTableStore.GetCatalogEntries(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return newCatalogSet(entries)
+}
+
+// reconcile exchanges messages until a side has no more ranges to ask
+// about. The initiator sends the first message.
+func (ts *SongTableSync) reconcile(ctx context.Context, s network.Stream, set catalogSet, first *reconcileMessage) (int, error) {
+	// the stream itself doesn't watch the context
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// done may be closed by now as well, the caller cancels
+			// ctx right after we return
+			select {
+			case <-done:
+			default:
+				s.Reset()
+			}
+		case <-done:
+		}
+	}()
+
+	// bounds each message, the session pages through as many as it needs
+	limited := &io.LimitedReader{R: s}
+
+	var enc wireEncoder = newWireEncoder(s)
+	var dec wireDecoder = newWireDecoder(limited)
+	if s.Protocol() == reconcileProtocolV1 {
+		enc = json.NewEncoder(s)
+		dec = json.NewDecoder(limited)
+	}
+
+	if first != nil {
+		if err := enc.Encode(first); err != nil {
+			return 0, err
+		}
+	}
+
+	total := 0
+	for range maxReconcileRounds {
+		limited.N = maxReconcileMessageSize
+
+		var msg reconcileMessage
+		if err := dec.Decode(&msg); err != nil {
+			if err == io.EOF {
+				return total, nil
+			}
+			return total, err
+		}
+
+		reply, received, err := set.process(msg)
+		if err != nil {
+			return total, err
+		}
+		received = ts.valid.openCatalogEntries(received, ts.logger)
+		if len(received) > 0 {
+			if err := ts.songTableStore.MergeCatalogEntries(ctx, received); err != nil {
+				return total, err
+			}
+			total += len(received)
+		}
+
+		if len(msg.Ranges) == 0 {
+			return total, nil
+		}
+		if err := enc.Encode(reply); err != nil {
+			return total, err
+		}
+		if len(reply.Ranges) == 0 {
+			return total, nil
+		}
+	}
+
+	return total, errReconcileRounds
+}
+
+// StartAntiEntropy reconciles the catalog with a random peer every
+// interval until ctx is done.
+func (ts *SongTableSync) StartAntiEntropy(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			p := getSongTableHolder(ts.h)
+			if p == "" {
+				continue
+			}
+
+			received, err := ts.ReconcileWith(ctx, p)
+			if err != nil {
+				ts.logger.Warn("Catalog reconciliation failed", "peer", p, "err", err)
+				continue
+			}
+			if received > 0 {
+				ts.logger.Info("Catalog reconciled", "peer", p, "received", received)
+			}
+		}
+	}()
+}
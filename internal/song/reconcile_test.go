@@ -0,0 +1,316 @@
+package song
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"sync"
+	"testing"
+
+	"p2p-music/config"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// memCatalogStore keeps the catalog state in memory.
+type memCatalogStore struct {
+	SongTableStore
+
+	mu      sync.Mutex
+	entries map[string]CatalogEntry
+	batches []int
+}
+
+func (m *memCatalogStore) GetCatalogEntries(ctx context.Context) ([]CatalogEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entries := make([]CatalogEntry, 0, len(m.entries))
+	for _, entry := range m.entries {
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (m *memCatalogStore) GetCatalogEntriesPage(ctx context.Context, after cid.Cid, limit int) ([]CatalogEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := slices.Sorted(maps.Keys(m.entries))
+
+	var page []CatalogEntry
+	for _, k := range keys {
+		if (!after.Defined() || k > after.KeyString()) && len(page) < limit {
+			page = append(page, m.entries[k])
+		}
+	}
+	return page, nil
+}
+
+func (m *memCatalogStore) GetCatalogEntry(ctx context.Context, c cid.Cid) (CatalogEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, ok := m.entries[c.KeyString()]
+	if !ok {
+		return CatalogEntry{CID: c}, nil
+	}
+	return entry, nil
+}
+
+func (m *memCatalogStore) MergeCatalogEntries(ctx context.Context, entries []CatalogEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, other := range entries {
+		entry := m.entries[other.CID.KeyString()]
+		entry.Merge(other)
+		m.entries[other.CID.KeyString()] = entry
+	}
+	m.batches = append(m.batches, len(entries))
+	return nil
+}
+
+// testCatalogKey publishes the songs of the catalog tests, so catalogs
+// built apart hold the same entries.
+var testCatalogKey = sync.OnceValue(func() crypto.PrivKey {
+	key, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	return key
+})
+
+// signedCatalogEntry applies the operation signed with testCatalogKey, as
+// it would arrive from gossip.
+func signedCatalogEntry(t *testing.T, op CatalogOp) CatalogEntry {
+	t.Helper()
+
+	id, err := peer.IDFromPrivateKey(testCatalogKey())
+	require.NoError(t, err)
+	op.Publisher = id
+	if op.Kind != CatalogRemove {
+		op.Clock.Peer = id.String()
+	}
+
+	data, err := signCatalogOp(op, testCatalogKey())
+	require.NoError(t, err)
+	op, err = openCatalogOp(data)
+	require.NoError(t, err)
+
+	var entry CatalogEntry
+	entry.Apply(op)
+	return entry
+}
+
+func testCatalogTag(t *testing.T, i int) string {
+	t.Helper()
+
+	id, err := peer.IDFromPrivateKey(testCatalogKey())
+	require.NoError(t, err)
+	return catalogTag(id, fmt.Sprint(i))
+}
+
+func (m *memCatalogStore) add(t *testing.T, i int, title string) {
+	t.Helper()
+
+	c := testSearchCID(t, fmt.Sprint(i))
+	entry := signedCatalogEntry(t, CatalogOp{Kind: CatalogAdd, CID: c, Tag: testCatalogTag(t, i), Song: Song{Title: title, CID: c}, Clock: Clock{Time: 1}})
+	m.MergeCatalogEntries(context.Background(), []CatalogEntry{entry})
+}
+
+func newReconcilingSync(t *testing.T, h host.Host) (*SongTableSync, *memCatalogStore) {
+	t.Helper()
+
+	store := &memCatalogStore{entries: make(map[string]CatalogEntry)}
+	ts := &SongTableSync{
+		ctx:            context.Background(),
+		h:              h,
+		self:           h.ID(),
+		logger:         slog.Default(),
+		songTableStore: store,
+	}
+	ts.valid = newCatalogValidator(h.ID(), store, &config.Config{GossipMaxFieldLength: 256})
+	ts.RegisterSongTableHandlers(context.Background(), h)
+	return ts, store
+}
+
+func TestReconcileWith(t *testing.T) {
+	ctx := context.Background()
+
+	testCases := []struct {
+		name        string
+		shared      int
+		onlyLeft    int
+		onlyRight   int
+		edited      int
+		forged      int
+		legacy      bool
+		noPages     bool
+		maxReceived int
+	}{
+		{
+			name:        "1. ReconcileWith: empty catalog receives everything",
+			onlyRight:   300,
+			maxReceived: 300,
+		},
+		{
+			name:        "2. ReconcileWith: same catalogs exchange nothing",
+			shared:      500,
+			maxReceived: 0,
+		},
+		{
+			name:      "3. ReconcileWith: only the differences are exchanged",
+			shared:    1000,
+			onlyLeft:  3,
+			onlyRight: 2,
+			edited:    1,
+			// whole leaf ranges around the 3 differences at most
+			maxReceived: 3 * reconcileLeafSize,
+		},
+		{
+			name:        "4. ReconcileWith: JSON version of an older peer",
+			shared:      100,
+			onlyLeft:    1,
+			onlyRight:   1,
+			legacy:      true,
+			maxReceived: 2 * reconcileLeafSize,
+		},
+		{
+			name:        "5. ReconcileWith: empty catalog pages through a peer without the catalog stream",
+			onlyRight:   2000,
+			noPages:     true,
+			maxReceived: 2000,
+		},
+		{
+			name:      "6. ReconcileWith: large differences on both sides are paged",
+			shared:    100,
+			onlyLeft:  700,
+			onlyRight: 900,
+			// each own entry once, plus whole leaf ranges around them
+			maxReceived: 900 + 700*reconcileLeafSize,
+		},
+		{
+			name:        "7. ReconcileWith: entries without proofs are dropped",
+			shared:      100,
+			onlyRight:   2,
+			forged:      3,
+			maxReceived: 3 * reconcileLeafSize,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mn, err := mocknet.FullMeshConnected(2)
+			require.NoError(t, err)
+			defer mn.Close()
+
+			left, leftStore := newReconcilingSync(t, mn.Hosts()[0])
+			_, rightStore := newReconcilingSync(t, mn.Hosts()[1])
+			if tc.legacy {
+				mn.Hosts()[1].RemoveStreamHandler(reconcileProtocol)
+			}
+			if tc.noPages {
+				mn.Hosts()[1].RemoveStreamHandler(getCatalogPagesProtocol)
+			}
+
+			i := 0
+			for ; i < tc.shared; i++ {
+				leftStore.add(t, i, fmt.Sprint("song ", i))
+				rightStore.add(t, i, fmt.Sprint("song ", i))
+			}
+			for range tc.onlyLeft {
+				leftStore.add(t, i, fmt.Sprint("song ", i))
+				i++
+			}
+			for range tc.onlyRight {
+				rightStore.add(t, i, fmt.Sprint("song ", i))
+				i++
+			}
+			for j := range tc.edited {
+				c := testSearchCID(t, fmt.Sprint(j))
+				rightStore.MergeCatalogEntries(ctx, []CatalogEntry{signedCatalogEntry(t, CatalogOp{Kind: CatalogUpdate, CID: c, Song: Song{Title: "edited"}, Clock: Clock{Time: 2}})})
+			}
+
+			var forged []CatalogEntry
+			for j := range tc.forged {
+				// an edit nobody signed, and a song nobody added
+				c := testSearchCID(t, fmt.Sprint(j))
+				forged = append(forged, CatalogEntry{CID: c, Song: Song{Title: "forged"}, Clock: Clock{Time: 3}})
+				c = testSearchCID(t, fmt.Sprint("forged ", j))
+				forged = append(forged, CatalogEntry{CID: c, Song: Song{Title: "forged", CID: c}, Adds: []string{"forged"}})
+			}
+			wantEntries, err := rightStore.GetCatalogEntries(ctx)
+			require.NoError(t, err)
+			rightStore.MergeCatalogEntries(ctx, forged)
+
+			received, err := left.ReconcileWith(ctx, mn.Hosts()[1].ID())
+			require.NoError(t, err)
+
+			require.LessOrEqual(t, received, tc.maxReceived)
+
+			leftEntries, err := leftStore.GetCatalogEntries(ctx)
+			require.NoError(t, err)
+			if tc.onlyLeft == 0 {
+				require.ElementsMatch(t, wantEntries, leftEntries)
+			}
+			if tc.forged == 0 {
+				rightEntries, err := rightStore.GetCatalogEntries(ctx)
+				require.NoError(t, err)
+				require.ElementsMatch(t, leftEntries, rightEntries)
+			}
+		})
+	}
+}
+
+func TestCatalogSetProcessPages(t *testing.T) {
+	store := &memCatalogStore{entries: make(map[string]CatalogEntry)}
+	for i := range 5000 {
+		store.add(t, i, fmt.Sprint("song ", i))
+	}
+	entries, err := store.GetCatalogEntries(context.Background())
+	require.NoError(t, err)
+
+	full, err := newCatalogSet(entries)
+	require.NoError(t, err)
+	empty, err := newCatalogSet(nil)
+	require.NoError(t, err)
+
+	// the empty side asks first, as ReconcileWith does
+	msg := reconcileMessage{Ranges: []reconcileRange{empty.leafOf(nil, nil)}}
+	sets := []catalogSet{full, empty}
+	received := make(map[string]bool)
+
+	for round := 0; len(msg.Ranges) > 0; round++ {
+		require.Less(t, round, maxReconcileRounds)
+
+		reply, got, err := sets[round%2].process(msg)
+		require.NoError(t, err)
+		for _, entry := range got {
+			if round%2 == 1 {
+				received[entry.CID.KeyString()] = true
+			}
+		}
+
+		sent := len(reply.Entries)
+		for _, r := range reply.Ranges {
+			sent += len(r.Entries)
+		}
+		require.LessOrEqual(t, sent, reconcileMessageEntries)
+
+		msg = reply
+	}
+	// the last reply carries entries without asking anything back
+	for _, entry := range msg.Entries {
+		received[entry.CID.KeyString()] = true
+	}
+	require.Len(t, received, 5000)
+}
@@ -0,0 +1,401 @@
+package song
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	// songSearchProtocol takes a CBOR search request and answers with a
+	// CBOR hit after the other until the stream is closed.
+	songSearchProtocol = "/song/search/2.0.0"
+
+	// songSearchProtocolV1 is the same in JSON, a hit per line. Still
+	// served for older peers.
+	songSearchProtocolV1 = "/song/search/1.0.0"
+
+	defaultSearchHops = 3
+	maxSearchHops     = 5
+
+	defaultSearchTimeout = 5 * time.Second
+	maxSearchTimeout     = 30 * time.Second
+
+	// searchHopMargin is kept from the deadline on every hop, so the hits
+	// have the time to travel back before the peer asking gives up.
+	searchHopMargin = 500 * time.Millisecond
+
+	// searchSeenTTL is how long a search ID is remembered to drop the
+	// same query arriving over another path.
+	searchSeenTTL = time.Minute
+
+	// maxSearchResults is the number of songs a search returns at most.
+	maxSearchResults = 100
+
+	maxSearchRequestSize = 4 << 10
+
+	// maxSearchHitSize bounds a single hit read from a peer.
+	maxSearchHitSize = 64 << 10
+)
+
+type searchRequest struct {
+	ID      string        `cbor:"1,keyasint"`
+	Query   string        `cbor:"2,keyasint"`
+	Limit   int           `cbor:"3,keyasint,omitempty"`
+	Hops    int           `cbor:"4,keyasint,omitempty"`
+	Timeout time.Duration `cbor:"5,keyasint,omitempty"`
+}
+
+// SearchHit is a song found by a distributed search together with the
+// peers which answered that they have its file. A peer only vouches for
+// itself, the providers it relays from further away are dropped.
+type SearchHit struct {
+	Song      Song      `cbor:"1,keyasint"`
+	Score     float64   `cbor:"2,keyasint"`
+	Providers []peer.ID `cbor:"3,keyasint,omitempty"`
+}
+
+// searchSeen remembers the IDs of recent searches and the most hops
+// they had left.
+type searchSeen struct {
+	mu  sync.Mutex
+	ids map[string]seenSearch
+}
+
+type seenSearch struct {
+	at   time.Time
+	hops int
+}
+
+// add reports whether the search has to be answered: it is new or came
+// with more hops left than before, over a shorter path, so it reaches
+// peers the first copy couldn't.
+func (ss *searchSeen) add(id string, hops int) bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	now := time.Now()
+	for seenID, seen := range ss.ids {
+		if now.Sub(seen.at) > searchSeenTTL {
+			delete(ss.ids, seenID)
+		}
+	}
+
+	if seen, ok := ss.ids[id]; ok && seen.hops >= hops {
+		return false
+	}
+	ss.ids[id] = seenSearch{at: now, hops: hops}
+	return true
+}
+
+// searchAggregator merges the hits for the same song from different
+// peers.
+type searchAggregator struct {
+	limit int
+	hits  map[string]*SearchHit
+}
+
+func newSearchAggregator(limit int) *searchAggregator {
+	return &searchAggregator{
+		limit: limit,
+		hits:  make(map[string]*SearchHit),
+	}
+}
+
+// add merges the hit in and returns the merged hit when it tells
+// something new: the song wasn't found before or has new providers.
+func (sa *searchAggregator) add(hit SearchHit) (SearchHit, bool) {
+	key := hit.Song.Title
+	if hit.Song.CID.Defined() {
+		key = hit.Song.CID.KeyString()
+	}
+
+	merged, ok := sa.hits[key]
+	if !ok {
+		if len(sa.hits) >= sa.limit {
+			return SearchHit{}, false
+		}
+		hit.Providers = slices.Compact(slices.Sorted(slices.Values(hit.Providers)))
+		sa.hits[key] = &hit
+		return cloneSearchHit(hit), true
+	}
+
+	changed := false
+	for _, provider := range hit.Providers {
+		if !slices.Contains(merged.Providers, provider) {
+			merged.Providers = append(merged.Providers, provider)
+			changed = true
+		}
+	}
+	slices.Sort(merged.Providers)
+	merged.Score = max(merged.Score, hit.Score)
+
+	return cloneSearchHit(*merged), changed
+}
+
+func cloneSearchHit(hit SearchHit) SearchHit {
+	hit.Providers = slices.Clone(hit.Providers)
+	return hit
+}
+
+// Search looks for the query in the local catalog and asks the peers up
+// to hops connections away, zero hops meaning the default. Hits are sent
+// as they arrive, a song is sent again when more providers answer for
+// it. The channel is closed once every peer answered or the deadline of
+// ctx passed, the default timeout when it has none.
+func (dm *SongManager) Search(ctx context.Context, query string, limit, hops int) <-chan SearchHit {
+	timeout := defaultSearchTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	if hops <= 0 {
+		hops = defaultSearchHops
+	}
+
+	req := normalizeSearchRequest(searchRequest{
+		ID:      uuid.NewString(),
+		Query:   query,
+		Limit:   limit,
+		Hops:    hops,
+		Timeout: timeout,
+	})
+	dm.searchSeen.add(req.ID, req.Hops)
+
+	hits := make(chan SearchHit)
+	go func() {
+		defer close(hits)
+		dm.search(ctx, req, "", func(hit SearchHit) error {
+			select {
+			case hits <- hit:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}()
+	return hits
+}
+
+func normalizeSearchRequest(req searchRequest) searchRequest {
+	req.Hops = min(max(req.Hops, 0), maxSearchHops)
+
+	if req.Timeout <= 0 {
+		req.Timeout = defaultSearchTimeout
+	}
+	req.Timeout = min(req.Timeout, maxSearchTimeout)
+
+	if req.Limit <= 0 {
+		req.Limit = maxSearchResults
+	}
+	req.Limit = min(req.Limit, maxSearchResults)
+	return req
+}
+
+func (dm *SongManager) RegisterSongSearchProtocol(ctx context.Context) {
+	handler := func(s network.Stream) {
+		defer s.Close()
+		if err := dm.answerSearch(ctx, s); err != nil {
+			dm.logger.Error("Failed to answer search", "peer", s.Conn().RemotePeer(), "err", err)
+			s.Reset()
+		}
+	}
+
+	dm.h.SetStreamHandler(songSearchProtocol, handler)
+	dm.h.SetStreamHandler(songSearchProtocolV1, handler)
+}
+
+// searchCodec returns the encoder and decoder of the protocol version.
+func searchCodec(s network.Stream, r io.Reader) (wireEncoder, wireDecoder) {
+	if s.Protocol() == songSearchProtocolV1 {
+		return json.NewEncoder(s), json.NewDecoder(r)
+	}
+	return newWireEncoder(s), newWireDecoder(r)
+}
+
+func (dm *SongManager) answerSearch(ctx context.Context, s network.Stream) error {
+	enc, dec := searchCodec(s, io.LimitReader(s, maxSearchRequestSize))
+
+	var req searchRequest
+	if err := dec.Decode(&req); err != nil {
+		return err
+	}
+	req = normalizeSearchRequest(req)
+
+	// reached us over another path already
+	if !dm.searchSeen.add(req.ID, req.Hops) {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, req.Timeout)
+	defer cancel()
+
+	// don't keep writing to a peer which stopped reading
+	answered := make(chan struct{})
+	defer close(answered)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// cancel runs right after answered is closed, only a
+			// deadline passing while we answer resets
+			select {
+			case <-answered:
+			default:
+				s.Reset()
+			}
+		case <-answered:
+		}
+	}()
+
+	dm.search(ctx, req, s.Conn().RemotePeer(), func(hit SearchHit) error {
+		return enc.Encode(hit)
+	})
+	return nil
+}
+
+// search collects the hits of the local catalog and of the peers the
+// request is forwarded to, except the one it came from, and sends every
+// new or updated hit until all of them answered or the timeout passed.
+func (dm *SongManager) search(ctx context.Context, req searchRequest, from peer.ID, send func(SearchHit) error) {
+	ctx, cancel := context.WithTimeout(ctx, req.Timeout)
+	defer cancel()
+
+	hits := make(chan SearchHit)
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		dm.searchLocal(ctx, req, hits)
+	}()
+
+	if forward, ok := forwardedSearchRequest(req); ok {
+		for _, p := range dm.h.Network().Peers() {
+			if p == from || p == dm.h.ID() {
+				continue
+			}
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := dm.forwardSearch(ctx, p, forward, hits); err != nil {
+					dm.logger.Debug("Search not answered", "peer", p, "err", err)
+				}
+			}()
+		}
+	}
+
+	go func() {
+		wg.Wait()
+		close(hits)
+	}()
+
+	aggregator := newSearchAggregator(req.Limit)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case hit, ok := <-hits:
+			if !ok {
+				return
+			}
+			merged, changed := aggregator.add(hit)
+			if !changed {
+				continue
+			}
+			if err := send(merged); err != nil {
+				dm.logger.Warn("Failed to send search hit", "err", err)
+				return
+			}
+		}
+	}
+}
+
+// forwardedSearchRequest returns the request for the next hop, if there
+// are hops and time left for one.
+func forwardedSearchRequest(req searchRequest) (searchRequest, bool) {
+	if req.Hops <= 0 {
+		return req, false
+	}
+	req.Hops--
+	req.Timeout -= searchHopMargin
+	return req, req.Timeout > 0
+}
+
+func (dm *SongManager) searchLocal(ctx context.Context, req searchRequest, hits chan<- SearchHit) {
+	results, err := dm.songTableStore.SearchSongs(ctx, req.Query, req.Limit)
+	if err != nil {
+		dm.logger.Error("Failed to search the song table", "err", err)
+		return
+	}
+
+	for _, result := range results {
+		hit := SearchHit{Song: result.Song, Score: result.Score}
+		if path, err := dm.filePathsStore.FindFilePath(ctx, result.Song.CID); err == nil && path != "" {
+			hit.Providers = []peer.ID{dm.h.ID()}
+		}
+
+		select {
+		case hits <- hit:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (dm *SongManager) forwardSearch(ctx context.Context, p peer.ID, req searchRequest, hits chan<- SearchHit) error {
+	s, err := dm.h.NewStream(ctx, p, songSearchProtocol, songSearchProtocolV1)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	// the stream itself doesn't watch the context
+	go func() {
+		<-ctx.Done()
+		s.Reset()
+	}()
+
+	// bounds each hit, a peer may send as many as the limit allows
+	limited := &io.LimitedReader{R: s}
+
+	enc, dec := searchCodec(s, limited)
+	if err := enc.Encode(req); err != nil {
+		return err
+	}
+	if err := s.CloseWrite(); err != nil {
+		return err
+	}
+	for {
+		limited.N = maxSearchHitSize
+
+		var hit SearchHit
+		if err := dec.Decode(&hit); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if hit.Song.Title == "" && !hit.Song.CID.Defined() {
+			continue
+		}
+		// the peer can't vouch for the files of others
+		if slices.Contains(hit.Providers, p) {
+			hit.Providers = []peer.ID{p}
+		} else {
+			hit.Providers = nil
+		}
+
+		select {
+		case hits <- hit:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package song
+
+import (
+	"context"
+	"log/slog"
+	"p2p-music/config"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// memSongTableStore answers every search with all of its songs.
+type memSongTableStore struct {
+	SongTableStore
+	songs []Song
+}
+
+func (m *memSongTableStore) SearchSongs(ctx context.Context, query string, limit int) ([]SearchResult, error) {
+	results := make([]SearchResult, 0, len(m.songs))
+	for _, s := range m.songs {
+		results = append(results, SearchResult{Song: s, Score: 1})
+	}
+	return results, nil
+}
+
+func TestSearch(t *testing.T) {
+	ctx := context.Background()
+
+	teardrop := Song{Title: "Teardrop", Artist: "Massive Attack", CID: testSearchCID(t, "teardrop")}
+	angel := Song{Title: "Angel", Artist: "Massive Attack", CID: testSearchCID(t, "angel")}
+	protection := Song{Title: "Protection", Artist: "Massive Attack", CID: testSearchCID(t, "protection")}
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	// a - b, a - c, b - c, c - d
+	var hosts []host.Host
+	for range 4 {
+		h, err := mn.GenPeer()
+		require.NoError(t, err)
+		hosts = append(hosts, h)
+	}
+	for _, link := range [][2]int{{0, 1}, {0, 2}, {1, 2}, {2, 3}} {
+		_, err := mn.LinkPeers(hosts[link[0]].ID(), hosts[link[1]].ID())
+		require.NoError(t, err)
+		_, err = mn.ConnectPeers(hosts[link[0]].ID(), hosts[link[1]].ID())
+		require.NoError(t, err)
+	}
+
+	peerSongs := []struct {
+		catalog []Song
+		files   []Song
+	}{
+		{},
+		{catalog: []Song{teardrop}, files: []Song{teardrop}},
+		{catalog: []Song{teardrop, angel}, files: []Song{teardrop}},
+		{catalog: []Song{protection}, files: []Song{protection}},
+	}
+
+	var managers []*SongManager
+	for i, h := range hosts {
+		paths := make(map[cid.Cid]string)
+		for _, s := range peerSongs[i].files {
+			paths[s.CID] = s.Title + ".mp3"
+		}
+
+		dm := NewSongManager(h, nil, nil, &memSongTableStore{songs: peerSongs[i].catalog}, &memFilePathsStore{paths: paths}, &config.Config{}, slog.Default())
+		dm.RegisterSongSearchProtocol(ctx)
+		managers = append(managers, dm)
+	}
+
+	testCases := []struct {
+		name          string
+		hops          int
+		limit         int
+		wantProviders map[string][]peer.ID
+	}{
+		{
+			name: "1. Search: direct peers, providers aggregated",
+			hops: 1,
+			wantProviders: map[string][]peer.ID{
+				teardrop.Title: sortedPeers(hosts[1].ID(), hosts[2].ID()),
+				angel.Title:    nil,
+			},
+		},
+		{
+			// c can't vouch for the file of d
+			name: "2. Search: forwarded a hop further",
+			hops: 2,
+			wantProviders: map[string][]peer.ID{
+				teardrop.Title:   sortedPeers(hosts[1].ID(), hosts[2].ID()),
+				angel.Title:      nil,
+				protection.Title: nil,
+			},
+		},
+		{
+			name:  "3. Search: limit",
+			hops:  1,
+			limit: 1,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+			defer cancel()
+
+			found := make(map[string][]peer.ID)
+			for hit := range managers[0].Search(ctx, "massive attack", tc.limit, tc.hops) {
+				found[hit.Song.Title] = hit.Providers
+			}
+			require.NoError(t, ctx.Err(), "search didn't end before the deadline")
+
+			if tc.limit > 0 {
+				require.Len(t, found, tc.limit)
+				return
+			}
+			require.Len(t, found, len(tc.wantProviders))
+			for title, providers := range tc.wantProviders {
+				require.ElementsMatch(t, providers, found[title], title)
+			}
+		})
+	}
+}
+
+func TestForwardSearch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	mn, err := mocknet.FullMeshConnected(3)
+	require.NoError(t, err)
+	defer mn.Close()
+
+	hosts := mn.Hosts()
+	answering, other := hosts[1].ID(), hosts[2].ID()
+
+	teardrop := Song{Title: "Teardrop", CID: testSearchCID(t, "teardrop")}
+	angel := Song{Title: "Angel", CID: testSearchCID(t, "angel")}
+	huge := Song{Title: strings.Repeat("a", maxSearchHitSize), CID: testSearchCID(t, "huge")}
+
+	hosts[1].SetStreamHandler(songSearchProtocol, func(s network.Stream) {
+		defer s.Close()
+		var req searchRequest
+		if err := newWireDecoder(s).Decode(&req); err != nil {
+			return
+		}
+
+		enc := newWireEncoder(s)
+		for _, hit := range []SearchHit{
+			{Song: teardrop, Providers: []peer.ID{other, answering}},
+			{Song: angel, Providers: []peer.ID{other}},
+			{Song: huge, Providers: []peer.ID{answering}},
+		} {
+			if err := enc.Encode(hit); err != nil {
+				return
+			}
+		}
+	})
+
+	dm := NewSongManager(hosts[0], nil, nil, nil, nil, &config.Config{}, slog.Default())
+
+	hits := make(chan SearchHit, 3)
+	err = dm.forwardSearch(ctx, answering, searchRequest{ID: "search", Query: "a"}, hits)
+	require.Error(t, err, "hit larger than maxSearchHitSize")
+	close(hits)
+
+	var found []SearchHit
+	for hit := range hits {
+		found = append(found, hit)
+	}
+	require.Equal(t, []SearchHit{
+		{Song: teardrop, Providers: []peer.ID{answering}},
+		{Song: angel},
+	}, found)
+}
+
+func TestSearchSeen(t *testing.T) {
+	seen := searchSeen{ids: make(map[string]seenSearch)}
+
+	require.True(t, seen.add("search", 1))
+	require.False(t, seen.add("search", 1))
+	require.False(t, seen.add("search", 0))
+
+	// came over a shorter path
+	require.True(t, seen.add("search", 2))
+
+	seen.ids["search"] = seenSearch{at: time.Now().Add(-2 * searchSeenTTL), hops: 2}
+	require.True(t, seen.add("search", 2))
+}
+
+func testSearchCID(t *testing.T, content string) cid.Cid {
+	t.Helper()
+
+	c, err := songCIDBuilder.Sum([]byte(content))
+	require.NoError(t, err)
+	return c
+}
+
+func sortedPeers(ids ...peer.ID) []peer.ID {
+	return slices.Sorted(slices.Values(ids))
+}
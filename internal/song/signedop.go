@@ -0,0 +1,165 @@
+package song
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Catalog operations are gossiped signed by the host key of their
+// publisher, so nobody can announce songs, nor retract them, in the name
+// of another peer. The signature covers the operation bytes as sent.
+const catalogOpSignaturePrefix = "p2p-music catalog op:"
+
+var (
+	errUnsignedCatalogOp = errors.New("unsigned catalog operation")
+	errCatalogOpSigner   = errors.New("catalog operation not signed by its publisher")
+)
+
+// signedCatalogOp is the gossiped form of a CatalogOp. Op is the CBOR
+// operation, or the JSON one from older peers.
+type signedCatalogOp struct {
+	Version   int    `json:",omitempty" cbor:"0,keyasint"`
+	Op        []byte `cbor:"1,keyasint"`
+	Signature []byte `cbor:"2,keyasint"`
+
+	// PublicKey is only sent for keys the peer ID doesn't embed.
+	PublicKey []byte `json:",omitempty" cbor:"3,keyasint,omitempty"`
+}
+
+// legacySignedCatalogOp is the JSON form, where the operation is embedded
+// as JSON rather than bytes.
+type legacySignedCatalogOp struct {
+	Op        json.RawMessage
+	Signature []byte
+	PublicKey []byte `json:",omitempty"`
+}
+
+// catalogTag makes the add tag of the publisher. Tags are prefixed with
+// their publisher, so a remove can be checked to retract only its own.
+func catalogTag(publisher peer.ID, id string) string {
+	return publisher.String() + "/" + id
+}
+
+func ownsCatalogTag(publisher peer.ID, tag string) bool {
+	return strings.HasPrefix(tag, publisher.String()+"/")
+}
+
+// signCatalogOp encodes the operation signed with key, which has to be
+// the key of op.Publisher.
+func signCatalogOp(op CatalogOp, key crypto.PrivKey) ([]byte, error) {
+	opBytes, err := marshalWire(op)
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := key.Sign(append([]byte(catalogOpSignaturePrefix), opBytes...))
+	if err != nil {
+		return nil, err
+	}
+
+	signed := signedCatalogOp{Version: wireVersion, Op: opBytes, Signature: sig}
+	if _, err := op.Publisher.ExtractPublicKey(); err != nil {
+		if signed.PublicKey, err = crypto.MarshalPublicKey(key.GetPublic()); err != nil {
+			return nil, err
+		}
+	}
+
+	return marshalWire(signed)
+}
+
+// openCatalogOp verifies a gossiped operation and returns it. The
+// operation has to be signed by its publisher, and a remove may only
+// retract the adds of its publisher.
+func openCatalogOp(data []byte) (CatalogOp, error) {
+	signed, op, err := decodeSignedCatalogOp(data)
+	if err != nil {
+		return CatalogOp{}, err
+	}
+	if err := op.Validate(); err != nil {
+		return CatalogOp{}, err
+	}
+
+	pub, err := publisherKey(op.Publisher, signed.PublicKey)
+	if err != nil {
+		return CatalogOp{}, err
+	}
+
+	ok, err := pub.Verify(append([]byte(catalogOpSignaturePrefix), signed.Op...), signed.Signature)
+	if err != nil {
+		return CatalogOp{}, err
+	}
+	if !ok {
+		return CatalogOp{}, errCatalogOpSigner
+	}
+
+	switch op.Kind {
+	case CatalogAdd:
+		if !ownsCatalogTag(op.Publisher, op.Tag) {
+			return CatalogOp{}, errCatalogOpSigner
+		}
+	case CatalogRemove:
+		for _, tag := range op.Tags {
+			if !ownsCatalogTag(op.Publisher, tag) {
+				return CatalogOp{}, errCatalogOpSigner
+			}
+		}
+	}
+
+	op.Signed = data
+	return op, nil
+}
+
+// decodeSignedCatalogOp decodes the envelope and the operation in it,
+// whether they are CBOR or the JSON of older peers.
+func decodeSignedCatalogOp(data []byte) (signedCatalogOp, CatalogOp, error) {
+	var signed signedCatalogOp
+	var op CatalogOp
+
+	if isJSONMessage(data) {
+		var legacy legacySignedCatalogOp
+		if err := json.Unmarshal(data, &legacy); err != nil {
+			return signed, op, err
+		}
+		signed = signedCatalogOp{Op: legacy.Op, Signature: legacy.Signature, PublicKey: legacy.PublicKey}
+		if len(signed.Op) == 0 || len(signed.Signature) == 0 {
+			return signed, op, errUnsignedCatalogOp
+		}
+		return signed, op, json.Unmarshal(signed.Op, &op)
+	}
+
+	if err := unmarshalWire(data, &signed); err != nil {
+		return signed, op, err
+	}
+	if err := checkWireVersion(signed.Version); err != nil {
+		return signed, op, err
+	}
+	if len(signed.Op) == 0 || len(signed.Signature) == 0 {
+		return signed, op, errUnsignedCatalogOp
+	}
+	return signed, op, unmarshalWire(signed.Op, &op)
+}
+
+// publisherKey returns the public key of the publisher, taken from its
+// peer ID or from the key sent along, which must match the ID.
+func publisherKey(publisher peer.ID, keyBytes []byte) (crypto.PubKey, error) {
+	if publisher == "" {
+		return nil, errUnsignedCatalogOp
+	}
+
+	if len(keyBytes) == 0 {
+		return publisher.ExtractPublicKey()
+	}
+
+	pub, err := crypto.UnmarshalPublicKey(keyBytes)
+	if err != nil {
+		return nil, err
+	}
+	if !publisher.MatchesPublicKey(pub) {
+		return nil, errCatalogOpSigner
+	}
+	return pub, nil
+}
@@ -0,0 +1,148 @@
+package song
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func testPeerKey(t *testing.T, keyType int) (crypto.PrivKey, peer.ID) {
+	t.Helper()
+
+	key, _, err := crypto.GenerateKeyPairWithReader(keyType, 2048, rand.Reader)
+	require.NoError(t, err)
+	id, err := peer.IDFromPrivateKey(key)
+	require.NoError(t, err)
+	return key, id
+}
+
+func TestOpenCatalogOp(t *testing.T) {
+	songCID := testSearchCID(t, "angel")
+	key, id := testPeerKey(t, crypto.Ed25519)
+	rsaKey, rsaID := testPeerKey(t, crypto.RSA)
+	otherKey, otherID := testPeerKey(t, crypto.Ed25519)
+
+	add := CatalogOp{
+		Kind:      CatalogAdd,
+		CID:       songCID,
+		Tag:       catalogTag(id, "1"),
+		Song:      Song{Title: "Angel", CID: songCID},
+		Clock:     Clock{Time: 1, Peer: id.String()},
+		Publisher: id,
+	}
+	rsaAdd := add
+	rsaAdd.Tag, rsaAdd.Publisher = catalogTag(rsaID, "1"), rsaID
+	foreignRemove := CatalogOp{Kind: CatalogRemove, CID: songCID, Tags: []string{add.Tag}, Publisher: otherID}
+
+	sign := func(op CatalogOp, key crypto.PrivKey) []byte {
+		data, err := signCatalogOp(op, key)
+		require.NoError(t, err)
+		return data
+	}
+	tampered := func(data []byte) []byte {
+		var signed signedCatalogOp
+		require.NoError(t, unmarshalWire(data, &signed))
+		var op CatalogOp
+		require.NoError(t, unmarshalWire(signed.Op, &op))
+		op.Song.Title = "Angel (Remix)"
+		signed.Op, _ = marshalWire(op)
+		data, _ = marshalWire(signed)
+		return data
+	}
+	// as signed by older peers
+	legacy := func(op CatalogOp, key crypto.PrivKey) []byte {
+		opBytes, err := json.Marshal(op)
+		require.NoError(t, err)
+		sig, err := key.Sign(append([]byte(catalogOpSignaturePrefix), opBytes...))
+		require.NoError(t, err)
+		data, err := json.Marshal(legacySignedCatalogOp{Op: opBytes, Signature: sig})
+		require.NoError(t, err)
+		return data
+	}
+	future := func(data []byte) []byte {
+		var signed signedCatalogOp
+		require.NoError(t, unmarshalWire(data, &signed))
+		signed.Version = wireVersion + 1
+		data, _ = marshalWire(signed)
+		return data
+	}
+	unsigned, err := json.Marshal(add)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name    string
+		data    []byte
+		want    CatalogOp
+		wantErr error
+	}{
+		{
+			name: "1. openCatalogOp: signed add",
+			data: sign(add, key),
+			want: add,
+		},
+		{
+			name: "2. openCatalogOp: key sent along the peer ID",
+			data: sign(rsaAdd, rsaKey),
+			want: rsaAdd,
+		},
+		{
+			name:    "3. openCatalogOp: unsigned operation",
+			data:    unsigned,
+			wantErr: errUnsignedCatalogOp,
+		},
+		{
+			name:    "4. openCatalogOp: signed by another peer",
+			data:    sign(add, otherKey),
+			wantErr: errCatalogOpSigner,
+		},
+		{
+			name:    "5. openCatalogOp: tampered operation",
+			data:    tampered(sign(add, key)),
+			wantErr: errCatalogOpSigner,
+		},
+		{
+			name:    "6. openCatalogOp: removing the adds of another peer",
+			data:    sign(foreignRemove, otherKey),
+			wantErr: errCatalogOpSigner,
+		},
+		{
+			name: "7. openCatalogOp: JSON operation of an older peer",
+			data: legacy(add, key),
+			want: add,
+		},
+		{
+			name:    "8. openCatalogOp: newer wire format version",
+			data:    future(sign(add, key)),
+			wantErr: errWireVersion,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			op, err := openCatalogOp(tc.data)
+			if tc.wantErr != nil {
+				require.ErrorIs(t, err, tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.want.Publisher, op.Publisher)
+			require.Equal(t, tc.want.Tag, op.Tag)
+			require.Equal(t, tc.want.Song.Title, op.Song.Title)
+		})
+	}
+}
+
+func TestCatalogOpPublisher(t *testing.T) {
+	songCID := testSearchCID(t, "angel")
+
+	var entry CatalogEntry
+	entry.Apply(CatalogOp{Kind: CatalogAdd, CID: songCID, Tag: "a/1", Song: Song{Title: "Angel", Publisher: "forged"}, Clock: Clock{Time: 1}, Publisher: "a"})
+	require.Equal(t, peer.ID("a"), entry.Song.Publisher)
+
+	entry.Apply(CatalogOp{Kind: CatalogUpdate, CID: songCID, Song: Song{Title: "Angel (Live)"}, Clock: Clock{Time: 2}, Publisher: "b"})
+	require.Equal(t, peer.ID("b"), entry.Song.Publisher)
+}
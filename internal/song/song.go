@@ -1,30 +1,37 @@
 package song
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"fmt"
+	"hash"
 	"io"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/multiformats/go-multihash"
 )
 
 //TODO: interface needed
 
 type Song struct {
-	Title    string
-	Artist   string
-	Album    string
-	Year     int
-	Format   string
-	Bitrate  int
-	FileSize int64
-	Duration time.Duration
-	CID      cid.Cid
+	Title    string        `cbor:"1,keyasint,omitempty"`
+	Artist   string        `cbor:"2,keyasint,omitempty"`
+	Album    string        `cbor:"3,keyasint,omitempty"`
+	Year     int           `cbor:"4,keyasint,omitempty"`
+	Format   string        `cbor:"5,keyasint,omitempty"`
+	Bitrate  int           `cbor:"6,keyasint,omitempty"` // kbps
+	FileSize int64         `cbor:"7,keyasint,omitempty"`
+	Duration time.Duration `cbor:"8,keyasint,omitempty"`
+	CID      cid.Cid       `cbor:"9,keyasint,omitempty"`
+
+	// Publisher is the peer which announced the song in the catalog.
+	Publisher peer.ID `json:",omitempty" cbor:"10,keyasint,omitempty"`
 }
 
 func NewSong(filePath string) (Song, error) {
@@ -34,43 +41,63 @@ func NewSong(filePath string) (Song, error) {
 	}
 	defer file.Close()
 
-	cid, err := GenerateSongCID(file)
+	return NewSongFromFile(file)
+}
+
+// NewSongFromFile builds a Song out of the file tags (ID3 for MP3, Vorbis
+// comments for OGG) and falls back to the file name for missing title
+// and artist.
+func NewSongFromFile(file *os.File) (Song, error) {
+	info, err := file.Stat()
 	if err != nil {
 		return Song{}, err
 	}
 
-	var format string
-	switch {
-	case strings.HasSuffix(filePath, "mp3"):
-		format = "mp3"
-	case strings.HasSuffix(filePath, "ogg"):
-		format = "ogg"
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return Song{}, err
 	}
 
-	return Song{
-		Title:  file.Name(),
-		Format: format,
-		CID:    cid,
-	}, nil
-}
-
-func NewSongFromFile(file *os.File) (Song, error) {
 	cid, err := GenerateSongCID(file)
 	if err != nil {
 		return Song{}, err
 	}
 
+	format := detectFormat(file.Name(), file)
+
+	meta := readMetadata(file, info.Size(), format)
+	meta.merge(metadataFromFileName(file.Name()))
+
 	return Song{
-		Title: file.Name(),
-		CID:   cid,
+		Title:    meta.Title,
+		Artist:   meta.Artist,
+		Album:    meta.Album,
+		Year:     meta.Year,
+		Format:   format,
+		Bitrate:  meta.Bitrate,
+		FileSize: info.Size(),
+		Duration: meta.Duration,
+		CID:      cid,
 	}, nil
 }
 
+// GenerateSongCID returns the root CID of the song DAG (see BuildSongDAG).
+// Songs of a single chunk get a raw CID equal to generateRawSongCID.
 func GenerateSongCID(song *os.File) (cid.Cid, error) {
+	dag, err := BuildSongDAG(song)
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	return dag.Root, nil
+}
+
+// generateRawSongCID hashes the whole content into a single raw CID, which
+// is how song CIDs were made before they were chunked.
+func generateRawSongCID(r io.Reader) (cid.Cid, error) {
 	hasher := sha256.New()
 
 	// Stream the file content through the hasher
-	if _, err := io.Copy(hasher, song); err != nil {
+	if _, err := io.Copy(hasher, r); err != nil {
 		return cid.Undef, fmt.Errorf("failed to hash file: %w", err)
 	}
 
@@ -83,26 +110,105 @@ func GenerateSongCID(song *os.File) (cid.Cid, error) {
 	return cid.NewCidV1(cid.Raw, mh), nil
 }
 
+// verifySongFile checks the whole file against the song CID using the
+// same scheme the CID was made with.
+func verifySongFile(song Song, f io.ReaderAt, size int64) error {
+	content := io.NewSectionReader(f, 0, size)
+
+	var received cid.Cid
+	if hasSongDAG(song.CID) {
+		dag, err := BuildSongDAG(content)
+		if err != nil {
+			return err
+		}
+		received = dag.Root
+	} else {
+		hasher, err := newSongHasher(song.CID)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(hasher, content); err != nil {
+			return err
+		}
+		return verifySongHash(song.CID, hasher.Sum(nil))
+	}
+
+	if !received.Equals(song.CID) {
+		return IntegrityError{
+			Expected: song.CID,
+			Received: received,
+		}
+	}
+	return nil
+}
+
+// newSongHasher returns a hasher for the multihash function of the CID.
+func newSongHasher(c cid.Cid) (hash.Hash, error) {
+	decoded, err := multihash.Decode(c.Hash())
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode multihash: %w", err)
+	}
+
+	return multihash.GetHasher(decoded.Code)
+}
+
+// verifySongHash checks a digest produced by newSongHasher against the CID.
+func verifySongHash(c cid.Cid, digest []byte) error {
+	decoded, err := multihash.Decode(c.Hash())
+	if err != nil {
+		return fmt.Errorf("failed to decode multihash: %w", err)
+	}
+
+	mh, err := multihash.Encode(digest, decoded.Code)
+	if err != nil {
+		return fmt.Errorf("failed to encode multihash: %w", err)
+	}
+
+	if !bytes.Equal(mh, c.Hash()) {
+		return IntegrityError{
+			Expected: c,
+			Received: cid.NewCidV1(c.Type(), mh),
+		}
+	}
+
+	return nil
+}
+
+// SongNameWithoutFormat returns a file system safe base name for the song
+// file, like "Artist - Title".
 func (s Song) SongNameWithoutFormat() string {
-	titleParts := strings.Split(s.Title, ".")
-	if len(titleParts) < 1 {
-		return uuid.NewString()
+	name := s.Title
+	if s.Format == "" {
+		// catalog entries made before tags were read carry the file path
+		// as the title
+		name = strings.TrimSuffix(filepath.Base(name), filepath.Ext(name))
+	} else if s.Artist != "" {
+		name = s.Artist + " - " + s.Title
 	}
 
-	noFormatPart := titleParts[len(titleParts)-2]
-	noFormatPartSpleted := strings.Split(noFormatPart, "/")
-	if len(noFormatPartSpleted) == 0 {
+	name = strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '\\', ':', '*', '?', '"', '<', '>', '|', 0:
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.Trim(strings.TrimSpace(name), ".")
+
+	if name == "" {
 		return uuid.NewString()
 	}
-
-	return noFormatPartSpleted[len(noFormatPartSpleted)-1]
+	return name
 }
 
 func (s Song) SongFormat() string {
-	titleParts := strings.Split(s.Title, ".")
-	if len(titleParts) < 1 {
-		return uuid.NewString()
+	if s.Format != "" {
+		return s.Format
 	}
 
-	return titleParts[len(titleParts)-1]
+	ext := strings.TrimPrefix(filepath.Ext(s.Title), ".")
+	if ext == "" {
+		return uuid.NewString()
+	}
+	return ext
 }
@@ -0,0 +1,205 @@
+package song
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewSong(t *testing.T) {
+	testCases := []struct {
+		name     string
+		filePath string
+		want     Song
+	}{
+		{
+			name:     "1. NewSong: ID3v2.3 tags, CBR stream",
+			filePath: "testdata/id3v23.mp3",
+			want: Song{
+				Title:    "Paranoid Android",
+				Artist:   "Radiohead",
+				Album:    "OK Computer",
+				Year:     1997,
+				Format:   FormatMP3,
+				Bitrate:  128,
+				FileSize: 44341,
+				Duration: 2762625 * time.Microsecond,
+			},
+		},
+		{
+			name:     "2. NewSong: ID3v2.4 UTF-8 tags, Xing VBR header",
+			filePath: "testdata/id3v24_xing.mp3",
+			want: Song{
+				Title:    "Группа крови",
+				Artist:   "Кино",
+				Album:    "Группа крови",
+				Year:     1988,
+				Format:   FormatMP3,
+				Bitrate:  127,
+				FileSize: 2652,
+				Duration: 10004897959,
+			},
+		},
+		{
+			name:     "3. NewSong: ID3v2.2 tags",
+			filePath: "testdata/id3v22.mp3",
+			want: Song{
+				Title:    "So What",
+				Artist:   "Miles Davis",
+				Album:    "Kind of Blue",
+				Year:     1959,
+				Format:   FormatMP3,
+				Bitrate:  128,
+				FileSize: 16784,
+				Duration: 1042500 * time.Microsecond,
+			},
+		},
+		{
+			name:     "4. NewSong: ID3v1 tag",
+			filePath: "testdata/id3v1.mp3",
+			want: Song{
+				Title:    "Smells Like Teen Spirit",
+				Artist:   "Nirvana",
+				Album:    "Nevermind",
+				Year:     1991,
+				Format:   FormatMP3,
+				Bitrate:  128,
+				FileSize: 16808,
+				Duration: 1042500 * time.Microsecond,
+			},
+		},
+		{
+			name:     "5. NewSong: no tags, file name heuristics",
+			filePath: "testdata/02. Daft Punk - One More Time.mp3",
+			want: Song{
+				Title:    "One More Time",
+				Artist:   "Daft Punk",
+				Format:   FormatMP3,
+				Bitrate:  128,
+				FileSize: 16680,
+				Duration: 1042500 * time.Microsecond,
+			},
+		},
+		{
+			name:     "6. NewSong: Vorbis comments",
+			filePath: "testdata/vorbis.ogg",
+			want: Song{
+				Title:    "Clair de Lune",
+				Artist:   "Claude Debussy",
+				Album:    "Suite bergamasque",
+				Year:     1905,
+				Format:   FormatOGG,
+				Bitrate:  160,
+				FileSize: 1475,
+				Duration: 5 * time.Second,
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			song, err := NewSong(tc.filePath)
+			require.NoError(t, err)
+			require.True(t, song.CID.Defined())
+
+			song.CID = tc.want.CID
+			require.Equal(t, tc.want, song)
+		})
+	}
+}
+
+func TestNewSongFromFile(t *testing.T) {
+	file, err := os.Open("testdata/id3v23.mp3")
+	require.NoError(t, err)
+	defer file.Close()
+
+	// read position must not matter
+	_, err = file.Seek(100, 0)
+	require.NoError(t, err)
+
+	fromFile, err := NewSongFromFile(file)
+	require.NoError(t, err)
+
+	fromPath, err := NewSong("testdata/id3v23.mp3")
+	require.NoError(t, err)
+
+	require.Equal(t, fromPath, fromFile)
+}
+
+func TestSongNameWithoutFormat(t *testing.T) {
+	testCases := []struct {
+		name string
+		song Song
+		want string
+	}{
+		{
+			name: "1. SongNameWithoutFormat: artist and title",
+			song: Song{Title: "One More Time", Artist: "Daft Punk", Format: FormatMP3},
+			want: "Daft Punk - One More Time",
+		},
+		{
+			name: "2. SongNameWithoutFormat: path separators replaced",
+			song: Song{Title: "AC/DC", Format: FormatMP3},
+			want: "AC_DC",
+		},
+		{
+			name: "3. SongNameWithoutFormat: legacy entry with file path title",
+			song: Song{Title: "/music/old song.mp3"},
+			want: "old song",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.want, tc.song.SongNameWithoutFormat())
+		})
+	}
+}
+
+func TestVerifySongHash(t *testing.T) {
+	file, err := os.Open("testdata/vorbis.ogg")
+	require.NoError(t, err)
+	defer file.Close()
+
+	songCID, err := GenerateSongCID(file)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name    string
+		content []byte
+		wantErr bool
+	}{
+		{
+			name: "1. verifySongHash: success",
+			content: func() []byte {
+				content, err := os.ReadFile("testdata/vorbis.ogg")
+				require.NoError(t, err)
+				return content
+			}(),
+		},
+		{
+			name:    "2. verifySongHash: failure: content mismatch",
+			content: []byte("not a song"),
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			hasher, err := newSongHasher(songCID)
+			require.NoError(t, err)
+
+			hasher.Write(tc.content)
+			err = verifySongHash(songCID, hasher.Sum(nil))
+			if tc.wantErr {
+				var integrityErr IntegrityError
+				require.ErrorAs(t, err, &integrityErr)
+				require.Equal(t, songCID, integrityErr.Expected)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
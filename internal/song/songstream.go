@@ -0,0 +1,195 @@
+package song
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+var errSongStreamClosed = errors.New("song stream is closed")
+
+// SongStream reads a song while ReceiveSongStream is still downloading
+// it, so playback can start before the download completes. Reads past the
+// downloaded part block until more data arrives. The download keeps going
+// when the stream is closed.
+type SongStream struct {
+	song Song
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	file      *os.File
+	available int64
+	offset    int64
+	closed    bool
+
+	// err ends reads, downloadErr is what the download itself returned
+	err         error
+	done        bool
+	songPath    string
+	downloadErr error
+}
+
+// StreamSong starts downloading the song from the peer and returns a
+// reader over the part of the file received so far.
+func (dm *SongManager) StreamSong(ctx context.Context, song Song, targetPeerID peer.ID) *SongStream {
+	s := &SongStream{song: song}
+	s.cond = sync.NewCond(&s.mu)
+
+	go func() {
+		songPath, err := dm.receiveSongStream(ctx, song, targetPeerID, s.update)
+		s.finish(songPath, err)
+	}()
+
+	return s
+}
+
+// LocalSongPath returns the path of the local copy of the song, or an
+// empty string when there is none.
+func (dm *SongManager) LocalSongPath(ctx context.Context, song Song) (string, error) {
+	songPath, err := dm.filePathsStore.FindFilePath(ctx, song.CID)
+	if err != nil || songPath == "" {
+		return "", err
+	}
+
+	if _, err := os.Stat(songPath); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", nil
+		}
+		return "", err
+	}
+	return songPath, nil
+}
+
+func (s *SongStream) update(partPath string, written int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil && !s.closed {
+		// opened before the part file is renamed, the descriptor
+		// survives the rename
+		file, err := os.Open(partPath)
+		if err != nil {
+			s.err = err
+			s.cond.Broadcast()
+			return
+		}
+		s.file = file
+	}
+
+	s.available = written
+	s.cond.Broadcast()
+}
+
+func (s *SongStream) finish(songPath string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.done = true
+	s.songPath = songPath
+	s.downloadErr = err
+	if s.err == nil {
+		s.err = err
+	}
+	s.cond.Broadcast()
+}
+
+// Read blocks until data at the current offset is downloaded. It returns
+// the download error if the download fails.
+func (s *SongStream) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	for !s.closed && s.err == nil && !s.done && s.offset >= s.available {
+		s.cond.Wait()
+	}
+
+	switch {
+	case s.closed:
+		s.mu.Unlock()
+		return 0, errSongStreamClosed
+	case s.err != nil:
+		err := s.err
+		s.mu.Unlock()
+		return 0, err
+	case s.offset >= s.available:
+		s.mu.Unlock()
+		return 0, io.EOF
+	}
+
+	n := int(min(int64(len(p)), s.available-s.offset))
+	file, offset := s.file, s.offset
+	s.mu.Unlock()
+
+	n, err := file.ReadAt(p[:n], offset)
+
+	s.mu.Lock()
+	s.offset += int64(n)
+	s.mu.Unlock()
+
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek sets the read offset. Seeking past the downloaded part is allowed,
+// the next Read waits for the download to get there. io.SeekEnd is
+// relative to the song file size.
+func (s *SongStream) Seek(offset int64, whence int) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += s.offset
+	case io.SeekEnd:
+		offset += s.song.FileSize
+	default:
+		return 0, errInvalidSongRange
+	}
+	if offset < 0 {
+		return 0, errInvalidSongRange
+	}
+
+	s.offset = offset
+	s.cond.Broadcast()
+	return offset, nil
+}
+
+// Size is the size of the song once fully downloaded.
+func (s *SongStream) Size() int64 {
+	return s.song.FileSize
+}
+
+// Wait blocks until the download ends and returns the path of the saved
+// song.
+func (s *SongStream) Wait() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for !s.done {
+		s.cond.Wait()
+	}
+	return s.songPath, s.downloadErr
+}
+
+// Close stops reading and unblocks pending reads. The download itself is
+// bound to the context passed to StreamSong.
+func (s *SongStream) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	s.cond.Broadcast()
+
+	if s.file == nil {
+		return nil
+	}
+	return s.file.Close()
+}
@@ -3,16 +3,18 @@ package song
 import (
 	"bufio"
 	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log/slog"
+	"math"
 	"os"
 	"p2p-music/config"
+	"path/filepath"
 	"strings"
-	"time"
 
-	"github.com/ebitengine/oto/v3"
-	"github.com/hajimehoshi/go-mp3"
 	"github.com/ipfs/go-cid"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
 	"github.com/libp2p/go-libp2p/core/host"
@@ -21,17 +23,42 @@ import (
 )
 
 const (
-	songStreamingProtocol = "/song/stream/1.1.0"
+	// songStreamingProtocol requests a byte range of a song by a CBOR
+	// songRequest.
+	songStreamingProtocol = "/song/stream/3.0.0"
+
+	// songStreamingProtocolV21 requests a byte range of a song by its CID
+	// bytes followed by uvarint offset and length.
+	songStreamingProtocolV21 = "/song/stream/2.1.0"
+
+	// songStreamingProtocolV2 requests a whole song by its CID bytes.
+	songStreamingProtocolV2 = "/song/stream/2.0.0"
+
+	// songStreamingProtocolV1 requests a song by a newline terminated
+	// title. Still served for older peers.
+	songStreamingProtocolV1 = "/song/stream/1.1.0"
+
+	maxSongRequestSize = 1 << 10
+
+	// maxSongFileSize bounds downloads of songs which don't say their
+	// size.
+	maxSongFileSize = 1 << 30
 )
 
 type FilePathsStore interface {
 	SaveFilePath(context.Context, cid.Cid, string) error
 
 	FindFilePath(context.Context, cid.Cid) (string, error)
+
+	ListFilePaths(context.Context) (map[cid.Cid]string, error)
 }
 
 type SongTableSynchronizer interface {
 	AdvertiseSong(Song) error
+
+	RemoveSong(cid.Cid) error
+
+	EditSong(Song) error
 }
 
 type SongManager struct {
@@ -42,6 +69,9 @@ type SongManager struct {
 	dht            *dht.IpfsDHT
 	config         *config.Config
 	logger         *slog.Logger
+
+	dagCache   songDAGCache
+	searchSeen searchSeen
 }
 
 func NewSongManager(
@@ -70,6 +100,13 @@ func NewSongManager(
 
 		songTableSync:  songTableSync,
 		songTableStore: songTableStore,
+
+		dagCache: songDAGCache{
+			dags: make(map[cid.Cid]*SongDAG),
+		},
+		searchSeen: searchSeen{
+			ids: make(map[string]seenSearch),
+		},
 	}
 }
 
@@ -82,13 +119,8 @@ func (dm *SongManager) PromoteSong(ctx context.Context, song Song, songFilePath
 	}
 	dm.logger.Info("Successfully saved song file path", "path", songFilePath)
 
-	addedSong, err := dm.songTableStore.AddSong(ctx, song)
-	if err != nil {
-		dm.logger.Error("Failed to add song to BoltDB", "err", err)
-		return err
-	}
-
-	if err := dm.dht.Provide(ctx, addedSong.CID, true); err != nil {
+	// the file is what we seed, whatever the catalog holds
+	if err := dm.dht.Provide(ctx, song.CID, true); err != nil {
 		dm.logger.Error("Failed to provide song", "err", err)
 		return PromoteSongError{
 			errMsg: err.Error(),
@@ -105,6 +137,41 @@ func (dm *SongManager) PromoteSong(ctx context.Context, song Song, songFilePath
 	return nil
 }
 
+// SeedSong makes a local copy of a song already in the catalog available
+// to other peers: the file is registered for streaming and the CID is
+// provided on the DHT. Unlike PromoteSong it doesn't advertise the song
+// over gossipsub again.
+func (dm *SongManager) SeedSong(ctx context.Context, song Song, songFilePath string) error {
+	if err := dm.filePathsStore.SaveFilePath(ctx, song.CID, songFilePath); err != nil {
+		dm.logger.Error("Failed to save song file path", "err", err)
+		return PromoteSongError{
+			errMsg: err.Error(),
+		}
+	}
+
+	if err := dm.dht.Provide(ctx, song.CID, true); err != nil {
+		dm.logger.Error("Failed to provide song", "err", err)
+		return PromoteSongError{
+			errMsg: err.Error(),
+		}
+	}
+
+	dm.logger.Info("Seeding song", "CID", song.CID, "path", songFilePath)
+	return nil
+}
+
+// seedDownloadedSong seeds a verified download if the config asks for it.
+// The download itself already succeeded, so failures are only logged.
+func (dm *SongManager) seedDownloadedSong(ctx context.Context, song Song, songFilePath string) {
+	if !dm.config.SeedDownloads {
+		return
+	}
+
+	if err := dm.SeedSong(ctx, song, songFilePath); err != nil {
+		dm.logger.Warn("Failed to seed downloaded song", "CID", song.CID, "err", err)
+	}
+}
+
 func (dm *SongManager) FindSongProviders(ctx context.Context, song Song) ([]peer.AddrInfo, error) {
 	nonSelfProviders := make([]peer.AddrInfo, 0)
 
@@ -122,80 +189,310 @@ func (dm *SongManager) FindSongProviders(ctx context.Context, song Song) ([]peer
 	return nonSelfProviders, nil
 }
 
-// TODO: promote song after receving
+// songRequest asks for Length bytes of the song starting at Offset. Zero
+// Length means up to the end of the file.
+type songRequest struct {
+	CID    cid.Cid `cbor:"1,keyasint"`
+	Offset int64   `cbor:"2,keyasint,omitempty"`
+	Length int64   `cbor:"3,keyasint,omitempty"`
+}
+
+// OpenSongRange opens a stream with length bytes of the song starting at
+// offset, zero length meaning up to the end. It lets a player seek into a
+// song which is not fully local yet. The caller must close the reader.
+func (dm *SongManager) OpenSongRange(ctx context.Context, song Song, targetPeerID peer.ID, offset, length int64) (io.ReadCloser, error) {
+	stream, err := dm.h.NewStream(ctx, targetPeerID, songStreamingProtocol, songStreamingProtocolV21)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeSongRequest(stream, song, offset, length); err != nil {
+		stream.Reset()
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+// ReceiveSongStream downloads the song into MusicPath. The download goes
+// to a "<CID>.part" file which is kept when the connection drops, so the
+// next call resumes from where it stopped. Songs with a DAG are verified
+// block by block while they arrive, others once the whole file is there.
+// With SeedDownloads enabled the saved song is seeded right away.
 func (dm *SongManager) ReceiveSongStream(ctx context.Context, song Song, targetPeerID peer.ID) (string, error) {
-	stream, err := dm.h.NewStream(context.Background(), targetPeerID, songStreamingProtocol)
+	return dm.receiveSongStream(ctx, song, targetPeerID, nil)
+}
+
+// downloadProgress is told how many bytes of the part file are written.
+// It is first called before anything is received, once the part file is
+// truncated to the resume offset.
+type downloadProgress func(partPath string, written int64)
+
+// progressWriter reports every write to the part file.
+type progressWriter struct {
+	w        io.Writer
+	path     string
+	written  int64
+	progress downloadProgress
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	n, err := pw.w.Write(p)
+	pw.written += int64(n)
+	pw.progress(pw.path, pw.written)
+	return n, err
+}
+
+func (dm *SongManager) receiveSongStream(ctx context.Context, song Song, targetPeerID peer.ID, progress downloadProgress) (string, error) {
+	var dag *SongDAG
+	if hasSongDAG(song.CID) {
+		var err error
+		dag, err = dm.FetchSongDAG(ctx, song, targetPeerID)
+		if err != nil {
+			dm.logger.Warn("Failed to fetch song DAG, verifying after download", "peer", targetPeerID, "err", err)
+		}
+	}
+
+	partPath := filepath.Join(dm.config.MusicPath, song.CID.String()+".part")
+	partFile, err := os.OpenFile(partPath, os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
+		dm.logger.Error("Failed to create song file", "err", err)
 		return "", err
 	}
-	defer stream.Close()
+	defer partFile.Close()
 
-	_, err = stream.Write([]byte(song.Title + "\n")) // Wrire separator
+	info, err := partFile.Stat()
 	if err != nil {
 		return "", err
 	}
+	offset := info.Size()
+	if dag != nil {
+		// only keep blocks we can vouch for
+		offset = dag.verifiedPrefix(partFile)
+	}
+	if song.FileSize > 0 && offset >= song.FileSize {
+		// can't be a valid prefix, start over
+		offset = 0
+	}
 
-	songNewFilePath := fmt.Sprintf("%s/%s.%s", dm.config.MusicPath, song.SongNameWithoutFormat(), song.SongFormat())
-	outFile, err := os.Create(songNewFilePath)
+	stream, err := dm.h.NewStream(ctx, targetPeerID, songStreamingProtocol, songStreamingProtocolV21, songStreamingProtocolV2, songStreamingProtocolV1)
 	if err != nil {
-		dm.logger.Error("Failed to create song file", "err", err)
 		return "", err
 	}
-	defer outFile.Close()
+	defer stream.Close()
+
+	if stream.Protocol() != songStreamingProtocol && stream.Protocol() != songStreamingProtocolV21 {
+		// older peers can only send the whole file
+		offset = 0
+	}
+	if err := truncatePartFile(partFile, offset); err != nil {
+		return "", err
+	}
+	if offset > 0 {
+		dm.logger.Info("Resuming song download", "CID", song.CID, "offset", offset)
+	}
+
+	if err := writeSongRequest(stream, song, offset, 0); err != nil {
+		return "", err
+	}
+
+	var w io.Writer = partFile
+	if progress != nil {
+		progress(partPath, offset)
+		w = &progressWriter{w: partFile, path: partPath, written: offset, progress: progress}
+	}
+
+	if dag != nil {
+		err = dag.copyVerified(w, stream, offset)
+	} else {
+		// the peer may send more than the song, don't fill the disk
+		limit := int64(maxSongFileSize)
+		if song.FileSize > 0 {
+			limit = song.FileSize - offset
+		}
+		_, err = io.Copy(w, io.LimitReader(stream, limit))
+	}
+	if err != nil {
+		// for DAG songs the part file holds only verified blocks and is
+		// kept for the next attempt
+		dm.logger.Error("Song download interrupted", "CID", song.CID, "peer", targetPeerID, "err", err)
+		return "", err
+	}
+	dm.logger.Info("Audio stream ended")
 
-	buf := make([]byte, 4096)
-	for {
-		n, err := stream.Read(buf)
-		if n > 0 {
-			_, writeErr := outFile.Write(buf[:n])
-			if writeErr != nil {
-				return "", writeErr
-			}
+	if dag == nil {
+		info, err := partFile.Stat()
+		if err != nil {
+			return "", err
 		}
-		if err == io.EOF {
-			dm.logger.Info("Audio stream ended")
-			break
-		} else if err != nil {
+
+		if err := verifySongFile(song, partFile, info.Size()); err != nil {
+			dm.logger.Error("Received song doesn't match its CID", "peer", targetPeerID, "err", err)
+			partFile.Close()
+			os.Remove(partPath)
 			return "", err
 		}
 	}
 
+	if err := partFile.Close(); err != nil {
+		return "", err
+	}
+
+	songNewFilePath := dm.songLibraryPath(song)
+	if err := os.Rename(partPath, songNewFilePath); err != nil {
+		dm.logger.Error("Failed to move song file into library", "err", err)
+		return "", err
+	}
+
+	dm.seedDownloadedSong(ctx, song, songNewFilePath)
+
 	return songNewFilePath, nil
 }
 
+// songLibraryPath is where a downloaded song is stored in MusicPath.
+// Titles aren't unique, when another file already has the name the CID
+// is added to it, so a download never replaces another song.
+func (dm *SongManager) songLibraryPath(song Song) string {
+	name := song.SongNameWithoutFormat()
+
+	songPath := fmt.Sprintf("%s/%s.%s", dm.config.MusicPath, name, song.SongFormat())
+	if _, err := os.Lstat(songPath); errors.Is(err, fs.ErrNotExist) {
+		return songPath
+	}
+	return fmt.Sprintf("%s/%s (%s).%s", dm.config.MusicPath, name, song.CID, song.SongFormat())
+}
+
+// truncatePartFile cuts the file to size and moves the offset to its end.
+func truncatePartFile(f *os.File, size int64) error {
+	if err := f.Truncate(size); err != nil {
+		return err
+	}
+	_, err := f.Seek(size, io.SeekStart)
+	return err
+}
+
 func (dm *SongManager) RegisterSongStreamingProtocols(ctx context.Context) {
-	dm.h.SetStreamHandler(songStreamingProtocol, func(s network.Stream) {
+	handler := func(s network.Stream) {
 		defer s.Close()
 		err := dm.streamSong(ctx, s)
 		if err != nil {
-			dm.logger.Error("Failed to stream song", "err", err)
+			dm.logger.Error("Failed to stream song", "protocol", s.Protocol(), "err", err)
 			// s.Reset()
 			return
 		}
 		dm.logger.Info("Song streaming success")
-	})
+	}
+
+	dm.h.SetStreamHandler(songStreamingProtocol, handler)
+	dm.h.SetStreamHandler(songStreamingProtocolV21, handler)
+	dm.h.SetStreamHandler(songStreamingProtocolV2, handler)
+	dm.h.SetStreamHandler(songStreamingProtocolV1, handler)
+
+	dm.registerSongDAGProtocol(ctx)
 }
 
-func (dm *SongManager) streamSong(ctx context.Context, s network.Stream) error {
-	// Читаем имя запрашиваемого файла
+// writeSongRequest writes the song request in the format of the
+// negotiated protocol version. The range is only sent on versions which
+// support it.
+func writeSongRequest(s network.Stream, song Song, offset, length int64) error {
+	var request []byte
+	switch s.Protocol() {
+	case songStreamingProtocolV1:
+		request = []byte(song.Title + "\n") // Wrire separator
+	case songStreamingProtocolV2:
+		request = song.CID.Bytes()
+	case songStreamingProtocolV21:
+		request = song.CID.Bytes()
+		request = binary.AppendUvarint(request, uint64(offset))
+		request = binary.AppendUvarint(request, uint64(length))
+	default:
+		var err error
+		request, err = marshalWire(songRequest{CID: song.CID, Offset: offset, Length: length})
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := s.Write(request)
+	return err
+}
+
+// readSongRequest reads the song request of any supported protocol
+// version and resolves it to the song CID.
+func (dm *SongManager) readSongRequest(ctx context.Context, s network.Stream) (songRequest, error) {
 	reader := bufio.NewReader(s)
-	songTitle, err := reader.ReadString('\n')
+
+	if s.Protocol() == songStreamingProtocolV1 {
+		// Читаем имя запрашиваемого файла
+		songTitle, err := reader.ReadString('\n')
+		if err != nil {
+			fmt.Println("Ошибка чтения запроса:", err)
+			return songRequest{}, err
+		}
+		songTitle = strings.TrimSpace(songTitle)
+
+		song, err := dm.songTableStore.FindSongByTitle(ctx, songTitle)
+		if err != nil {
+			dm.logger.Error("Failed to find file", "song title", songTitle, "err", err)
+			return songRequest{}, err
+		}
+
+		return songRequest{CID: song.CID}, nil
+	}
+
+	if s.Protocol() == songStreamingProtocol {
+		var request songRequest
+		if err := newWireDecoder(io.LimitReader(reader, maxSongRequestSize)).Decode(&request); err != nil {
+			return songRequest{}, err
+		}
+		if !request.CID.Defined() || request.Offset < 0 || request.Length < 0 {
+			return songRequest{}, errInvalidSongRange
+		}
+		return request, nil
+	}
+
+	_, songCID, err := cid.CidFromReader(reader)
 	if err != nil {
-		fmt.Println("Ошибка чтения запроса:", err)
-		return err
+		dm.logger.Error("Failed to read song CID", "err", err)
+		return songRequest{}, err
+	}
+	request := songRequest{CID: songCID}
+
+	if s.Protocol() == songStreamingProtocolV2 {
+		return request, nil
 	}
-	songTitle = strings.TrimSpace(songTitle)
 
-	song, err := dm.songTableStore.FindSongByTitle(ctx, songTitle)
+	offset, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return songRequest{}, err
+	}
+	length, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return songRequest{}, err
+	}
+	if offset > math.MaxInt64 || length > math.MaxInt64 {
+		return songRequest{}, errInvalidSongRange
+	}
+	request.Offset = int64(offset)
+	request.Length = int64(length)
+
+	return request, nil
+}
+
+func (dm *SongManager) streamSong(ctx context.Context, s network.Stream) error {
+	request, err := dm.readSongRequest(ctx, s)
 	if err != nil {
-		dm.logger.Error("Failed to find file", "song title", songTitle, "err", err)
 		return err
 	}
 
-	songPath, err := dm.filePathsStore.FindFilePath(ctx, song.CID)
+	songPath, err := dm.filePathsStore.FindFilePath(ctx, request.CID)
 	if err != nil {
 		return err
 	}
+	if songPath == "" {
+		dm.logger.Error("No local file for requested song", "CID", request.CID)
+		return errSongFileNotFound
+	}
 
 	file, err := os.Open(songPath)
 	if err != nil {
@@ -204,55 +501,28 @@ func (dm *SongManager) streamSong(ctx context.Context, s network.Stream) error {
 	}
 	defer file.Close()
 
-	// Стримим аудиофайл чанками
-	buf := make([]byte, 4096)
-	for {
-		n, err := file.Read(buf)
-		if n > 0 {
-			_, writeErr := s.Write(buf[:n])
-			if writeErr != nil {
-				return writeErr
-			}
-		}
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return err
-		}
-	}
-
-	return nil
-}
-
-// TODO: unused
-func StreamMP3FromReader(reader io.Reader) {
-	// Декодируем MP3 из переданного потока
-	decodedMp3, err := mp3.NewDecoder(reader)
+	info, err := file.Stat()
 	if err != nil {
-		panic("mp3.NewDecoder failed: " + err.Error())
-	}
-
-	// Настройка oto контекста
-	op := &oto.NewContextOptions{
-		SampleRate:   44100,
-		ChannelCount: 2,
-		Format:       oto.FormatSignedInt16LE,
+		return err
 	}
-	otoCtx, readyChan, err := oto.NewContext(op)
-	if err != nil {
-		panic("oto.NewContext failed: " + err.Error())
+	if request.Offset > info.Size() {
+		return errInvalidSongRange
 	}
-	<-readyChan
 
-	player := otoCtx.NewPlayer(decodedMp3)
-	player.Play()
+	if _, err := file.Seek(request.Offset, io.SeekStart); err != nil {
+		return err
+	}
 
-	// Ждём окончания воспроизведения
-	for player.IsPlaying() {
-		time.Sleep(time.Millisecond * 100)
+	// Стримим аудиофайл чанками
+	if request.Length == 0 {
+		_, err = io.Copy(s, file)
+		return err
 	}
 
-	if err = player.Close(); err != nil {
-		panic("player.Close failed: " + err.Error())
+	_, err = io.CopyN(s, file, request.Length)
+	if err == io.EOF {
+		// range past the end of file, send what we have
+		return nil
 	}
+	return err
 }
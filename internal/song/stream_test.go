@@ -0,0 +1,304 @@
+package song
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"p2p-music/config"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/require"
+)
+
+type memFilePathsStore struct {
+	mu    sync.Mutex
+	paths map[cid.Cid]string
+}
+
+func (m *memFilePathsStore) SaveFilePath(ctx context.Context, c cid.Cid, path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.paths[c] = path
+	return nil
+}
+
+func (m *memFilePathsStore) FindFilePath(ctx context.Context, c cid.Cid) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.paths[c], nil
+}
+
+func (m *memFilePathsStore) ListFilePaths(ctx context.Context) (map[cid.Cid]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return maps.Clone(m.paths), nil
+}
+
+// titleSongStore finds its songs by title for /song/stream/1.1.0.
+type titleSongStore struct {
+	SongTableStore
+	songs []Song
+}
+
+func (m *titleSongStore) FindSongByTitle(ctx context.Context, title string) (Song, error) {
+	for _, s := range m.songs {
+		if s.Title == title {
+			return s, nil
+		}
+	}
+	return Song{}, errSongNotInCatalog
+}
+
+// newTestSongManagers returns a provider seeding the fixture file and a
+// receiver downloading into its own music dir.
+func newTestSongManagers(t *testing.T, fixture string) (*SongManager, *SongManager, Song) {
+	t.Helper()
+	ctx := context.Background()
+
+	mn, err := mocknet.FullMeshConnected(2)
+	require.NoError(t, err)
+	t.Cleanup(func() { mn.Close() })
+
+	hosts := mn.Hosts()
+
+	song, err := NewSong(fixture)
+	require.NoError(t, err)
+
+	providerStore := &memFilePathsStore{paths: map[cid.Cid]string{song.CID: fixture}}
+	provider := NewSongManager(hosts[0], nil, nil, nil, providerStore, &config.Config{}, slog.Default())
+	provider.RegisterSongStreamingProtocols(ctx)
+
+	receiverStore := &memFilePathsStore{paths: make(map[cid.Cid]string)}
+	receiver := NewSongManager(hosts[1], nil, nil, nil, receiverStore, &config.Config{MusicPath: t.TempDir()}, slog.Default())
+
+	return provider, receiver, song
+}
+
+func TestReceiveSongStream(t *testing.T) {
+	ctx := context.Background()
+	fixture := "testdata/id3v23.mp3"
+
+	content, err := os.ReadFile(fixture)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name    string
+		part    []byte
+		wantErr bool
+	}{
+		{
+			name: "1. ReceiveSongStream: success",
+		},
+		{
+			name: "2. ReceiveSongStream: resume from .part file",
+			part: content[:len(content)/2],
+		},
+		{
+			name:    "3. ReceiveSongStream: failure: corrupt .part file",
+			part:    make([]byte, len(content)/2),
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			provider, receiver, song := newTestSongManagers(t, fixture)
+
+			partPath := filepath.Join(receiver.config.MusicPath, song.CID.String()+".part")
+			if tc.part != nil {
+				require.NoError(t, os.WriteFile(partPath, tc.part, 0644))
+			}
+
+			songPath, err := receiver.ReceiveSongStream(ctx, song, provider.h.ID())
+			if tc.wantErr {
+				var integrityErr IntegrityError
+				require.ErrorAs(t, err, &integrityErr)
+				require.NoFileExists(t, partPath)
+				return
+			}
+			require.NoError(t, err)
+
+			received, err := os.ReadFile(songPath)
+			require.NoError(t, err)
+			require.Equal(t, content, received)
+			require.NoFileExists(t, partPath)
+		})
+	}
+}
+
+func TestReceiveSongStreamOlderProvider(t *testing.T) {
+	ctx := context.Background()
+	fixture := "testdata/id3v23.mp3"
+
+	content, err := os.ReadFile(fixture)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name     string
+		protocol protocol.ID
+		part     []byte
+	}{
+		{
+			name:     "1. ReceiveSongStream: request by CID on 2.0.0",
+			protocol: songStreamingProtocolV2,
+			part:     content[:len(content)/2],
+		},
+		{
+			name:     "2. ReceiveSongStream: request by title on 1.1.0",
+			protocol: songStreamingProtocolV1,
+			part:     content[:len(content)/2],
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			provider, receiver, song := newTestSongManagers(t, fixture)
+			provider.songTableStore = &titleSongStore{songs: []Song{song}}
+
+			// the provider only speaks tc.protocol
+			for _, p := range []protocol.ID{songStreamingProtocol, songStreamingProtocolV21, songStreamingProtocolV2, songStreamingProtocolV1} {
+				if p != tc.protocol {
+					provider.h.RemoveStreamHandler(p)
+				}
+			}
+
+			// older versions can't resume, the part file is started over
+			partPath := filepath.Join(receiver.config.MusicPath, song.CID.String()+".part")
+			require.NoError(t, os.WriteFile(partPath, tc.part, 0644))
+
+			songPath, err := receiver.ReceiveSongStream(ctx, song, provider.h.ID())
+			require.NoError(t, err)
+
+			received, err := os.ReadFile(songPath)
+			require.NoError(t, err)
+			require.Equal(t, content, received)
+			require.NoFileExists(t, partPath)
+		})
+	}
+}
+
+func TestOpenSongRange(t *testing.T) {
+	ctx := context.Background()
+	fixture := "testdata/id3v23.mp3"
+
+	content, err := os.ReadFile(fixture)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name   string
+		offset int64
+		length int64
+		want   []byte
+	}{
+		{
+			name:   "1. OpenSongRange: offset and length",
+			offset: 100,
+			length: 417,
+			want:   content[100:517],
+		},
+		{
+			name:   "2. OpenSongRange: up to the end",
+			offset: int64(len(content) - 128),
+			want:   content[len(content)-128:],
+		},
+		{
+			name:   "3. OpenSongRange: length past the end",
+			offset: int64(len(content) - 10),
+			length: 100,
+			want:   content[len(content)-10:],
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			provider, receiver, song := newTestSongManagers(t, fixture)
+
+			r, err := receiver.OpenSongRange(ctx, song, provider.h.ID(), tc.offset, tc.length)
+			require.NoError(t, err)
+			defer r.Close()
+
+			received, err := io.ReadAll(r)
+			require.NoError(t, err)
+			require.Equal(t, tc.want, received)
+		})
+	}
+}
+
+func TestStreamSong(t *testing.T) {
+	ctx := context.Background()
+	fixture := "testdata/id3v23.mp3"
+
+	content, err := os.ReadFile(fixture)
+	require.NoError(t, err)
+
+	provider, receiver, song := newTestSongManagers(t, fixture)
+
+	stream := receiver.StreamSong(ctx, song, provider.h.ID())
+	defer stream.Close()
+
+	received, err := io.ReadAll(stream)
+	require.NoError(t, err)
+	require.Equal(t, content, received)
+
+	songPath, err := stream.Wait()
+	require.NoError(t, err)
+	require.FileExists(t, songPath)
+
+	// seeking back still works after the part file is renamed
+	_, err = stream.Seek(-128, io.SeekEnd)
+	require.NoError(t, err)
+	tail, err := io.ReadAll(stream)
+	require.NoError(t, err)
+	require.Equal(t, content[len(content)-128:], tail)
+}
+
+func TestReceiveSongStreamOversized(t *testing.T) {
+	ctx := context.Background()
+	fixture := "testdata/id3v23.mp3"
+
+	content, err := os.ReadFile(fixture)
+	require.NoError(t, err)
+
+	provider, receiver, song := newTestSongManagers(t, fixture)
+
+	// the provider sends garbage past the end of the song
+	padded := filepath.Join(t.TempDir(), "padded.mp3")
+	require.NoError(t, os.WriteFile(padded, append(bytes.Clone(content), make([]byte, 4096)...), 0644))
+	require.NoError(t, provider.filePathsStore.SaveFilePath(ctx, song.CID, padded))
+
+	songPath, err := receiver.ReceiveSongStream(ctx, song, provider.h.ID())
+	require.NoError(t, err)
+
+	received, err := os.ReadFile(songPath)
+	require.NoError(t, err)
+	require.Equal(t, content, received)
+}
+
+func TestReceiveSongStreamKeepsSameNamedFile(t *testing.T) {
+	ctx := context.Background()
+	fixture := "testdata/id3v23.mp3"
+
+	provider, receiver, song := newTestSongManagers(t, fixture)
+
+	// another song with the same artist and title
+	other := []byte("another song")
+	otherPath := receiver.songLibraryPath(song)
+	require.NoError(t, os.WriteFile(otherPath, other, 0644))
+
+	songPath, err := receiver.ReceiveSongStream(ctx, song, provider.h.ID())
+	require.NoError(t, err)
+	require.NotEqual(t, otherPath, songPath)
+	require.Contains(t, songPath, song.CID.String())
+
+	kept, err := os.ReadFile(otherPath)
+	require.NoError(t, err)
+	require.Equal(t, other, kept)
+}
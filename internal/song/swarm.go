@@ -0,0 +1,345 @@
+package song
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/multiformats/go-multistream"
+)
+
+const (
+	// swarmChunkTimeout bounds a single chunk request so one slow peer
+	// doesn't stall the whole download.
+	swarmChunkTimeout = 30 * time.Second
+
+	// swarmMaxPeerFailures drops a provider after this many failed chunks
+	// in a row.
+	swarmMaxPeerFailures = 3
+
+	// swarmMaxChunkAttempts bounds how often a chunk is requested again
+	// from a provider which already failed it.
+	swarmMaxChunkAttempts = 3
+)
+
+var (
+	errNoSongProviders = errors.New("no providers left to download the song from")
+	errNoSongRanges    = errors.New("no provider sends song ranges")
+	errSwarmChunkSize  = errors.New("song chunk larger than a DAG block")
+)
+
+type swarmChunk struct {
+	index  int
+	offset int64
+	length int64
+	block  cid.Cid // cid.Undef when the song has no DAG
+
+	done     bool
+	inFlight int
+	attempts int
+	tried    map[peer.ID]bool
+}
+
+type swarmResult struct {
+	chunk *swarmChunk
+	peer  peer.ID
+	err   error
+}
+
+// SwarmDownload downloads the song in chunks from all providers in
+// parallel, retrying failed chunks on other providers. Songs with a DAG
+// are fetched block by block and each block is verified on arrival, so a
+// bad block only costs a retry. Other songs are verified once reassembled.
+func (dm *SongManager) SwarmDownload(ctx context.Context, song Song, providers []peer.AddrInfo) (string, error) {
+	if len(providers) == 0 {
+		return "", errNoSongProviders
+	}
+
+	for _, provider := range providers {
+		dm.h.Peerstore().AddAddrs(provider.ID, provider.Addrs, peerstore.TempAddrTTL)
+	}
+
+	var chunks []*swarmChunk
+	size := song.FileSize
+
+	var dag *SongDAG
+	if hasSongDAG(song.CID) {
+		dag = dm.fetchSongDAGFromAny(ctx, song, providers)
+	}
+	if dag != nil {
+		size = dag.Size()
+		chunks = swarmChunksFromDAG(dag)
+	} else {
+		chunks = splitSwarmChunks(size)
+	}
+
+	// Without the size there is nothing to split, fall back to whole file
+	// downloads one provider after another
+	if size <= 0 {
+		return dm.receiveFromAny(ctx, song, providers)
+	}
+
+	tmpFile, err := os.CreateTemp(dm.config.MusicPath, ".*.part")
+	if err != nil {
+		dm.logger.Error("Failed to create song file", "err", err)
+		return "", err
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	if err := tmpFile.Truncate(size); err != nil {
+		return "", err
+	}
+
+	err = dm.downloadChunks(ctx, song, chunks, providers, tmpFile)
+	if errors.Is(err, errNoSongRanges) {
+		// older peers only send whole files
+		return dm.receiveFromAny(ctx, song, providers)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if dag == nil {
+		if err := verifySongFile(song, tmpFile, size); err != nil {
+			dm.logger.Error("Reassembled song doesn't match its CID", "CID", song.CID, "err", err)
+			return "", err
+		}
+	}
+
+	if err := tmpFile.Close(); err != nil {
+		return "", err
+	}
+
+	songNewFilePath := dm.songLibraryPath(song)
+	if err := os.Rename(tmpFile.Name(), songNewFilePath); err != nil {
+		dm.logger.Error("Failed to move song file into library", "err", err)
+		return "", err
+	}
+
+	dm.seedDownloadedSong(ctx, song, songNewFilePath)
+
+	return songNewFilePath, nil
+}
+
+func (dm *SongManager) fetchSongDAGFromAny(ctx context.Context, song Song, providers []peer.AddrInfo) *SongDAG {
+	for _, provider := range providers {
+		dag, err := dm.FetchSongDAG(ctx, song, provider.ID)
+		if err == nil {
+			return dag
+		}
+		dm.logger.Warn("Failed to fetch song DAG", "peer", provider.ID, "err", err)
+	}
+	return nil
+}
+
+func (dm *SongManager) receiveFromAny(ctx context.Context, song Song, providers []peer.AddrInfo) (string, error) {
+	var errs []error
+	for _, provider := range providers {
+		dm.h.Peerstore().AddAddrs(provider.ID, provider.Addrs, peerstore.TempAddrTTL)
+
+		songPath, err := dm.ReceiveSongStream(ctx, song, provider.ID)
+		if err == nil {
+			return songPath, nil
+		}
+
+		dm.logger.Warn("Failed to receive song from provider", "peer", provider.ID, "err", err)
+		errs = append(errs, err)
+	}
+
+	return "", errors.Join(errs...)
+}
+
+// downloadChunks schedules chunks on idle providers until every chunk is
+// written to out. When nothing is pending, idle providers duplicate chunks
+// still in flight elsewhere, so the slowest peer doesn't decide the
+// download time. Providers which don't speak a range protocol are
+// dropped at once, and errNoSongRanges is returned if none of them does.
+func (dm *SongManager) downloadChunks(ctx context.Context, song Song, chunks []*swarmChunk, providers []peer.AddrInfo, out io.WriterAt) error {
+	// wait for stragglers so nothing writes to out after we return
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	remaining := len(chunks)
+
+	idle := make([]peer.ID, 0, len(providers))
+	failures := make(map[peer.ID]int, len(providers))
+	for _, provider := range providers {
+		idle = append(idle, provider.ID)
+	}
+
+	results := make(chan swarmResult)
+	busy := 0
+	noRanges := 0
+
+	for remaining > 0 {
+		// hand out work to every idle provider which has something to do
+		stillIdle := idle[:0]
+		for _, p := range idle {
+			chunk := nextSwarmChunk(chunks, p)
+			if chunk == nil {
+				stillIdle = append(stillIdle, p)
+				continue
+			}
+
+			chunk.inFlight++
+			chunk.attempts++
+			chunk.tried[p] = true
+			busy++
+			wg.Add(1)
+			go func(chunk *swarmChunk, p peer.ID) {
+				defer wg.Done()
+				err := dm.fetchChunk(ctx, song, p, chunk, out)
+				select {
+				case results <- swarmResult{chunk: chunk, peer: p, err: err}:
+				case <-ctx.Done():
+				}
+			}(chunk, p)
+		}
+		idle = stillIdle
+
+		if busy == 0 {
+			if noRanges == len(providers) {
+				return errNoSongRanges
+			}
+			return errNoSongProviders
+		}
+
+		var result swarmResult
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case result = <-results:
+		}
+		busy--
+		result.chunk.inFlight--
+
+		if errors.Is(result.err, multistream.ErrNotSupported[protocol.ID]{}) {
+			dm.logger.Warn("Dropping song provider without range requests", "peer", result.peer)
+			noRanges++
+			continue
+		}
+		if result.err != nil {
+			failures[result.peer]++
+			dm.logger.Warn("Failed to fetch song chunk", "peer", result.peer, "chunk", result.chunk.index, "err", result.err)
+
+			if failures[result.peer] >= swarmMaxPeerFailures {
+				dm.logger.Warn("Dropping song provider", "peer", result.peer)
+				continue
+			}
+			idle = append(idle, result.peer)
+			continue
+		}
+
+		failures[result.peer] = 0
+		idle = append(idle, result.peer)
+		if !result.chunk.done {
+			result.chunk.done = true
+			remaining--
+		}
+	}
+
+	return nil
+}
+
+func splitSwarmChunks(size int64) []*swarmChunk {
+	chunks := make([]*swarmChunk, 0, size/songChunkSize+1)
+	for offset := int64(0); offset < size; offset += songChunkSize {
+		chunks = append(chunks, &swarmChunk{
+			index:  len(chunks),
+			offset: offset,
+			length: min(songChunkSize, size-offset),
+			tried:  make(map[peer.ID]bool),
+		})
+	}
+	return chunks
+}
+
+func swarmChunksFromDAG(dag *SongDAG) []*swarmChunk {
+	chunks := make([]*swarmChunk, 0, len(dag.Blocks))
+	for i, block := range dag.Blocks {
+		chunks = append(chunks, &swarmChunk{
+			index:  i,
+			offset: block.Offset,
+			length: block.Size,
+			block:  block.CID,
+			tried:  make(map[peer.ID]bool),
+		})
+	}
+	return chunks
+}
+
+// nextSwarmChunk picks a chunk for the provider: first pending chunks it
+// hasn't tried yet, then chunks which are in flight on other providers,
+// and only then chunks it has already failed.
+func nextSwarmChunk(chunks []*swarmChunk, p peer.ID) *swarmChunk {
+	var duplicate, retry *swarmChunk
+	for _, chunk := range chunks {
+		switch {
+		case chunk.done:
+		case !chunk.tried[p] && chunk.inFlight == 0:
+			return chunk
+		case !chunk.tried[p]:
+			if duplicate == nil {
+				duplicate = chunk
+			}
+		case chunk.inFlight == 0 && chunk.attempts < swarmMaxChunkAttempts:
+			if retry == nil {
+				retry = chunk
+			}
+		}
+	}
+
+	if duplicate != nil {
+		return duplicate
+	}
+	return retry
+}
+
+func (dm *SongManager) fetchChunk(ctx context.Context, song Song, p peer.ID, chunk *swarmChunk, out io.WriterAt) error {
+	ctx, cancel := context.WithTimeout(ctx, swarmChunkTimeout)
+	defer cancel()
+
+	r, err := dm.OpenSongRange(ctx, song, p, chunk.offset, chunk.length)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	// the stream itself doesn't watch the context
+	go func() {
+		<-ctx.Done()
+		r.Close()
+	}()
+
+	// DAG chunk sizes come from the publisher
+	if chunk.length < 0 || chunk.length > songChunkSize {
+		return fmt.Errorf("chunk %d: %w", chunk.index, errSwarmChunkSize)
+	}
+
+	buf := make([]byte, chunk.length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return fmt.Errorf("chunk %d: %w", chunk.index, err)
+	}
+
+	if chunk.block.Defined() {
+		block := SongBlock{CID: chunk.block, Offset: chunk.offset, Size: chunk.length}
+		if err := verifyBlock(block, buf); err != nil {
+			return fmt.Errorf("chunk %d: %w", chunk.index, err)
+		}
+	}
+
+	_, err = out.WriteAt(buf, chunk.offset)
+	return err
+}
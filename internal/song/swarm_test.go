@@ -0,0 +1,108 @@
+package song
+
+import (
+	"context"
+	"crypto/rand"
+	"log/slog"
+	"os"
+	"p2p-music/config"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSwarmDownload(t *testing.T) {
+	ctx := context.Background()
+
+	content := make([]byte, 5*songChunkSize+1234)
+	_, err := rand.Read(content)
+	require.NoError(t, err)
+
+	songPath := filepath.Join(t.TempDir(), "song.mp3")
+	require.NoError(t, os.WriteFile(songPath, content, 0644))
+
+	file, err := os.Open(songPath)
+	require.NoError(t, err)
+	songCID, err := GenerateSongCID(file)
+	file.Close()
+	require.NoError(t, err)
+
+	song := Song{
+		Title:    "song",
+		Format:   FormatMP3,
+		FileSize: int64(len(content)),
+		CID:      songCID,
+	}
+
+	testCases := []struct {
+		name          string
+		goodProviders int
+		badProviders  int
+		oldProviders  int
+		wantErr       error
+	}{
+		{
+			name:          "1. SwarmDownload: success: several providers",
+			goodProviders: 3,
+		},
+		{
+			name:          "2. SwarmDownload: success: providers without the file are skipped",
+			goodProviders: 1,
+			badProviders:  2,
+		},
+		{
+			name:         "3. SwarmDownload: failure: no provider has the file",
+			badProviders: 2,
+			wantErr:      errNoSongProviders,
+		},
+		{
+			name:         "4. SwarmDownload: success: providers without range requests send the whole file",
+			oldProviders: 2,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mn, err := mocknet.FullMeshConnected(1 + tc.goodProviders + tc.badProviders + tc.oldProviders)
+			require.NoError(t, err)
+			defer mn.Close()
+
+			hosts := mn.Hosts()
+			providers := make([]peer.AddrInfo, 0, len(hosts)-1)
+			for i, h := range hosts[1:] {
+				paths := make(map[cid.Cid]string)
+				old := i >= tc.goodProviders+tc.badProviders
+				if i < tc.goodProviders || old {
+					paths[songCID] = songPath
+				}
+
+				provider := NewSongManager(h, nil, nil, nil, &memFilePathsStore{paths: paths}, &config.Config{}, slog.Default())
+				provider.RegisterSongStreamingProtocols(ctx)
+				if old {
+					for _, p := range []protocol.ID{songStreamingProtocol, songStreamingProtocolV21} {
+						h.RemoveStreamHandler(p)
+					}
+				}
+				providers = append(providers, peer.AddrInfo{ID: h.ID()})
+			}
+
+			receiver := NewSongManager(hosts[0], nil, nil, nil, &memFilePathsStore{paths: make(map[cid.Cid]string)}, &config.Config{MusicPath: t.TempDir()}, slog.Default())
+
+			receivedPath, err := receiver.SwarmDownload(ctx, song, providers)
+			if tc.wantErr != nil {
+				require.ErrorIs(t, err, tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+
+			received, err := os.ReadFile(receivedPath)
+			require.NoError(t, err)
+			require.Equal(t, content, received)
+		})
+	}
+}
@@ -3,13 +3,17 @@ package song
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"io"
 	"log/slog"
 	"math/rand/v2"
+	"p2p-music/config"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/ipfs/go-cid"
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
@@ -18,51 +22,101 @@ import (
 type SongTableStore interface {
 	GetSongsList(context.Context) ([]Song, error)
 
+	GetSongsPage(ctx context.Context, after cid.Cid, limit int) ([]Song, error)
+
 	FindSongsByTitle(context.Context, string) ([]Song, error)
 
 	FindSongByTitle(ctx context.Context, title string) (Song, error)
 
 	FindSongByCID(ctx context.Context, cid cid.Cid) (Song, error)
 
-	FindSongsWithParams(context.Context, Song) ([]Song, error)
+	FindSongsWithParams(context.Context, SongQuery) ([]Song, error)
+
+	SearchSongs(ctx context.Context, query string, limit int) ([]SearchResult, error)
+
+	ApplyCatalogOp(context.Context, CatalogOp) (bool, error)
 
-	AddSong(context.Context, Song) (Song, error)
+	MergeCatalogEntries(context.Context, []CatalogEntry) error
 
-	CreateSongsList(context.Context, []Song) error
+	GetCatalogEntry(context.Context, cid.Cid) (CatalogEntry, error)
+
+	GetCatalogEntries(context.Context) ([]CatalogEntry, error)
+
+	GetCatalogEntriesPage(ctx context.Context, after cid.Cid, limit int) ([]CatalogEntry, error)
 }
 
 const (
-	songTableTopic       = "song_table"
+	// songTableTopic carries CBOR catalog operations.
+	songTableTopic = "song_table/2.0.0"
+
+	// legacySongTableTopic carries the JSON operations of older peers,
+	// they are still received but no longer published.
+	legacySongTableTopic = "song_table"
+
+	// getCatalogProtocol sends the catalog CRDT state as JSON.
+	getCatalogProtocol = "/songtable/get/1.1.0"
+
+	// getSongTableProtocol sends the visible songs as one JSON array.
+	// Still served for older peers.
 	getSongTableProtocol = "/songtable/get/1.0.0"
 )
 
+var errNoHostKey = errors.New("host has no private key to sign with")
+
 type SongTableSync struct {
 	ctx    context.Context
 	ps     *pubsub.PubSub
 	topic  *pubsub.Topic
 	sub    *pubsub.Subscription
+	legacy *pubsub.Subscription
+	h      host.Host
 	self   peer.ID
+	key    crypto.PrivKey
+	clock  *hybridClock
+	valid  *catalogValidator
 	logger *slog.Logger
 
 	songTableStore SongTableStore
 }
 
-func SetupSongTableSync(ctx context.Context, h host.Host, songTableStore SongTableStore, logger *slog.Logger) (*SongTableSync, error) {
-	ps, err := pubsub.NewGossipSub(ctx, h)
+func SetupSongTableSync(ctx context.Context, h host.Host, songTableStore SongTableStore, cfg *config.Config, logger *slog.Logger) (*SongTableSync, error) {
+	key := h.Peerstore().PrivKey(h.ID())
+	if key == nil {
+		return nil, errNoHostKey
+	}
+
+	scoreParams, scoreThresholds := songTablePeerScore(cfg)
+	ps, err := pubsub.NewGossipSub(ctx, h, pubsub.WithPeerScore(scoreParams, scoreThresholds))
 	if err != nil {
 		logger.Error("Failed to create gossipsub", "err", err)
 		return nil, err
 	}
 
-	topic, err := ps.Join(songTableTopic)
+	topicName, legacyTopicName := songTableTopicNames(cfg)
+
+	validator := newCatalogValidator(h.ID(), songTableStore, cfg)
+	for _, topicName := range []string{topicName, legacyTopicName} {
+		if err := ps.RegisterTopicValidator(topicName, validator.Validate); err != nil {
+			logger.Error("Failed to register song table validator", "topic name", topicName, "err", err)
+			return nil, err
+		}
+	}
+
+	topic, err := ps.Join(topicName)
 	if err != nil {
-		logger.Error("Gossip sub join failure", "topic name", songTableStore, "err", err)
+		logger.Error("Gossip sub join failure", "topic name", topicName, "err", err)
 		return nil, err
 	}
 
 	sub, err := topic.Subscribe()
 	if err != nil {
-		logger.Error("Subscription failure", "topic name", songTableStore, "err", err)
+		logger.Error("Subscription failure", "topic name", topicName, "err", err)
+		return nil, err
+	}
+
+	legacySub, err := ps.Subscribe(legacyTopicName)
+	if err != nil {
+		logger.Error("Subscription failure", "topic name", legacyTopicName, "err", err)
 		return nil, err
 	}
 
@@ -82,59 +136,171 @@ func SetupSongTableSync(ctx context.Context, h host.Host, songTableStore SongTab
 	//TODO: think about how to get rid of Sleep func
 	time.Sleep(time.Second)
 
-	//TODO: implement re-reveiving songs
-	songs, err := receiveSongs(ctx, h, logger)
-	if err != nil {
-		logger.Error("Failed to receive songs", "err", err)
-		return nil, err
-	}
-
-	logger.Info("Received songs", "=======songs_count========", len(songs))
-
-	if err := songTableStore.CreateSongsList(ctx, songs); err != nil {
-		return nil, err
-	}
-
 	p := &SongTableSync{
 		ctx:    ctx,
 		ps:     ps,
 		topic:  topic,
 		sub:    sub,
+		legacy: legacySub,
+		h:      h,
 		self:   h.ID(),
+		key:    key,
+		clock:  &hybridClock{peer: h.ID().String()},
+		valid:  validator,
 		logger: logger,
 
 		songTableStore: songTableStore,
 	}
 
-	songsChan := p.streamListenerLoop()
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
+	// later misses are repaired by StartAntiEntropy
+	if pHolder := getSongTableHolder(h); pHolder != "" {
+		received, err := p.ReconcileWith(ctx, pHolder)
+		if err != nil {
+			logger.Error("Failed to receive songs", "err", err)
+			return nil, err
+		}
+		logger.Info("Received songs", "=======songs_count========", received)
+	}
+
+	go p.applyOps(p.streamListenerLoop(sub))
+	go p.applyOps(p.streamListenerLoop(legacySub))
+
+	return p, nil
+}
+
+func (ts *SongTableSync) applyOps(opsChan <-chan CatalogOp) {
+	for {
+		select {
+		case <-ts.ctx.Done():
+			return
+		case op, ok := <-opsChan:
+			if !ok {
 				return
-			case song := <-songsChan:
-				logger.Info("New song received", "song title", song.Title)
-				if _, err := songTableStore.AddSong(ctx, *song); err != nil {
-					logger.Error("Failed to add song to BoltDB", "err", err)
-				}
+			}
+			ts.clock.Observe(op.Clock)
+
+			changed, err := ts.songTableStore.ApplyCatalogOp(ts.ctx, op)
+			if err != nil {
+				ts.logger.Error("Failed to apply catalog operation", "kind", op.Kind, "CID", op.CID, "err", err)
+				continue
+			}
+			if changed {
+				ts.logger.Info("Catalog operation applied", "kind", op.Kind, "song title", op.Song.Title, "CID", op.CID)
 			}
 		}
-	}()
+	}
+}
 
-	return p, nil
+// songTableTopicNames returns the song table topic and the legacy one in
+// the network namespace, so private networks gossip apart from the rest.
+func songTableTopicNames(cfg *config.Config) (string, string) {
+	if cfg.NetworkNamespace == "" {
+		return songTableTopic, legacySongTableTopic
+	}
+	return cfg.NetworkNamespace + "/" + songTableTopic, cfg.NetworkNamespace + "/" + legacySongTableTopic
 }
 
 func (ts *SongTableSync) RegisterSongTableHandlers(ctx context.Context, h host.Host) {
+	h.SetStreamHandler(reconcileProtocol, ts.handleReconcile)
+	h.SetStreamHandler(reconcileProtocolV1, ts.handleReconcile)
+	h.SetStreamHandler(getCatalogPagesProtocol, ts.sendSongTablePages)
+	h.SetStreamHandler(getCatalogProtocol, ts.sendCatalogToStream)
+	h.SetStreamHandler(getSongTableProtocolV3, ts.sendSongTablePages)
+	h.SetStreamHandler(getSongTableProtocolV2, ts.sendSongTablePages)
 	h.SetStreamHandler(getSongTableProtocol, ts.sendSongsToStream)
 }
 
+// AdvertiseSong adds the song to the global song table.
 func (ts *SongTableSync) AdvertiseSong(song Song) error {
-	songBytes, err := json.Marshal(song)
+	return ts.publishOp(CatalogOp{
+		Kind:      CatalogAdd,
+		CID:       song.CID,
+		Tag:       catalogTag(ts.self, uuid.NewString()),
+		Song:      song,
+		Clock:     ts.clock.Now(),
+		Publisher: ts.self,
+	})
+}
+
+// RemoveSong retracts our announcements of the song from the global song
+// table. The song stays while other peers share it.
+func (ts *SongTableSync) RemoveSong(songCID cid.Cid) error {
+	entry, err := ts.songTableStore.GetCatalogEntry(ts.ctx, songCID)
 	if err != nil {
 		return err
 	}
 
-	return ts.topic.Publish(ts.ctx, songBytes)
+	var tags []string
+	for _, tag := range entry.LiveTags() {
+		if ownsCatalogTag(ts.self, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) == 0 {
+		return errSongNotInCatalog
+	}
+
+	return ts.publishOp(CatalogOp{
+		Kind:      CatalogRemove,
+		CID:       songCID,
+		Tags:      tags,
+		Publisher: ts.self,
+	})
+}
+
+// EditSong replaces the metadata of the song with the same CID. The
+// latest edit wins.
+func (ts *SongTableSync) EditSong(song Song) error {
+	return ts.publishOp(CatalogOp{
+		Kind:      CatalogUpdate,
+		CID:       song.CID,
+		Song:      song,
+		Clock:     ts.clock.Now(),
+		Publisher: ts.self,
+	})
+}
+
+// publishOp applies the operation locally and gossips it signed, no
+// faster than other peers accept operations from us. The operation is
+// applied as peers open it, so our entries carry the same proofs.
+func (ts *SongTableSync) publishOp(op CatalogOp) error {
+	opBytes, err := signCatalogOp(op, ts.key)
+	if err != nil {
+		return err
+	}
+	if op, err = openCatalogOp(opBytes); err != nil {
+		return err
+	}
+	if err := ts.valid.checkFields(op); err != nil {
+		return err
+	}
+	if err := ts.valid.checkPublisher(ts.ctx, op); err != nil {
+		return err
+	}
+	if err := ts.valid.limiter(ts.self).Wait(ts.ctx); err != nil {
+		return err
+	}
+
+	if _, err := ts.songTableStore.ApplyCatalogOp(ts.ctx, op); err != nil {
+		return err
+	}
+
+	return ts.topic.Publish(ts.ctx, opBytes)
+}
+
+func (ts *SongTableSync) sendCatalogToStream(s network.Stream) {
+	defer s.Close()
+
+	entries, err := ts.songTableStore.GetCatalogEntries(ts.ctx)
+	if err != nil {
+		ts.logger.Error("Failed to get catalog from BoltDB", "err", err)
+		s.Reset()
+		return
+	}
+
+	if err := json.NewEncoder(s).Encode(entries); err != nil {
+		ts.logger.Error("Failed to write catalog to stream", "err", err)
+	}
 }
 
 func (ts *SongTableSync) sendSongsToStream(s network.Stream) {
@@ -162,51 +328,43 @@ func (ts *SongTableSync) sendSongsToStream(s network.Stream) {
 	}
 }
 
-func receiveSongs(ctx context.Context, h host.Host, logger *slog.Logger) ([]Song, error) {
-	pHolder := getSongTableHolder(h)
-	if pHolder == "" {
-		return make([]Song, 0), nil
-	}
-
-	s, err := h.NewStream(ctx, pHolder, getSongTableProtocol)
-	if err != nil {
-		logger.Error("Failed to create new stream", "err", err)
-		return nil, err
-	}
-	defer s.Close()
-
+// readSongTable merges the whole catalog a peer too old to reconcile
+// sends, but for the entries v doesn't accept. It returns the number of
+// entries merged. Songs of peers which can't send the catalog state
+// aren't taken, they would bypass it.
+func readSongTable(ctx context.Context, s network.Stream, store SongTableStore, v *catalogValidator, logger *slog.Logger) (int, error) {
 	songsBytes, err := io.ReadAll(s)
 	if err != nil {
 		logger.Error("Failed to read from stream", "err", err)
-		return nil, err
+		return 0, err
 	}
 	if len(songsBytes) == 0 {
 		logger.Info("Empty songs bytes received")
 		// TODO: return err
-		return nil, nil
+		return 0, nil
 	}
 
-	var songs []Song
-	err = json.Unmarshal(songsBytes, &songs)
-	if err != nil {
-		logger.Error("Failed to unmarshal songs", "err", err)
-		return nil, err
+	var entries []CatalogEntry
+	if err := json.Unmarshal(songsBytes, &entries); err != nil {
+		logger.Error("Failed to unmarshal catalog", "err", err)
+		return 0, err
 	}
 
-	return songs, nil
+	entries = v.openCatalogEntries(entries, logger)
+	return len(entries), store.MergeCatalogEntries(ctx, entries)
 }
 
-func (ts *SongTableSync) streamListenerLoop() <-chan *Song {
-	songsChan := make(chan *Song)
+func (ts *SongTableSync) streamListenerLoop(sub *pubsub.Subscription) <-chan CatalogOp {
+	opsChan := make(chan CatalogOp)
 
 	go func() {
-		defer close(songsChan)
+		defer close(opsChan)
 		for {
 			select {
 			case <-ts.ctx.Done():
 				return
 			default:
-				msg, err := ts.sub.Next(ts.ctx)
+				msg, err := sub.Next(ts.ctx)
 				if err != nil {
 					return
 				}
@@ -216,18 +374,18 @@ func (ts *SongTableSync) streamListenerLoop() <-chan *Song {
 					continue
 				}
 
-				song := new(Song)
-				err = json.Unmarshal(msg.Data, song)
-				if err != nil {
+				// verified by catalogValidator
+				op, ok := msg.ValidatorData.(CatalogOp)
+				if !ok {
 					continue
 				}
 
-				songsChan <- song
+				opsChan <- op
 			}
 		}
 	}()
 
-	return songsChan
+	return opsChan
 }
 
 // TODO: mb integrate method like iin ListPeers() func
@@ -241,5 +399,5 @@ func getSongTableHolder(h host.Host) peer.ID {
 
 // TODO: needed?
 func (ts *SongTableSync) ListPeers() []peer.ID {
-	return ts.ps.ListPeers(songTableTopic)
+	return ts.topic.ListPeers()
 }
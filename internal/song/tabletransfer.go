@@ -0,0 +1,289 @@
+package song
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// getCatalogPagesProtocol streams the catalog record by record: the
+// requester sends a request record, the holder answers with a record per
+// catalog entry read page by page from its store, and an empty record at
+// the end. Records are a uvarint length and the CBOR, the answer is
+// gzipped when asked for.
+const (
+	getCatalogPagesProtocol = "/songtable/get/4.0.0"
+
+	// getSongTableProtocolV3 streams the visible songs the same way,
+	// without their catalog state. Still served for older peers.
+	getSongTableProtocolV3 = "/songtable/get/3.0.0"
+
+	// getSongTableProtocolV2 is the same with JSON records. Still served
+	// for older peers.
+	getSongTableProtocolV2 = "/songtable/get/2.0.0"
+
+	songTableCompressionGzip = "gzip"
+
+	// maxSongTableRecordSize bounds a song record, bigger songs aren't sent
+	maxSongTableRecordSize = 64 << 10
+
+	// maxCatalogRecordSize bounds a catalog entry record, which also
+	// carries the tags of the entry
+	maxCatalogRecordSize = 1 << 20
+
+	// songTablePageSize of songs read from the store at once
+	songTablePageSize = 256
+
+	// songTableBatchSize of received entries stored at once
+	songTableBatchSize = 100
+)
+
+var (
+	errSongTableRecordTooLarge = errors.New("song table record too large")
+	errSongTableTruncated      = errors.New("song table stream ended early")
+	errSongTableCompression    = errors.New("unknown song table compression")
+)
+
+type songTableRequest struct {
+	// Compression of the answer, empty or gzip
+	Compression string `cbor:"1,keyasint,omitempty"`
+
+	// After is the CID to resume after
+	After string `cbor:"2,keyasint,omitempty"`
+}
+
+// songTableCodec encodes the records of a protocol version.
+type songTableCodec struct {
+	marshal   func(any) ([]byte, error)
+	unmarshal func([]byte, any) error
+}
+
+func songTableCodecOf(protocol protocol.ID) songTableCodec {
+	if protocol == getSongTableProtocolV2 {
+		return songTableCodec{marshal: json.Marshal, unmarshal: json.Unmarshal}
+	}
+	return songTableCodec{marshal: marshalWire, unmarshal: unmarshalWire}
+}
+
+func writeSongTableRecord(w io.Writer, record []byte) error {
+	if _, err := w.Write(binary.AppendUvarint(nil, uint64(len(record)))); err != nil {
+		return err
+	}
+	_, err := w.Write(record)
+	return err
+}
+
+func readSongTableRecord(r *bufio.Reader, maxSize uint64) ([]byte, error) {
+	size, err := binary.ReadUvarint(r)
+	if err == io.EOF {
+		return nil, errSongTableTruncated
+	}
+	if err != nil {
+		return nil, err
+	}
+	if size > maxSize {
+		return nil, fmt.Errorf("%w: %d bytes", errSongTableRecordTooLarge, size)
+	}
+
+	record := make([]byte, size)
+	if _, err := io.ReadFull(r, record); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errSongTableTruncated
+		}
+		return nil, err
+	}
+	return record, nil
+}
+
+func (ts *SongTableSync) sendSongTablePages(s network.Stream) {
+	defer s.Close()
+
+	if err := ts.writeSongTablePages(s); err != nil {
+		ts.logger.Error("Failed to send song table", "peer", s.Conn().RemotePeer(), "err", err)
+		s.Reset()
+	}
+}
+
+func (ts *SongTableSync) writeSongTablePages(s network.Stream) error {
+	codec := songTableCodecOf(s.Protocol())
+
+	requestRecord, err := readSongTableRecord(bufio.NewReader(s), maxSongTableRecordSize)
+	if err != nil {
+		return err
+	}
+
+	var req songTableRequest
+	if err := codec.unmarshal(requestRecord, &req); err != nil {
+		return err
+	}
+
+	var w io.Writer = s
+	switch req.Compression {
+	case "":
+	case songTableCompressionGzip:
+		gz := gzip.NewWriter(s)
+		defer gz.Close()
+		w = gz
+	default:
+		return fmt.Errorf("%w: %s", errSongTableCompression, req.Compression)
+	}
+
+	var after cid.Cid
+	if req.After != "" {
+		if after, err = cid.Decode(req.After); err != nil {
+			return err
+		}
+	}
+
+	maxSize := maxSongTableRecordSize
+	if s.Protocol() == getCatalogPagesProtocol {
+		maxSize = maxCatalogRecordSize
+	}
+
+	bw := bufio.NewWriter(w)
+	for {
+		page, last, err := ts.songTablePage(s.Protocol(), after)
+		if err != nil {
+			return err
+		}
+
+		for _, item := range page {
+			record, err := codec.marshal(item)
+			if err != nil {
+				return err
+			}
+			if len(record) > maxSize {
+				ts.logger.Warn("Song table record too large to send", "size", len(record))
+				continue
+			}
+			if err := writeSongTableRecord(bw, record); err != nil {
+				return err
+			}
+		}
+
+		if len(page) < songTablePageSize {
+			break
+		}
+		after = last
+	}
+
+	if err := writeSongTableRecord(bw, nil); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// songTablePage reads the page of the protocol after the CID from the
+// store. It returns the page and the CID of its last record.
+func (ts *SongTableSync) songTablePage(protocol protocol.ID, after cid.Cid) ([]any, cid.Cid, error) {
+	var page []any
+	var last cid.Cid
+
+	if protocol == getCatalogPagesProtocol {
+		entries, err := ts.songTableStore.GetCatalogEntriesPage(ts.ctx, after, songTablePageSize)
+		if err != nil {
+			return nil, cid.Undef, err
+		}
+		for _, entry := range entries {
+			page = append(page, entry)
+			last = entry.CID
+		}
+		return page, last, nil
+	}
+
+	songs, err := ts.songTableStore.GetSongsPage(ts.ctx, after, songTablePageSize)
+	if err != nil {
+		return nil, cid.Undef, err
+	}
+	for _, song := range songs {
+		page = append(page, song)
+		last = song.CID
+	}
+	return page, last, nil
+}
+
+// receiveCatalogPages requests the catalog of the peer on the stream and
+// merges it in batches as it arrives.
+func (ts *SongTableSync) receiveCatalogPages(ctx context.Context, s network.Stream) (int, error) {
+	request, err := marshalWire(songTableRequest{Compression: songTableCompressionGzip})
+	if err != nil {
+		return 0, err
+	}
+	if err := writeSongTableRecord(s, request); err != nil {
+		return 0, err
+	}
+	if err := s.CloseWrite(); err != nil {
+		return 0, err
+	}
+
+	return readCatalogRecords(ctx, s, songTableCompressionGzip, ts.songTableStore, ts.valid, ts.logger)
+}
+
+// readCatalogRecords merges the catalog entries of the stream. Malformed
+// records and entries v doesn't accept are skipped, the entries merged
+// before a broken stream are kept.
+func readCatalogRecords(ctx context.Context, r io.Reader, compression string, store SongTableStore, v *catalogValidator, logger *slog.Logger) (int, error) {
+	if compression == songTableCompressionGzip {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return 0, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	br := bufio.NewReader(r)
+
+	received := 0
+	batch := make([]CatalogEntry, 0, songTableBatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := store.MergeCatalogEntries(ctx, batch); err != nil {
+			return err
+		}
+		received += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+
+	for {
+		record, err := readSongTableRecord(br, maxCatalogRecordSize)
+		if err != nil {
+			// flush before reading received, it counts what it stores
+			err = errors.Join(err, flush())
+			return received, err
+		}
+		if len(record) == 0 {
+			err := flush()
+			return received, err
+		}
+
+		var entry CatalogEntry
+		if err := unmarshalWire(record, &entry); err != nil || !entry.CID.Defined() {
+			logger.Warn("Skipping malformed catalog record", "err", err)
+			continue
+		}
+		if err := v.openCatalogEntry(entry); err != nil {
+			logger.Warn("Skipping unproven catalog entry", "CID", entry.CID, "err", err)
+			continue
+		}
+
+		batch = append(batch, entry)
+		if len(batch) == songTableBatchSize {
+			if err := flush(); err != nil {
+				return received, err
+			}
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package song
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"testing"
+
+	"p2p-music/config"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// memSongsStore keeps songs sorted by CID.
+type memSongsStore struct {
+	SongTableStore
+
+	songs []Song
+}
+
+func (m *memSongsStore) GetSongsPage(ctx context.Context, after cid.Cid, limit int) ([]Song, error) {
+	var page []Song
+	for _, s := range m.songs {
+		if (!after.Defined() || s.CID.KeyString() > after.KeyString()) && len(page) < limit {
+			page = append(page, s)
+		}
+	}
+	return page, nil
+}
+
+func TestReceiveCatalogPages(t *testing.T) {
+	ctx := context.Background()
+
+	mn, err := mocknet.FullMeshConnected(2)
+	require.NoError(t, err)
+	defer mn.Close()
+
+	_, holderStore := newReconcilingSync(t, mn.Hosts()[0])
+	for i := range 1000 {
+		holderStore.add(t, i, fmt.Sprintf("song %04d", i))
+	}
+	receiver, receiverStore := newReconcilingSync(t, mn.Hosts()[1])
+
+	s, err := mn.Hosts()[1].NewStream(ctx, mn.Hosts()[0].ID(), getCatalogPagesProtocol)
+	require.NoError(t, err)
+	defer s.Close()
+
+	received, err := receiver.receiveCatalogPages(ctx, s)
+	require.NoError(t, err)
+	require.Equal(t, 1000, received)
+	require.Equal(t, holderStore.entries, receiverStore.entries)
+	for _, batch := range receiverStore.batches {
+		require.LessOrEqual(t, batch, songTableBatchSize)
+	}
+}
+
+func TestSendSongTablePages(t *testing.T) {
+	ctx := context.Background()
+
+	holderStore := &memSongsStore{}
+	for i := range 1000 {
+		holderStore.songs = append(holderStore.songs, Song{Title: fmt.Sprintf("song %04d", i), Artist: "Artist", CID: testSearchCID(t, fmt.Sprint(i))})
+	}
+	slices.SortFunc(holderStore.songs, func(a, b Song) int {
+		return strings.Compare(a.CID.KeyString(), b.CID.KeyString())
+	})
+	// too large to be sent
+	holderStore.songs = append(holderStore.songs, Song{Title: "song large", Artist: strings.Repeat("a", maxSongTableRecordSize), CID: testSearchCID(t, "large")})
+
+	for _, protocolID := range []protocol.ID{getSongTableProtocolV3, getSongTableProtocolV2} {
+		t.Run(string(protocolID), func(t *testing.T) {
+			mn, err := mocknet.FullMeshConnected(2)
+			require.NoError(t, err)
+			defer mn.Close()
+
+			holder := &SongTableSync{ctx: ctx, h: mn.Hosts()[0], logger: slog.Default(), songTableStore: holderStore}
+			holder.RegisterSongTableHandlers(ctx, mn.Hosts()[0])
+
+			s, err := mn.Hosts()[1].NewStream(ctx, mn.Hosts()[0].ID(), protocolID)
+			require.NoError(t, err)
+			defer s.Close()
+
+			codec := songTableCodecOf(protocolID)
+			request, err := codec.marshal(songTableRequest{})
+			require.NoError(t, err)
+			require.NoError(t, writeSongTableRecord(s, request))
+			require.NoError(t, s.CloseWrite())
+
+			var songs []Song
+			br := bufio.NewReader(s)
+			for {
+				record, err := readSongTableRecord(br, maxSongTableRecordSize)
+				require.NoError(t, err)
+				if len(record) == 0 {
+					break
+				}
+
+				var song Song
+				require.NoError(t, codec.unmarshal(record, &song))
+				songs = append(songs, song)
+			}
+			require.Equal(t, holderStore.songs[:1000], songs)
+		})
+	}
+}
+
+func TestReadCatalogRecords(t *testing.T) {
+	ctx := context.Background()
+
+	entry := func(i int) CatalogEntry {
+		c := testSearchCID(t, fmt.Sprint(i))
+		return signedCatalogEntry(t, CatalogOp{Kind: CatalogAdd, CID: c, Tag: testCatalogTag(t, i), Song: Song{Title: fmt.Sprint("song ", i), CID: c}, Clock: Clock{Time: 1}})
+	}
+	forged := entry(2)
+	forged.Song.Title = "forged"
+	record := func(v any) []byte {
+		b, ok := v.([]byte)
+		if !ok {
+			var err error
+			b, err = marshalWire(v)
+			require.NoError(t, err)
+		}
+
+		var buf bytes.Buffer
+		require.NoError(t, writeSongTableRecord(&buf, b))
+		return buf.Bytes()
+	}
+	stream := func(records ...[]byte) []byte {
+		return slices.Concat(records...)
+	}
+	jsonEntry, err := json.Marshal(entry(3))
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name        string
+		stream      []byte
+		wantEntries []CatalogEntry
+		wantErr     error
+	}{
+		{
+			name:        "1. readCatalogRecords: malformed record is skipped",
+			stream:      stream(record(entry(0)), record(jsonEntry), record(CatalogEntry{}), record(entry(1)), record([]byte{})),
+			wantEntries: []CatalogEntry{entry(0), entry(1)},
+		},
+		{
+			name:        "2. readCatalogRecords: entries before a truncated stream are kept",
+			stream:      stream(record(entry(0)), record(entry(1))),
+			wantEntries: []CatalogEntry{entry(0), entry(1)},
+			wantErr:     errSongTableTruncated,
+		},
+		{
+			name:        "3. readCatalogRecords: oversized record",
+			stream:      stream(record(entry(0)), []byte{0xff, 0xff, 0xff, 0x7f}),
+			wantEntries: []CatalogEntry{entry(0)},
+			wantErr:     errSongTableRecordTooLarge,
+		},
+		{
+			name:        "4. readCatalogRecords: unproven entry is skipped",
+			stream:      stream(record(entry(0)), record(forged), record(entry(1)), record([]byte{})),
+			wantEntries: []CatalogEntry{entry(0), entry(1)},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := &memCatalogStore{entries: make(map[string]CatalogEntry)}
+			v := newCatalogValidator("self", store, &config.Config{GossipMaxFieldLength: 256})
+			_, err := readCatalogRecords(ctx, bytes.NewReader(tc.stream), "", store, v, slog.Default())
+			if tc.wantErr != nil {
+				require.ErrorIs(t, err, tc.wantErr)
+			} else {
+				require.NoError(t, err)
+			}
+
+			entries, err := store.GetCatalogEntriesPage(ctx, cid.Undef, len(tc.wantEntries)+1)
+			require.NoError(t, err)
+			require.ElementsMatch(t, tc.wantEntries, entries)
+		})
+	}
+}
@@ -0,0 +1,348 @@
+package song
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"p2p-music/config"
+
+	"github.com/ipfs/go-cid"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multihash"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// maxCatalogMessageSize bounds a gossiped operation, the song
+	// metadata is small
+	maxCatalogMessageSize = 16 << 10
+
+	// maxCatalogTagLength fits a peer ID and an UUID
+	maxCatalogTagLength = 128
+
+	// maxCatalogRemoveTags a remove may retract at once
+	maxCatalogRemoveTags = 256
+
+	// maxPublishLimiters kept before the idle ones are dropped
+	maxPublishLimiters = 1024
+
+	// maxCatalogClockSkew a clock may be ahead of our wall time, later
+	// ones would win every metadata write for good
+	maxCatalogClockSkew = time.Minute
+
+	// maxCatalogEntryProofs an entry may carry, adds and removes together
+	maxCatalogEntryProofs = 1024
+)
+
+var (
+	errCatalogOpField     = errors.New("invalid catalog operation field")
+	errSongCID            = errors.New("not a song CID")
+	errCatalogOpPublisher = errors.New("song published by another peer")
+	errCatalogOpUnknown   = errors.New("song not added yet")
+	errCatalogEntryProof  = errors.New("catalog entry state not backed by its proofs")
+)
+
+// catalogEntries looks up the catalog state operations apply to.
+type catalogEntries interface {
+	GetCatalogEntry(context.Context, cid.Cid) (CatalogEntry, error)
+}
+
+// catalogValidator guards the song table topic: it drops the operations
+// which aren't signed by their publisher, don't fit the schema, edit songs
+// of other peers, or come faster than a peer may publish. Gossipsub only
+// relays the operations it accepts, and scores down the peers which send
+// rejected ones. Entries peers send outside of gossip go through the same
+// checks in openCatalogEntry.
+type catalogValidator struct {
+	self           peer.ID
+	entries        catalogEntries
+	maxFieldLength int
+	publishRate    rate.Limit
+	publishBurst   int
+
+	mu       sync.Mutex
+	limiters map[peer.ID]*rate.Limiter
+}
+
+func newCatalogValidator(self peer.ID, entries catalogEntries, cfg *config.Config) *catalogValidator {
+	return &catalogValidator{
+		self:           self,
+		entries:        entries,
+		maxFieldLength: cfg.GossipMaxFieldLength,
+		publishRate:    rate.Limit(cfg.GossipPublishRate),
+		publishBurst:   cfg.GossipPublishBurst,
+		limiters:       make(map[peer.ID]*rate.Limiter),
+	}
+}
+
+// Validate is the topic validator of the song table.
+func (v *catalogValidator) Validate(ctx context.Context, from peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+	if len(msg.Data) > maxCatalogMessageSize {
+		return pubsub.ValidationReject
+	}
+
+	// our own operations wait for the limiter in publishOp
+	publisher := msg.GetFrom()
+	if publisher != v.self && !v.limiter(publisher).Allow() {
+		// relays of a flood aren't to blame for it
+		if from != publisher {
+			return pubsub.ValidationIgnore
+		}
+		return pubsub.ValidationReject
+	}
+
+	op, err := openCatalogOp(msg.Data)
+	if err != nil || op.Publisher != publisher {
+		return pubsub.ValidationReject
+	}
+	if err := v.checkFields(op); err != nil {
+		return pubsub.ValidationReject
+	}
+	if err := v.checkPublisher(ctx, op); err != nil {
+		// the add may still be on its way
+		if errors.Is(err, errCatalogOpUnknown) {
+			return pubsub.ValidationIgnore
+		}
+		return pubsub.ValidationReject
+	}
+
+	msg.ValidatorData = op
+	return pubsub.ValidationAccept
+}
+
+// checkFields checks what Validate of the operation leaves out: CIDs,
+// clocks and the size of the fields.
+func (v *catalogValidator) checkFields(op CatalogOp) error {
+	if err := checkSongCID(op.CID); err != nil {
+		return err
+	}
+
+	if op.Kind != CatalogRemove {
+		if op.Clock.Peer != op.Publisher.String() {
+			return fmt.Errorf("%w: clock peer", errCatalogOpField)
+		}
+		if op.Clock.Time > time.Now().Add(maxCatalogClockSkew).UnixNano() {
+			return fmt.Errorf("%w: clock ahead", errCatalogOpField)
+		}
+	}
+
+	if len(op.Tag) > maxCatalogTagLength || len(op.Tags) > maxCatalogRemoveTags {
+		return fmt.Errorf("%w: tags", errCatalogOpField)
+	}
+	for _, tag := range op.Tags {
+		if len(tag) > maxCatalogTagLength {
+			return fmt.Errorf("%w: tags", errCatalogOpField)
+		}
+	}
+
+	if op.Kind == CatalogRemove {
+		return nil
+	}
+
+	s := op.Song
+	if s.CID.Defined() && !s.CID.Equals(op.CID) {
+		return fmt.Errorf("%w: song CID", errCatalogOpField)
+	}
+	for name, field := range map[string]string{"title": s.Title, "artist": s.Artist, "album": s.Album, "format": s.Format} {
+		if len(field) > v.maxFieldLength || !utf8.ValidString(field) {
+			return fmt.Errorf("%w: %s", errCatalogOpField, name)
+		}
+	}
+	if s.Year < 0 || s.Bitrate < 0 || s.FileSize < 0 || s.Duration < 0 {
+		return fmt.Errorf("%w: negative size", errCatalogOpField)
+	}
+	return nil
+}
+
+// checkPublisher checks that updates and removes come from a peer which
+// added the song.
+func (v *catalogValidator) checkPublisher(ctx context.Context, op CatalogOp) error {
+	if op.Kind == CatalogAdd {
+		return nil
+	}
+
+	entry, err := v.entries.GetCatalogEntry(ctx, op.CID)
+	if err != nil {
+		return err
+	}
+	return entry.checkPublisher(op)
+}
+
+// openCatalogEntry checks a catalog entry sent by a peer the way gossiped
+// operations are checked: it rebuilds the entry from the signed operations
+// it carries, and rejects it unless that gives the same state.
+func (v *catalogValidator) openCatalogEntry(entry CatalogEntry) error {
+	if err := checkSongCID(entry.CID); err != nil {
+		return err
+	}
+	if len(entry.Proofs) > maxCatalogEntryProofs {
+		return fmt.Errorf("%w: %d proofs", errCatalogEntryProof, len(entry.Proofs))
+	}
+
+	opened := CatalogEntry{CID: entry.CID}
+	for _, proof := range entry.Proofs {
+		op, err := v.openProof(entry.CID, proof)
+		if err != nil {
+			return err
+		}
+		if op.Kind == CatalogUpdate {
+			return fmt.Errorf("%w: update among adds and removes", errCatalogEntryProof)
+		}
+		opened.Apply(op)
+	}
+
+	if entry.MetaProof != nil {
+		op, err := v.openProof(entry.CID, entry.MetaProof)
+		if err != nil {
+			return err
+		}
+		if op.Kind == CatalogRemove {
+			return fmt.Errorf("%w: remove as metadata", errCatalogEntryProof)
+		}
+		if err := opened.checkPublisher(op); err != nil {
+			return err
+		}
+		opened.Apply(op)
+	}
+
+	want, err := catalogEntryDigest(entry)
+	if err != nil {
+		return err
+	}
+	got, err := catalogEntryDigest(opened)
+	if err != nil {
+		return err
+	}
+	if got != want {
+		return errCatalogEntryProof
+	}
+	return nil
+}
+
+// openProof opens a signed operation of the entry of the CID.
+func (v *catalogValidator) openProof(c cid.Cid, proof []byte) (CatalogOp, error) {
+	if len(proof) > maxCatalogMessageSize {
+		return CatalogOp{}, fmt.Errorf("%w: proof too large", errCatalogEntryProof)
+	}
+
+	op, err := openCatalogOp(proof)
+	if err != nil {
+		return CatalogOp{}, err
+	}
+	if !op.CID.Equals(c) {
+		return CatalogOp{}, fmt.Errorf("%w: proof of another song", errCatalogEntryProof)
+	}
+	if err := v.checkFields(op); err != nil {
+		return CatalogOp{}, err
+	}
+	return op, nil
+}
+
+// openCatalogEntries returns the entries openCatalogEntry accepts, the
+// others are logged and dropped.
+func (v *catalogValidator) openCatalogEntries(entries []CatalogEntry, logger *slog.Logger) []CatalogEntry {
+	opened := make([]CatalogEntry, 0, len(entries))
+	for _, entry := range entries {
+		if err := v.openCatalogEntry(entry); err != nil {
+			logger.Warn("Dropping unproven catalog entry", "CID", entry.CID, "err", err)
+			continue
+		}
+		opened = append(opened, entry)
+	}
+	return opened
+}
+
+// checkSongCID accepts the CIDs songs are made with: SHA2-256 of the
+// song DAG, or of the raw file for older songs.
+func checkSongCID(c cid.Cid) error {
+	if !c.Defined() || c.Version() != 1 {
+		return errSongCID
+	}
+	if c.Type() != cid.DagProtobuf && c.Type() != cid.Raw {
+		return errSongCID
+	}
+
+	mh, err := multihash.Decode(c.Hash())
+	if err != nil || mh.Code != multihash.SHA2_256 || mh.Length != 32 {
+		return errSongCID
+	}
+	return nil
+}
+
+// limiter returns the publish rate limiter of the peer.
+func (v *catalogValidator) limiter(p peer.ID) *rate.Limiter {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if l, ok := v.limiters[p]; ok {
+		return l
+	}
+
+	if len(v.limiters) >= maxPublishLimiters {
+		// a full bucket is the same as a new one
+		now := time.Now()
+		for id, l := range v.limiters {
+			if l.TokensAt(now) >= float64(v.publishBurst) {
+				delete(v.limiters, id)
+			}
+		}
+	}
+
+	l := rate.NewLimiter(v.publishRate, v.publishBurst)
+	v.limiters[p] = l
+	return l
+}
+
+// songTablePeerScore makes the gossipsub peer scoring: peers earn score
+// by being first to deliver operations and lose it, and get graylisted,
+// by delivering rejected ones.
+func songTablePeerScore(cfg *config.Config) (*pubsub.PeerScoreParams, *pubsub.PeerScoreThresholds) {
+	topicParams := &pubsub.TopicScoreParams{
+		TopicWeight: 1,
+
+		TimeInMeshWeight:  0.01,
+		TimeInMeshQuantum: time.Second,
+		TimeInMeshCap:     100,
+
+		FirstMessageDeliveriesWeight: 1,
+		FirstMessageDeliveriesDecay:  pubsub.ScoreParameterDecay(10 * time.Minute),
+		FirstMessageDeliveriesCap:    20,
+
+		InvalidMessageDeliveriesWeight: cfg.GossipInvalidMessageWeight,
+		InvalidMessageDeliveriesDecay:  pubsub.ScoreParameterDecay(time.Hour),
+	}
+
+	topicName, legacyTopicName := songTableTopicNames(cfg)
+	params := &pubsub.PeerScoreParams{
+		Topics: map[string]*pubsub.TopicScoreParams{
+			topicName:       topicParams,
+			legacyTopicName: topicParams,
+		},
+		TopicScoreCap: 50,
+
+		AppSpecificScore: func(peer.ID) float64 { return 0 },
+
+		BehaviourPenaltyWeight:    -10,
+		BehaviourPenaltyThreshold: 6,
+		BehaviourPenaltyDecay:     pubsub.ScoreParameterDecay(10 * time.Minute),
+
+		DecayInterval: time.Second,
+		DecayToZero:   0.01,
+		RetainScore:   time.Hour,
+	}
+
+	thresholds := &pubsub.PeerScoreThresholds{
+		GossipThreshold:             cfg.GossipThreshold,
+		PublishThreshold:            cfg.GossipPublishThreshold,
+		GraylistThreshold:           cfg.GossipGraylistThreshold,
+		AcceptPXThreshold:           10,
+		OpportunisticGraftThreshold: 5,
+	}
+	return params, thresholds
+}
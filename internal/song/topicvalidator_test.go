@@ -0,0 +1,307 @@
+package song
+
+import (
+	"context"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"p2p-music/config"
+
+	"github.com/ipfs/go-cid"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCatalogValidator(t *testing.T) {
+	songCID := testSearchCID(t, "angel")
+	key, id := testPeerKey(t, crypto.Ed25519)
+	otherKey, otherID := testPeerKey(t, crypto.Ed25519)
+	unknownCID := testSearchCID(t, "teardrop")
+
+	sha1Hash, err := multihash.Sum([]byte("angel"), multihash.SHA1, -1)
+	require.NoError(t, err)
+
+	add := func(edit func(*CatalogOp)) []byte {
+		op := CatalogOp{Kind: CatalogAdd, CID: songCID, Tag: catalogTag(id, "1"), Song: Song{Title: "Angel", CID: songCID}, Clock: Clock{Time: time.Now().UnixNano(), Peer: id.String()}, Publisher: id}
+		if edit != nil {
+			edit(&op)
+		}
+		data, err := signCatalogOp(op, key)
+		require.NoError(t, err)
+		return data
+	}
+	update := func(songCID cid.Cid, key crypto.PrivKey, publisher peer.ID) []byte {
+		op := CatalogOp{Kind: CatalogUpdate, CID: songCID, Song: Song{Title: "Angel (Live)"}, Clock: Clock{Time: time.Now().UnixNano(), Peer: publisher.String()}, Publisher: publisher}
+		data, err := signCatalogOp(op, key)
+		require.NoError(t, err)
+		return data
+	}
+
+	// the song is in the catalog, added by id
+	store := &memCatalogStore{entries: make(map[string]CatalogEntry)}
+	var entry CatalogEntry
+	entry.Apply(CatalogOp{Kind: CatalogAdd, CID: songCID, Tag: catalogTag(id, "1"), Song: Song{Title: "Angel"}, Publisher: id})
+	store.entries[songCID.KeyString()] = entry
+
+	testCases := []struct {
+		name   string
+		data   []byte
+		author peer.ID
+		want   pubsub.ValidationResult
+	}{
+		{
+			name:   "1. Validate: signed add",
+			data:   add(nil),
+			author: id,
+			want:   pubsub.ValidationAccept,
+		},
+		{
+			name:   "2. Validate: republished by another peer as its own",
+			data:   add(nil),
+			author: otherID,
+			want:   pubsub.ValidationReject,
+		},
+		{
+			name:   "3. Validate: malformed JSON",
+			data:   []byte(`{"Op":`),
+			author: id,
+			want:   pubsub.ValidationReject,
+		},
+		{
+			name:   "4. Validate: empty title",
+			data:   add(func(op *CatalogOp) { op.Song.Title = "" }),
+			author: id,
+			want:   pubsub.ValidationReject,
+		},
+		{
+			name:   "5. Validate: not a song CID",
+			data:   add(func(op *CatalogOp) { op.CID = cid.NewCidV1(cid.Raw, sha1Hash); op.Song.CID = op.CID }),
+			author: id,
+			want:   pubsub.ValidationReject,
+		},
+		{
+			name:   "6. Validate: song of another CID",
+			data:   add(func(op *CatalogOp) { op.Song.CID = testSearchCID(t, "teardrop") }),
+			author: id,
+			want:   pubsub.ValidationReject,
+		},
+		{
+			name:   "7. Validate: too long field",
+			data:   add(func(op *CatalogOp) { op.Song.Artist = strings.Repeat("a", 300) }),
+			author: id,
+			want:   pubsub.ValidationReject,
+		},
+		{
+			name:   "8. Validate: clock far ahead",
+			data:   add(func(op *CatalogOp) { op.Clock.Time = math.MaxInt64 }),
+			author: id,
+			want:   pubsub.ValidationReject,
+		},
+		{
+			name:   "9. Validate: clock of another peer",
+			data:   add(func(op *CatalogOp) { op.Clock.Peer = otherID.String() }),
+			author: id,
+			want:   pubsub.ValidationReject,
+		},
+		{
+			name:   "10. Validate: update by the publisher",
+			data:   update(songCID, key, id),
+			author: id,
+			want:   pubsub.ValidationAccept,
+		},
+		{
+			name:   "11. Validate: update of the song of another peer",
+			data:   update(songCID, otherKey, otherID),
+			author: otherID,
+			want:   pubsub.ValidationReject,
+		},
+		{
+			name:   "12. Validate: update before the add",
+			data:   update(unknownCID, key, id),
+			author: id,
+			want:   pubsub.ValidationIgnore,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			v := newCatalogValidator("self", store, &config.Config{GossipPublishRate: 1, GossipPublishBurst: 10, GossipMaxFieldLength: 256})
+
+			msg := &pubsub.Message{Message: &pb.Message{Data: tc.data, From: []byte(tc.author)}}
+			require.Equal(t, tc.want, v.Validate(context.Background(), tc.author, msg))
+			if tc.want == pubsub.ValidationAccept {
+				require.Equal(t, id, msg.ValidatorData.(CatalogOp).Publisher)
+			}
+		})
+	}
+}
+
+func TestCatalogValidatorRate(t *testing.T) {
+	songCID := testSearchCID(t, "angel")
+	key, id := testPeerKey(t, crypto.Ed25519)
+	_, relay := testPeerKey(t, crypto.Ed25519)
+
+	data, err := signCatalogOp(CatalogOp{Kind: CatalogAdd, CID: songCID, Tag: catalogTag(id, "1"), Song: Song{Title: "Angel"}, Clock: Clock{Time: 1, Peer: id.String()}, Publisher: id}, key)
+	require.NoError(t, err)
+	msg := func() *pubsub.Message {
+		return &pubsub.Message{Message: &pb.Message{Data: data, From: []byte(id)}}
+	}
+
+	v := newCatalogValidator("self", nil, &config.Config{GossipPublishRate: 0.001, GossipPublishBurst: 3, GossipMaxFieldLength: 256})
+	for range 3 {
+		require.Equal(t, pubsub.ValidationAccept, v.Validate(context.Background(), id, msg()))
+	}
+
+	// the flood is ignored when relayed, rejected from its publisher
+	require.Equal(t, pubsub.ValidationIgnore, v.Validate(context.Background(), relay, msg()))
+	require.Equal(t, pubsub.ValidationReject, v.Validate(context.Background(), id, msg()))
+}
+
+func TestSongTablePeerScore(t *testing.T) {
+	mn, err := mocknet.FullMeshConnected(1)
+	require.NoError(t, err)
+	defer mn.Close()
+
+	params, thresholds := songTablePeerScore(&config.Config{GossipInvalidMessageWeight: -10, GossipThreshold: -10, GossipPublishThreshold: -50, GossipGraylistThreshold: -80})
+	_, err = pubsub.NewGossipSub(context.Background(), mn.Hosts()[0], pubsub.WithPeerScore(params, thresholds))
+	require.NoError(t, err)
+}
+
+func TestSongTableTopicNames(t *testing.T) {
+	topic, legacy := songTableTopicNames(&config.Config{})
+	require.Equal(t, songTableTopic, topic)
+	require.Equal(t, legacySongTableTopic, legacy)
+
+	topic, legacy = songTableTopicNames(&config.Config{NetworkNamespace: "lan"})
+	require.Equal(t, "lan/"+songTableTopic, topic)
+	require.Equal(t, "lan/"+legacySongTableTopic, legacy)
+}
+
+func TestOpenCatalogEntry(t *testing.T) {
+	songCID := testSearchCID(t, "angel")
+	otherCID := testSearchCID(t, "teardrop")
+	key, id := testPeerKey(t, crypto.Ed25519)
+	otherKey, otherID := testPeerKey(t, crypto.Ed25519)
+
+	open := func(key crypto.PrivKey, op CatalogOp) CatalogOp {
+		data, err := signCatalogOp(op, key)
+		require.NoError(t, err)
+		op, err = openCatalogOp(data)
+		require.NoError(t, err)
+		return op
+	}
+	clock := func(id peer.ID, time int64) Clock {
+		return Clock{Time: time, Peer: id.String()}
+	}
+	add := open(key, CatalogOp{Kind: CatalogAdd, CID: songCID, Tag: catalogTag(id, "1"), Song: Song{Title: "Angel", CID: songCID}, Clock: clock(id, 1), Publisher: id})
+	otherAdd := open(otherKey, CatalogOp{Kind: CatalogAdd, CID: otherCID, Tag: catalogTag(otherID, "1"), Song: Song{Title: "Teardrop", CID: otherCID}, Clock: clock(otherID, 1), Publisher: otherID})
+	update := open(key, CatalogOp{Kind: CatalogUpdate, CID: songCID, Song: Song{Title: "Angel (Live)"}, Clock: clock(id, 2), Publisher: id})
+	otherUpdate := open(otherKey, CatalogOp{Kind: CatalogUpdate, CID: songCID, Song: Song{Title: "Angel (Live)"}, Clock: clock(otherID, 2), Publisher: otherID})
+	remove := open(key, CatalogOp{Kind: CatalogRemove, CID: songCID, Tags: []string{add.Tag}, Publisher: id})
+
+	entry := func(ops ...CatalogOp) CatalogEntry {
+		var entry CatalogEntry
+		for _, op := range ops {
+			entry.Apply(op)
+		}
+		return entry
+	}
+	edit := func(entry CatalogEntry, edit func(*CatalogEntry)) CatalogEntry {
+		edit(&entry)
+		return entry
+	}
+
+	testCases := []struct {
+		name    string
+		entry   CatalogEntry
+		wantErr bool
+	}{
+		{
+			name:  "1. openCatalogEntry: added, edited and removed",
+			entry: entry(add, update, remove),
+		},
+		{
+			name:    "2. openCatalogEntry: state without proofs",
+			entry:   edit(entry(add), func(e *CatalogEntry) { e.Proofs, e.MetaProof = nil, nil }),
+			wantErr: true,
+		},
+		{
+			name:    "3. openCatalogEntry: metadata changed after signing",
+			entry:   edit(entry(add, update), func(e *CatalogEntry) { e.Song.Artist = "Massive Attack" }),
+			wantErr: true,
+		},
+		{
+			name:    "4. openCatalogEntry: tag without an add",
+			entry:   edit(entry(add), func(e *CatalogEntry) { e.Adds = append(e.Adds, catalogTag(otherID, "2")) }),
+			wantErr: true,
+		},
+		{
+			name:    "5. openCatalogEntry: proof of another song",
+			entry:   edit(entry(add), func(e *CatalogEntry) { e.Proofs = append(e.Proofs, otherAdd.Signed) }),
+			wantErr: true,
+		},
+		{
+			name:    "6. openCatalogEntry: edit by a peer which didn't add the song",
+			entry:   entry(add, otherUpdate),
+			wantErr: true,
+		},
+		{
+			name:    "7. openCatalogEntry: too many proofs",
+			entry:   edit(entry(add), func(e *CatalogEntry) { e.Proofs = make([][]byte, maxCatalogEntryProofs+1) }),
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			v := newCatalogValidator("self", nil, &config.Config{GossipMaxFieldLength: 256})
+
+			err := v.openCatalogEntry(tc.entry)
+			if tc.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestCatalogValidatorForeignAdd(t *testing.T) {
+	songCID := testSearchCID(t, "angel")
+	key, id := testPeerKey(t, crypto.Ed25519)
+	otherKey, otherID := testPeerKey(t, crypto.Ed25519)
+
+	signed := func(key crypto.PrivKey, op CatalogOp) []byte {
+		data, err := signCatalogOp(op, key)
+		require.NoError(t, err)
+		return data
+	}
+
+	// the song is in the catalog, added by id
+	owned, err := openCatalogOp(signed(key, CatalogOp{Kind: CatalogAdd, CID: songCID, Tag: catalogTag(id, "1"), Song: Song{Title: "Angel", CID: songCID}, Clock: Clock{Time: 1, Peer: id.String()}, Publisher: id}))
+	require.NoError(t, err)
+	var entry CatalogEntry
+	entry.Apply(owned)
+	store := &memCatalogStore{entries: map[string]CatalogEntry{songCID.KeyString(): entry}}
+
+	// another peer adds it again with its own metadata and a newer clock
+	data := signed(otherKey, CatalogOp{Kind: CatalogAdd, CID: songCID, Tag: catalogTag(otherID, "1"), Song: Song{Title: "Not Angel", CID: songCID}, Clock: Clock{Time: time.Now().UnixNano(), Peer: otherID.String()}, Publisher: otherID})
+
+	v := newCatalogValidator("self", store, &config.Config{GossipPublishRate: 1, GossipPublishBurst: 10, GossipMaxFieldLength: 256})
+	msg := &pubsub.Message{Message: &pb.Message{Data: data, From: []byte(otherID)}}
+	require.Equal(t, pubsub.ValidationAccept, v.Validate(context.Background(), otherID, msg))
+
+	// it shares the song, but the metadata stays the owner's
+	require.True(t, entry.Apply(msg.ValidatorData.(CatalogOp)))
+	require.Equal(t, "Angel", entry.Song.Title)
+	require.Equal(t, id, entry.Song.Publisher)
+	require.Len(t, entry.LiveTags(), 2)
+	require.NoError(t, v.openCatalogEntry(entry))
+}
@@ -0,0 +1,240 @@
+package song
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	oggPageHeaderSize = 27
+
+	// oggTailWindow is how much of the file end we scan for the last page
+	// to read the final granule position.
+	oggTailWindow = 64 * 1024
+
+	// vorbisHeaderLimit bounds the identification and comment packets so a
+	// corrupt file can't make us buffer it whole.
+	vorbisHeaderLimit = 1 << 20
+)
+
+var errBadOggPage = errors.New("bad ogg page")
+
+type oggPage struct {
+	granule  int64
+	serial   uint32
+	segments []byte
+	size     int64 // header plus body
+}
+
+func readOggPage(r io.ReaderAt, offset int64) (oggPage, error) {
+	header := make([]byte, oggPageHeaderSize)
+	if _, err := r.ReadAt(header, offset); err != nil {
+		return oggPage{}, err
+	}
+	if !bytes.HasPrefix(header, []byte("OggS")) || header[4] != 0 {
+		return oggPage{}, errBadOggPage
+	}
+
+	segments := make([]byte, header[26])
+	if _, err := r.ReadAt(segments, offset+oggPageHeaderSize); err != nil {
+		return oggPage{}, err
+	}
+
+	var bodySize int64
+	for _, s := range segments {
+		bodySize += int64(s)
+	}
+
+	return oggPage{
+		granule:  int64(binary.LittleEndian.Uint64(header[6:14])),
+		serial:   binary.LittleEndian.Uint32(header[14:18]),
+		segments: segments,
+		size:     oggPageHeaderSize + int64(len(segments)) + bodySize,
+	}, nil
+}
+
+// readOggPackets returns the first n packets of the first logical stream.
+func readOggPackets(r io.ReaderAt, size int64, n int) ([][]byte, uint32, error) {
+	var (
+		packets [][]byte
+		current []byte
+		serial  uint32
+		offset  int64
+		total   int
+	)
+
+	for offset < size && len(packets) < n {
+		page, err := readOggPage(r, offset)
+		if err != nil {
+			return packets, serial, err
+		}
+		if offset == 0 {
+			serial = page.serial
+		}
+
+		bodyOffset := offset + oggPageHeaderSize + int64(len(page.segments))
+		offset += page.size
+		if page.serial != serial {
+			continue
+		}
+
+		for _, segment := range page.segments {
+			if segment > 0 {
+				data := make([]byte, segment)
+				if _, err := r.ReadAt(data, bodyOffset); err != nil {
+					return packets, serial, err
+				}
+				current = append(current, data...)
+				bodyOffset += int64(segment)
+
+				total += int(segment)
+				if total > vorbisHeaderLimit {
+					return packets, serial, errBadOggPage
+				}
+			}
+
+			if segment < 255 {
+				packets = append(packets, current)
+				current = nil
+				if len(packets) == n {
+					break
+				}
+			}
+		}
+	}
+
+	return packets, serial, nil
+}
+
+func readOGGMetadata(r io.ReaderAt, size int64) metadata {
+	var meta metadata
+
+	packets, serial, _ := readOggPackets(r, size, 2)
+	if len(packets) == 0 {
+		return meta
+	}
+
+	sampleRate, nominalBitrate, ok := parseVorbisIdentification(packets[0])
+	if !ok {
+		return meta
+	}
+
+	if len(packets) > 1 {
+		meta.merge(parseVorbisComments(packets[1]))
+	}
+
+	if granule := lastOggGranule(r, size, serial); granule > 0 && sampleRate > 0 {
+		meta.Duration = time.Duration(granule) * time.Second / time.Duration(sampleRate)
+	}
+
+	switch {
+	case nominalBitrate > 0:
+		meta.Bitrate = nominalBitrate / 1000
+	case meta.Duration > 0:
+		meta.Bitrate = int(float64(size) * 8 / meta.Duration.Seconds() / 1000)
+	}
+
+	return meta
+}
+
+func parseVorbisIdentification(packet []byte) (int, int, bool) {
+	if len(packet) < 30 || packet[0] != 0x01 || string(packet[1:7]) != "vorbis" {
+		return 0, 0, false
+	}
+
+	sampleRate := int(binary.LittleEndian.Uint32(packet[12:16]))
+	nominalBitrate := int(int32(binary.LittleEndian.Uint32(packet[20:24])))
+
+	return sampleRate, nominalBitrate, true
+}
+
+func parseVorbisComments(packet []byte) metadata {
+	var meta metadata
+	if len(packet) < 7 || packet[0] != 0x03 || string(packet[1:7]) != "vorbis" {
+		return meta
+	}
+
+	comments := parseVorbisCommentList(packet[7:])
+	meta.Title = comments["TITLE"]
+	meta.Artist = comments["ARTIST"]
+	if meta.Artist == "" {
+		meta.Artist = comments["ALBUMARTIST"]
+	}
+	meta.Album = comments["ALBUM"]
+	meta.Year = parseYear(comments["DATE"])
+	if meta.Year == 0 {
+		meta.Year = parseYear(comments["YEAR"])
+	}
+
+	return meta
+}
+
+// parseVorbisCommentList parses the vendor string and the list of
+// "KEY=value" comments shared by Vorbis and FLAC.
+func parseVorbisCommentList(data []byte) map[string]string {
+	comments := make(map[string]string)
+
+	next := func() ([]byte, bool) {
+		if len(data) < 4 {
+			return nil, false
+		}
+		length := int(binary.LittleEndian.Uint32(data))
+		if length < 0 || 4+length > len(data) {
+			return nil, false
+		}
+		value := data[4 : 4+length]
+		data = data[4+length:]
+		return value, true
+	}
+
+	if _, ok := next(); !ok { // vendor
+		return comments
+	}
+	if len(data) < 4 {
+		return comments
+	}
+	count := int(binary.LittleEndian.Uint32(data))
+	data = data[4:]
+
+	for i := 0; i < count; i++ {
+		comment, ok := next()
+		if !ok {
+			break
+		}
+
+		key, value, ok := strings.Cut(string(comment), "=")
+		if !ok {
+			continue
+		}
+		key = strings.ToUpper(key)
+		if _, exists := comments[key]; !exists {
+			comments[key] = cleanTagValue(value)
+		}
+	}
+
+	return comments
+}
+
+// lastOggGranule returns the granule position of the last page of the
+// stream, which for Vorbis is the total number of samples.
+func lastOggGranule(r io.ReaderAt, size int64, serial uint32) int64 {
+	start := max(0, size-oggTailWindow)
+	tail := make([]byte, size-start)
+	if _, err := r.ReadAt(tail, start); err != nil && err != io.EOF {
+		return 0
+	}
+
+	for i := bytes.LastIndex(tail, []byte("OggS")); i >= 0; i = bytes.LastIndex(tail[:i], []byte("OggS")) {
+		page, err := readOggPage(r, start+int64(i))
+		if err != nil || page.serial != serial || page.granule < 0 {
+			continue
+		}
+		return page.granule
+	}
+
+	return 0
+}
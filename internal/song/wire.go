@@ -0,0 +1,86 @@
+package song
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Protocol messages are CBOR maps with integer keys, encoded in the core
+// deterministic form so the same message always has the same bytes. CIDs
+// and peer IDs are sent as their binary form. Keys are never reused and
+// unknown keys are skipped, so fields can be added without a new version.
+//
+// Streams are versioned by their protocol ID and gossip by the Version of
+// its envelope. The JSON versions are still decoded and served for older
+// peers.
+const wireVersion = 1
+
+var errWireVersion = errors.New("unsupported wire format version")
+
+var (
+	wireEncMode = mustWireEncMode()
+	wireDecMode = mustWireDecMode()
+)
+
+func mustWireEncMode() cbor.EncMode {
+	mode, err := cbor.CoreDetEncOptions().EncMode()
+	if err != nil {
+		panic(err)
+	}
+	return mode
+}
+
+func mustWireDecMode() cbor.DecMode {
+	mode, err := cbor.DecOptions{
+		DupMapKey:   cbor.DupMapKeyEnforcedAPF,
+		IndefLength: cbor.IndefLengthForbidden,
+	}.DecMode()
+	if err != nil {
+		panic(err)
+	}
+	return mode
+}
+
+func marshalWire(v any) ([]byte, error) {
+	return wireEncMode.Marshal(v)
+}
+
+func unmarshalWire(data []byte, v any) error {
+	return wireDecMode.Unmarshal(data, v)
+}
+
+// wireEncoder and wireDecoder are implemented by both the CBOR and the
+// JSON streams, so a handler can speak either protocol version.
+type wireEncoder interface {
+	Encode(v any) error
+}
+
+type wireDecoder interface {
+	Decode(v any) error
+}
+
+func newWireEncoder(w io.Writer) wireEncoder {
+	return wireEncMode.NewEncoder(w)
+}
+
+func newWireDecoder(r io.Reader) wireDecoder {
+	return wireDecMode.NewDecoder(r)
+}
+
+// isJSONMessage tells the JSON messages of older peers from CBOR ones,
+// which are maps and never start with a brace.
+func isJSONMessage(data []byte) bool {
+	data = bytes.TrimLeft(data, " \t\r\n")
+	return len(data) > 0 && data[0] == '{'
+}
+
+func checkWireVersion(version int) error {
+	if version > wireVersion {
+		return fmt.Errorf("%w: %d", errWireVersion, version)
+	}
+	return nil
+}
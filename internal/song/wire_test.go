@@ -0,0 +1,75 @@
+package song
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWireRoundTrip(t *testing.T) {
+	_, publisher := testPeerKey(t, crypto.Ed25519)
+	songCID := testSearchCID(t, "angel")
+	angel := Song{
+		Title:     "Angel",
+		Artist:    "Massive Attack",
+		Year:      1998,
+		Duration:  6*time.Minute + 19*time.Second,
+		CID:       songCID,
+		Publisher: publisher,
+	}
+	entry := CatalogEntry{CID: songCID, Song: angel, Clock: Clock{Time: 2, Peer: "b"}, Adds: []string{"a", "b"}, Removes: []string{"a"}}
+
+	testCases := []struct {
+		name string
+		in   any
+		out  any
+	}{
+		{
+			name: "1. marshalWire: song",
+			in:   &angel,
+			out:  &Song{},
+		},
+		{
+			name: "2. marshalWire: catalog entry",
+			in:   &entry,
+			out:  &CatalogEntry{},
+		},
+		{
+			name: "3. marshalWire: search hit",
+			in:   &SearchHit{Song: angel, Score: 0.5},
+			out:  &SearchHit{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			data, err := marshalWire(tc.in)
+			require.NoError(t, err)
+			require.False(t, isJSONMessage(data))
+
+			again, err := marshalWire(tc.in)
+			require.NoError(t, err)
+			require.Equal(t, data, again, "encoding is deterministic")
+
+			require.NoError(t, unmarshalWire(data, tc.out))
+			require.Equal(t, tc.in, tc.out)
+		})
+	}
+}
+
+func TestUnmarshalWireUnknownFields(t *testing.T) {
+	// a newer peer sending a field we don't know yet
+	data, err := marshalWire(map[int]any{1: "Angel", 99: "unknown"})
+	require.NoError(t, err)
+
+	var s Song
+	require.NoError(t, unmarshalWire(data, &s))
+	require.Equal(t, "Angel", s.Title)
+
+	legacy, err := json.Marshal(Song{Title: "Angel"})
+	require.NoError(t, err)
+	require.True(t, isJSONMessage(legacy))
+}
@@ -0,0 +1,154 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"p2p-music/internal/player"
+	"p2p-music/internal/song"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	seekStep   = 10 * time.Second
+	volumeStep = 0.1
+)
+
+var (
+	errNoSongs         = errors.New("song list is empty")
+	errNoSongProviders = errors.New("nobody provides the song")
+)
+
+// SongSource finds where a song can be played from.
+type SongSource interface {
+	LocalSongPath(context.Context, song.Song) (string, error)
+
+	FindSongProviders(context.Context, song.Song) ([]peer.AddrInfo, error)
+
+	StreamSong(context.Context, song.Song, peer.ID) *song.SongStream
+}
+
+type playerEventMsg player.Event
+
+type playErrMsg struct {
+	err error
+}
+
+// waitPlayerEvent delivers the next player event to Update.
+func waitPlayerEvent(p *player.Player) tea.Cmd {
+	return func() tea.Msg {
+		e, ok := <-p.Events()
+		if !ok {
+			return nil
+		}
+		return playerEventMsg(e)
+	}
+}
+
+func playRandomSong(ts song.SongTableStore, songs SongSource, p *player.Player) tea.Cmd {
+	return func() tea.Msg {
+		ctx := context.Background()
+
+		songsList, err := ts.GetSongsList(ctx)
+		if err != nil {
+			return playErrMsg{err: err}
+		}
+		if len(songsList) == 0 {
+			return playErrMsg{err: errNoSongs}
+		}
+
+		s := songsList[rand.IntN(len(songsList))]
+		src, err := openSong(ctx, songs, s)
+		if err != nil {
+			return playErrMsg{err: err}
+		}
+
+		if err := p.Play(src); err != nil {
+			return playErrMsg{err: err}
+		}
+		return nil
+	}
+}
+
+// openSong plays the local copy if there is one, otherwise it streams the
+// song from a provider while downloading it.
+func openSong(ctx context.Context, songs SongSource, s song.Song) (player.Source, error) {
+	songPath, err := songs.LocalSongPath(ctx, s)
+	if err != nil {
+		return player.Source{}, err
+	}
+	if songPath != "" {
+		return player.OpenFile(s, songPath)
+	}
+
+	providers, err := songs.FindSongProviders(ctx, s)
+	if err != nil {
+		return player.Source{}, err
+	}
+	if len(providers) == 0 {
+		return player.Source{}, errNoSongProviders
+	}
+
+	return player.StreamSource(s, songs.StreamSong(ctx, s, providers[0].ID)), nil
+}
+
+// updatePlayer handles the playback keys.
+func (t Tea) updatePlayer(key string) Tea {
+	switch key {
+	case "p":
+		switch t.status.State {
+		case player.Playing:
+			t.player.Pause()
+		case player.Paused:
+			t.player.Resume()
+		}
+	case "s":
+		t.player.Stop()
+	case "+", "=":
+		t.player.SetVolume(t.player.Volume() + volumeStep)
+	case "-":
+		t.player.SetVolume(t.player.Volume() - volumeStep)
+	case "left":
+		t.err = t.player.Seek(t.status.Position - seekStep)
+	case "right":
+		t.err = t.player.Seek(t.status.Position + seekStep)
+	}
+	return t
+}
+
+func (t Tea) playerView() string {
+	s := ""
+	if t.status.State != player.Stopped {
+		playing := t.status.Source.Song
+		name := playing.Title
+		if playing.Artist != "" {
+			name = playing.Artist + " - " + name
+		}
+		if playing.Publisher != "" {
+			name += " (shared by " + shortPeerID(playing.Publisher) + ")"
+		}
+
+		s += fmt.Sprintf("\n[%s] %s  %s / %s  vol %d%%\n",
+			t.status.State, name,
+			formatDuration(t.status.Position), formatDuration(t.status.Duration),
+			int(t.player.Volume()*100+0.5))
+	}
+
+	err := t.err
+	if err == nil {
+		err = t.status.Err
+	}
+	if err != nil {
+		s += fmt.Sprintf("\nPlayback error: %v\n", err)
+	}
+	return s
+}
+
+func formatDuration(d time.Duration) string {
+	d = d.Round(time.Second)
+	return fmt.Sprintf("%d:%02d", int(d.Minutes()), int(d.Seconds())%60)
+}
@@ -2,8 +2,10 @@ package model
 
 import (
 	"fmt"
+	"p2p-music/internal/song"
 
 	tea "github.com/charmbracelet/bubbletea"
+	"github.com/libp2p/go-libp2p/core/peer"
 )
 
 type SongList struct {
@@ -94,3 +96,20 @@ func (sl SongList) View() string {
 	// Send the UI for rendering
 	return s
 }
+
+// songListItem names the song and the peer which shared it.
+func songListItem(s song.Song) string {
+	if s.Publisher == "" {
+		return s.Title
+	}
+	return fmt.Sprintf("%s  (shared by %s)", s.Title, shortPeerID(s.Publisher))
+}
+
+// shortPeerID abbreviates the peer ID like libp2p logs do.
+func shortPeerID(p peer.ID) string {
+	id := p.String()
+	if len(id) <= 10 {
+		return id
+	}
+	return id[:2] + "*" + id[len(id)-6:]
+}
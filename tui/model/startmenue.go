@@ -3,9 +3,11 @@ package model
 import (
 	"context"
 	"fmt"
+	"p2p-music/internal/player"
 	"p2p-music/internal/song"
 
 	tea "github.com/charmbracelet/bubbletea"
+	"github.com/libp2p/go-libp2p/core/network"
 )
 
 type Tea struct {
@@ -15,25 +17,50 @@ type Tea struct {
 
 	songTableManager song.SongTableSynchronizer
 	ts               song.SongTableStore
+
+	songs  SongSource
+	player *player.Player
+	status player.Event
+	err    error
+
+	reachabilityEvents <-chan network.Reachability
+	reachability       network.Reachability
 }
 
-func InitTea(songTableManager song.SongTableSynchronizer, ts song.SongTableStore) Tea {
+func InitTea(songTableManager song.SongTableSynchronizer, ts song.SongTableStore, songs SongSource, p *player.Player, reachability <-chan network.Reachability) Tea {
 	return Tea{
 		choices:  StartMenueChoice,
 		selected: make(map[int]struct{}),
 
 		songTableManager: songTableManager,
 		ts:               ts,
+
+		songs:  songs,
+		player: p,
+
+		reachabilityEvents: reachability,
 	}
 }
 
 func (t Tea) Init() tea.Cmd {
-	return nil
+	return tea.Batch(waitPlayerEvent(t.player), waitReachability(t.reachabilityEvents))
 }
 
 func (t Tea) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	switch msg := msg.(type) {
 
+	case playerEventMsg:
+		t.status = player.Event(msg)
+		return t, waitPlayerEvent(t.player)
+
+	case playErrMsg:
+		t.err = msg.err
+		return t, nil
+
+	case reachabilityMsg:
+		t.reachability = network.Reachability(msg)
+		return t, waitReachability(t.reachabilityEvents)
+
 	// Is it a key press?
 	case tea.KeyMsg:
 
@@ -44,6 +71,9 @@ func (t Tea) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		case "ctrl+c", "q":
 			return t, tea.Quit
 
+		case "p", "s", "+", "=", "-", "left", "right":
+			return t.updatePlayer(msg.String()), nil
+
 		// The "up" and "k" keys move the cursor up
 		case "up", "k":
 			if t.cursor > 0 {
@@ -71,10 +101,14 @@ func (t Tea) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				songList := InitSongList()
 				songs, _ := t.ts.GetSongsList(context.Background())
 				for _, song := range songs {
-					songList.songs = append(songList.songs, song.Title)
+					songList.songs = append(songList.songs, songListItem(song))
 				}
 
 				return songList, nil
+
+			case "Play random song":
+				t.err = nil
+				return t, playRandomSong(t.ts, t.songs, t.player)
 			}
 
 		}
@@ -108,9 +142,37 @@ func (t Tea) View() string {
 		s += fmt.Sprintf("%s [%s] %s\n", cursor, checked, choice)
 	}
 
+	s += t.playerView()
+	s += t.reachabilityView()
+
 	// The footer
+	s += "\np pause, s stop, +/- volume, left/right seek\n"
 	s += "\nPress q to quit.\n"
 
 	// Send the UI for rendering
 	return s
 }
+
+type reachabilityMsg network.Reachability
+
+// waitReachability delivers the next reachability change to Update.
+func waitReachability(events <-chan network.Reachability) tea.Cmd {
+	return func() tea.Msg {
+		r, ok := <-events
+		if !ok {
+			return nil
+		}
+		return reachabilityMsg(r)
+	}
+}
+
+func (t Tea) reachabilityView() string {
+	switch t.reachability {
+	case network.ReachabilityPublic:
+		return "\nNetwork: publicly reachable\n"
+	case network.ReachabilityPrivate:
+		return "\nNetwork: behind a NAT, connecting through relays\n"
+	default:
+		return "\nNetwork: checking reachability...\n"
+	}
+}